@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gdamore/tcell/v2"
+	openfga "github.com/openfga/go-sdk"
+	"github.com/paulosuzart/fgamanager/db"
+	"github.com/rivo/tview"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/user"
+	"strings"
+	"sync"
+	"time"
+)
+
+// operator is who runs fgamanager, as the OS knows it
+var operator = sync.OnceValue(func() string {
+	if current, err := user.Current(); err == nil {
+		return current.Username
+	}
+	if name := os.Getenv("USER"); name != "" {
+		return name
+	}
+	return "unknown"
+})
+
+// auditJournal is the optional JSON lines copy of the audit log, shared by every store
+type auditJournal struct {
+	lock sync.Mutex
+	file *os.File
+}
+
+// openAuditJournal appends to path, there's no journal if path is empty
+func openAuditJournal(path string) (*auditJournal, error) {
+	if path == "" {
+		return nil, nil
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditJournal{file: file}, nil
+}
+
+func (j *auditJournal) append(entry db.AuditEntry) error {
+	if j == nil {
+		return nil
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	_, err = j.file.Write(append(line, '\n'))
+	return err
+}
+
+func (j *auditJournal) close() {
+	if j != nil {
+		_ = j.file.Close()
+	}
+}
+
+// auditedFga records every write and delete it sends, whatever the server answers
+type auditedFga struct {
+	fgaService
+	inner   fgaService
+	config  storeConfig
+	repo    db.AuditRepository
+	journal *auditJournal
+}
+
+func (a *auditedFga) write(ctx context.Context, tuple *openfga.WriteRequestWrites) (*http.Response, error) {
+	resp, err := a.inner.write(ctx, tuple)
+	var keys []string
+	for _, key := range tuple.TupleKeys {
+		keys = append(keys, key.User+" "+key.Relation+" "+key.Object)
+	}
+	a.record("write", keys, resp, err)
+	return resp, err
+}
+
+func (a *auditedFga) delete(ctx context.Context, deletes []openfga.TupleKeyWithoutCondition) (*http.Response, error) {
+	resp, err := a.inner.delete(ctx, deletes)
+	var keys []string
+	for _, key := range deletes {
+		keys = append(keys, key.User+" "+key.Relation+" "+key.Object)
+	}
+	a.record("delete", keys, resp, err)
+	return resp, err
+}
+
+func (a *auditedFga) record(operation string, keys []string, resp *http.Response, err error) {
+	entry := db.AuditEntry{
+		Timestamp: time.Now().UTC(),
+		Operator:  operator(),
+		Profile:   a.config.Name,
+		ApiUrl:    a.config.ApiUrl,
+		StoreId:   a.config.StoreId,
+		Operation: operation,
+		TupleKeys: keys,
+	}
+	if resp != nil {
+		entry.StatusCode = resp.StatusCode
+		entry.Response = resp.Status
+	}
+	if err != nil {
+		entry.Response = err.Error()
+	}
+	if err := a.repo.RecordAudit(entry); err != nil {
+		slog.Error("Failed to record audit entry", "store_id", entry.StoreId, "operation", entry.Operation, "tuples", []string(entry.TupleKeys), "err", err)
+	}
+	if err := a.journal.append(entry); err != nil {
+		slog.Error("Failed to append audit entry to the journal", "store_id", entry.StoreId, "operation", entry.Operation, "err", err)
+	}
+}
+
+// exportAudit writes the audit log of a replica as JSON lines to path, stdout if path is empty
+func exportAudit(repo db.AuditRepository, path string) (int, error) {
+	var out io.Writer = os.Stdout
+	if path != "" {
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return 0, err
+		}
+		defer func() { _ = file.Close() }()
+		out = file
+	}
+	return repo.ExportAudit(out)
+}
+
+func runAuditExport() error {
+	if _, err := os.Stat(*auditDb); err != nil && !db.IsShared(*auditDb) {
+		return err
+	}
+	repo, err := db.Open(*auditDb)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = repo.Close() }()
+	exported, err := exportAudit(repo, *auditOutput)
+	if err == nil && *auditOutput != "" {
+		fmt.Printf("Exported %v audit entries to %v\n", exported, *auditOutput)
+	}
+	return err
+}
+
+// auditView is a full screen page with the audit log of a store and the tuple keys of the selected entry
+type auditView struct {
+	*tview.Flex
+	table   *tview.Table
+	details *tview.TextView
+	entries []db.AuditEntry
+}
+
+func newAuditView(onExport func(), onDone func()) *auditView {
+	a := &auditView{
+		Flex:    tview.NewFlex().SetDirection(tview.FlexRow),
+		table:   tview.NewTable().SetSelectable(true, false).SetFixed(1, 0),
+		details: tview.NewTextView().SetDynamicColors(true),
+	}
+	a.table.SetBorder(true)
+	a.details.SetBorder(true).SetTitle(" Tuples ")
+	a.table.SetDoneFunc(func(key tcell.Key) {
+		if key == tcell.KeyEscape {
+			onDone()
+		}
+	})
+	a.table.SetSelectionChangedFunc(func(row, _ int) {
+		a.details.Clear()
+		if row > 0 && row <= len(a.entries) {
+			entry := a.entries[row-1]
+			a.details.SetText(fmt.Sprintf("[orange]%v[white]\n%v", entry.Response, strings.Join(entry.TupleKeys, "\n")))
+		}
+	})
+	a.table.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		if event.Key() == tcell.KeyCtrlE {
+			onExport()
+			return nil
+		}
+		return event
+	})
+	a.AddItem(a.table, 0, 2, true).AddItem(a.details, 0, 1, false)
+	return a
+}
+
+func (a *auditView) show(title string, entries []db.AuditEntry) {
+	a.entries = entries
+	a.table.Clear()
+	a.table.SetTitle(fmt.Sprintf(" Audit log of %v (%v entries) - <ctrl-e> to export, <esc> to return ", title, len(entries)))
+	for column, header := range []string{"TIMESTAMP ↓             ", "OPERATOR        ", "PROFILE         ", "OPERATION ", "TUPLES ", "STATUS "} {
+		a.table.SetCell(0, column, tview.NewTableCell(header).SetSelectable(false))
+	}
+	if len(entries) == 0 {
+		a.table.SetCell(1, 0, tview.NewTableCell("Nothing was sent to this store yet").SetSelectable(false))
+	}
+	for i, entry := range entries {
+		row := i + 1
+		operation := tview.NewTableCell(entry.Operation).SetTextColor(tcell.ColorLightGreen)
+		if entry.Operation == "delete" {
+			operation.SetTextColor(tcell.ColorLightCoral)
+		}
+		status := tview.NewTableCell(fmt.Sprint(entry.StatusCode)).SetTextColor(tcell.ColorLightCyan)
+		if entry.StatusCode < 200 || entry.StatusCode > 299 {
+			status.SetTextColor(tcell.ColorRed)
+		}
+		a.table.SetCell(row, 0, tview.NewTableCell(entry.Timestamp.Local().Format(time.DateTime)).SetTextColor(tcell.ColorLightCyan))
+		a.table.SetCell(row, 1, tview.NewTableCell(entry.Operator).SetTextColor(tcell.ColorLightCyan))
+		a.table.SetCell(row, 2, tview.NewTableCell(entry.Profile).SetTextColor(tcell.ColorLightCyan))
+		a.table.SetCell(row, 3, operation)
+		a.table.SetCell(row, 4, tview.NewTableCell(fmt.Sprint(len(entry.TupleKeys))).SetTextColor(tcell.ColorLightCyan))
+		a.table.SetCell(row, 5, status)
+	}
+	a.table.ScrollToBeginning()
+	a.table.Select(1, 0)
+}
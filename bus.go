@@ -0,0 +1,126 @@
+package main
+
+import (
+	openfga "github.com/openfga/go-sdk"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// changeEvent is what changed in the replica of a store
+type changeEvent struct {
+	Store           *store
+	Writes, Deletes int
+	// UserTypes, Relations and ObjectTypes are the values of the tuples changed
+	UserTypes, Relations, ObjectTypes []string
+	// Rebuilt tells anything may have changed, like after a resync or a sync run by another instance
+	Rebuilt bool
+}
+
+// newChangeEvent describes a page of changes applied to the replica of s
+func newChangeEvent(s *store, changes []openfga.TupleChange) changeEvent {
+	event := changeEvent{Store: s}
+	userTypes, relations, objectTypes := map[string]bool{}, map[string]bool{}, map[string]bool{}
+	for _, change := range changes {
+		if change.GetOperation() == openfga.DELETE {
+			event.Deletes++
+		} else {
+			event.Writes++
+		}
+		key := change.GetTupleKey()
+		userType, _, _ := strings.Cut(key.User, ":")
+		objectType, _, _ := strings.Cut(key.Object, ":")
+		userTypes[userType], relations[key.Relation], objectTypes[objectType] = true, true, true
+	}
+	event.UserTypes, event.Relations, event.ObjectTypes = keysOf(userTypes), keysOf(relations), keysOf(objectTypes)
+	return event
+}
+
+func keysOf(set map[string]bool) []string {
+	var keys []string
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// merge adds the changes of another event of the same store
+func (e changeEvent) merge(other changeEvent) changeEvent {
+	union := func(a, b []string) []string {
+		set := map[string]bool{}
+		for _, value := range append(append([]string(nil), a...), b...) {
+			set[value] = true
+		}
+		return keysOf(set)
+	}
+	e.Writes += other.Writes
+	e.Deletes += other.Deletes
+	e.UserTypes = union(e.UserTypes, other.UserTypes)
+	e.Relations = union(e.Relations, other.Relations)
+	e.ObjectTypes = union(e.ObjectTypes, other.ObjectTypes)
+	e.Rebuilt = e.Rebuilt || other.Rebuilt
+	return e
+}
+
+// changeBus fans the changes of the replicas out to the parts of the UI showing them, so nothing is queried
+// while the replicas don't change
+type changeBus struct {
+	lock          sync.Mutex
+	subscriptions []*subscription
+}
+
+// subscription keeps the events published since its last wait, merged by store. Publishing never blocks the sync
+type subscription struct {
+	lock    sync.Mutex
+	pending map[*store]changeEvent
+	ready   chan struct{}
+	// interval is the least time between two waits, so a busy store doesn't refresh a view on every page
+	interval time.Duration
+	last     time.Time
+}
+
+func (b *changeBus) subscribe(interval time.Duration) *subscription {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	sub := &subscription{pending: map[*store]changeEvent{}, ready: make(chan struct{}, 1), interval: interval}
+	b.subscriptions = append(b.subscriptions, sub)
+	return sub
+}
+
+// publish tells every subscription about an event. Stores opened outside of a session have no bus
+func (b *changeBus) publish(event changeEvent) {
+	if b == nil {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for _, sub := range b.subscriptions {
+		sub.lock.Lock()
+		merged := event
+		if pending, found := sub.pending[event.Store]; found {
+			merged = pending.merge(event)
+		}
+		sub.pending[event.Store] = merged
+		sub.lock.Unlock()
+		select {
+		case sub.ready <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// wait blocks until there are events, returning the event of every store that changed
+func (s *subscription) wait() map[*store]changeEvent {
+	if pause := s.interval - time.Since(s.last); pause > 0 {
+		time.Sleep(pause)
+	}
+	<-s.ready
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	events := s.pending
+	s.pending = map[*store]changeEvent{}
+	s.last = time.Now()
+	return events
+}
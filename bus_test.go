@@ -0,0 +1,65 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestChangeBus(t *testing.T) {
+	bus := &changeBus{}
+	first, second := bus.subscribe(0), bus.subscribe(0)
+	staging, prod := &store{}, &store{}
+
+	// nobody waits, publishing must not block the sync
+	bus.publish(changeEvent{Store: staging, Writes: 2, ObjectTypes: []string{"folder"}})
+	bus.publish(changeEvent{Store: staging, Deletes: 1, ObjectTypes: []string{"document", "folder"}})
+	bus.publish(changeEvent{Store: prod, Rebuilt: true})
+
+	for _, sub := range []*subscription{first, second} {
+		events := sub.wait()
+		if event := events[staging]; event.Writes != 2 || event.Deletes != 1 || !reflect.DeepEqual(event.ObjectTypes, []string{"document", "folder"}) {
+			t.Errorf("Expected the events of a store merged, got %+v", event)
+		}
+		if event := events[prod]; !event.Rebuilt || len(events) != 2 {
+			t.Errorf("Expected an event per store, got %+v", events)
+		}
+	}
+
+	t.Run("Waits for changes", func(t *testing.T) {
+		sub := bus.subscribe(0)
+		waited := make(chan map[*store]changeEvent)
+		go func() { waited <- sub.wait() }()
+		select {
+		case <-waited:
+			t.Fatal("Nothing changed yet")
+		case <-time.After(50 * time.Millisecond):
+		}
+		bus.publish(changeEvent{Store: prod, Writes: 1})
+		select {
+		case events := <-waited:
+			if events[prod].Writes != 1 {
+				t.Errorf("Unexpected events %+v", events)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected the change")
+		}
+	})
+
+	t.Run("Refreshes at most once per interval", func(t *testing.T) {
+		sub := bus.subscribe(100 * time.Millisecond)
+		bus.publish(changeEvent{Store: prod, Writes: 1})
+		sub.wait()
+		bus.publish(changeEvent{Store: prod, Writes: 1})
+		started := time.Now()
+		sub.wait()
+		if waited := time.Since(started); waited < 50*time.Millisecond {
+			t.Errorf("Expected to wait for the interval, waited %v", waited)
+		}
+	})
+
+	t.Run("Stores outside of a session", func(t *testing.T) {
+		var none *changeBus
+		none.publish(changeEvent{Store: prod})
+	})
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/paulosuzart/fgamanager/db"
+	"gopkg.in/yaml.v3"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultApiUrl       = "http://localhost:8087"
+	defaultPageSize     = 50
+	defaultSyncInterval = 2 * time.Second
+	// maxPageSize is the largest page ReadChanges returns
+	maxPageSize = 100
+)
+
+// profile is a named connection in the config file
+type profile struct {
+	ApiUrl  string `yaml:"apiUrl"`
+	StoreId string `yaml:"storeId"`
+	// Credentials points to the API token as env:VARIABLE or file:path, the token itself is never kept in the file
+	Credentials  string        `yaml:"credentials"`
+	DbPath       string        `yaml:"dbPath"`
+	SyncInterval time.Duration `yaml:"syncInterval"`
+	PageSize     int32         `yaml:"pageSize"`
+	ReadOnly     bool          `yaml:"readOnly"`
+	// Types are the object types to replicate, every type when empty
+	Types []string `yaml:"types"`
+}
+
+// configFile is the content of the config file
+type configFile struct {
+	LogFile   string `yaml:"logFile"`
+	LogLevel  string `yaml:"logLevel"`
+	LogFormat string `yaml:"logFormat"`
+	// AuditFile is an optional JSON lines copy of the audit log
+	AuditFile string             `yaml:"auditFile"`
+	Profiles  map[string]profile `yaml:"profiles"`
+}
+
+// settings is everything fgamanager runs with, resolved from the config file, env vars and flags
+type settings struct {
+	LogFile   string
+	LogLevel  string
+	LogFormat string
+	AuditFile string
+	// Server is where stores given with --storeId live, and the server the store commands and picker use
+	Server storeConfig
+	Stores []storeConfig
+}
+
+// cliFlags are the values given on the command line, zero when not given
+type cliFlags struct {
+	ConfigPath string
+	Profiles   []string
+	StoreIds   []string
+	ApiUrl     string
+	ReadOnly   bool
+	Types      []string
+	AuditFile  string
+	LogFile    string
+	LogLevel   string
+	LogFormat  string
+}
+
+// defaultConfigPath follows the XDG base directory spec
+func defaultConfigPath(getenv func(string) string) string {
+	base := getenv("XDG_CONFIG_HOME")
+	if base == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		base = filepath.Join(home, ".config")
+	}
+	return filepath.Join(base, "fgamanager", "config.yaml")
+}
+
+// readConfigFile parses path. A missing file is only an error if it was asked for explicitly
+func readConfigFile(path string, explicit bool) (*configFile, error) {
+	config := &configFile{}
+	if path == "" {
+		return config, nil
+	}
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) && !explicit {
+		return config, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+	return config, nil
+}
+
+// expandHome resolves a leading ~/ to the home directory
+func expandHome(path string) string {
+	if !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[2:])
+}
+
+// resolveCredentials reads the token a credentials reference points to
+func resolveCredentials(ref string, getenv func(string) string) (string, error) {
+	if ref == "" {
+		return "", nil
+	}
+	kind, value, _ := strings.Cut(ref, ":")
+	switch kind {
+	case "env":
+		token := getenv(value)
+		if token == "" {
+			return "", fmt.Errorf("credentials variable %v is not set", value)
+		}
+		return token, nil
+	case "file":
+		content, err := os.ReadFile(expandHome(value))
+		if err != nil {
+			return "", fmt.Errorf("unable to read credentials: %w", err)
+		}
+		return strings.TrimSpace(string(content)), nil
+	}
+	return "", fmt.Errorf("credentials %q must be env:VARIABLE or file:path", ref)
+}
+
+// envOverrides are the FGAMANAGER_* variables, each one overriding the same setting of every store
+var envOverrides = []struct {
+	name  string
+	apply func(config *storeConfig, value string) error
+	// identity overrides name the store and its replica, so they only apply when a single store is opened
+	identity bool
+}{
+	{"FGAMANAGER_API_URL", func(c *storeConfig, v string) error { c.ApiUrl = v; return nil }, false},
+	{"FGAMANAGER_STORE_ID", func(c *storeConfig, v string) error { c.StoreId = v; return nil }, true},
+	{"FGAMANAGER_API_TOKEN", func(c *storeConfig, v string) error { c.ApiToken = v; return nil }, false},
+	{"FGAMANAGER_DB_PATH", func(c *storeConfig, v string) error { c.DbPath = v; return nil }, true},
+	{"FGAMANAGER_SYNC_INTERVAL", func(c *storeConfig, v string) (err error) {
+		c.SyncInterval, err = time.ParseDuration(v)
+		return
+	}, false},
+	{"FGAMANAGER_PAGE_SIZE", func(c *storeConfig, v string) error {
+		size, err := strconv.ParseInt(v, 10, 32)
+		c.PageSize = int32(size)
+		return err
+	}, false},
+	{"FGAMANAGER_READ_ONLY", func(c *storeConfig, v string) (err error) {
+		c.ReadOnly, err = strconv.ParseBool(v)
+		return
+	}, false},
+	{"FGAMANAGER_TYPES", func(c *storeConfig, v string) error { c.Types = strings.Split(v, ","); return nil }, false},
+}
+
+// applyEnv applies the overrides set, the identity ones only when identity is true
+func applyEnv(config *storeConfig, getenv func(string) string, identity bool) error {
+	var errs []error
+	for _, override := range envOverrides {
+		if override.identity && !identity {
+			continue
+		}
+		if value := getenv(override.name); value != "" {
+			if err := override.apply(config, value); err != nil {
+				errs = append(errs, fmt.Errorf("%v: %w", override.name, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// toStoreConfig fills the settings the profile leaves out from base
+func (p profile) toStoreConfig(name string, base storeConfig, getenv func(string) string) (storeConfig, error) {
+	config := base
+	config.Name = name
+	config.StoreId = p.StoreId
+	config.DbPath = expandHome(p.DbPath)
+	if p.ApiUrl != "" {
+		config.ApiUrl = p.ApiUrl
+	}
+	if p.SyncInterval != 0 {
+		config.SyncInterval = p.SyncInterval
+	}
+	if p.PageSize != 0 {
+		config.PageSize = p.PageSize
+	}
+	config.ReadOnly = config.ReadOnly || p.ReadOnly
+	if len(p.Types) > 0 {
+		config.Types = p.Types
+	}
+	if p.Credentials != "" {
+		token, err := resolveCredentials(p.Credentials, getenv)
+		if err != nil {
+			return config, err
+		}
+		config.ApiToken = token
+	}
+	return config, nil
+}
+
+// validate reports every problem of a store at once
+func (c storeConfig) validate() error {
+	var errs []error
+	if c.StoreId == "" {
+		errs = append(errs, fmt.Errorf("store id missing"))
+	}
+	if _, err := url.ParseRequestURI(c.ApiUrl); err != nil {
+		errs = append(errs, fmt.Errorf("api url is malformed: %w", err))
+	}
+	if c.PageSize < 1 || c.PageSize > maxPageSize {
+		errs = append(errs, fmt.Errorf("page size must be between 1 and %v, got %v", maxPageSize, c.PageSize))
+	}
+	if c.SyncInterval <= 0 {
+		errs = append(errs, fmt.Errorf("sync interval must be positive, got %v", c.SyncInterval))
+	}
+	types := map[string]bool{}
+	for _, objectType := range c.Types {
+		if objectType == "" || strings.ContainsAny(objectType, ": ") {
+			errs = append(errs, fmt.Errorf("object type %q is malformed", objectType))
+		}
+		if types[objectType] {
+			errs = append(errs, fmt.Errorf("object type %v given more than once", objectType))
+		}
+		types[objectType] = true
+	}
+	return errors.Join(errs...)
+}
+
+// loadSettings resolves the settings with flags over env vars over the config file over defaults.
+// Profiles come first in the order they are given, then every --storeId
+func loadSettings(flags cliFlags, getenv func(string) string) (*settings, error) {
+	configPath, profiles, storeArgs := flags.ConfigPath, flags.Profiles, flags.StoreIds
+	explicit := configPath != "" || getenv("FGAMANAGER_CONFIG") != ""
+	if configPath == "" {
+		configPath = getenv("FGAMANAGER_CONFIG")
+	}
+	if configPath == "" {
+		configPath = defaultConfigPath(getenv)
+	}
+	file, err := readConfigFile(configPath, explicit)
+	if err != nil {
+		return nil, err
+	}
+
+	// firstOf picks the flag, then the env var, then the config file, then the default
+	result := &settings{
+		LogFile:   expandHome(firstOf(flags.LogFile, getenv("FGAMANAGER_LOG_FILE"), file.LogFile, defaultLogPath(getenv))),
+		LogLevel:  firstOf(flags.LogLevel, getenv("FGAMANAGER_LOG_LEVEL"), file.LogLevel, "info"),
+		LogFormat: firstOf(flags.LogFormat, getenv("FGAMANAGER_LOG_FORMAT"), file.LogFormat, "json"),
+		AuditFile: expandHome(firstOf(flags.AuditFile, getenv("FGAMANAGER_AUDIT_FILE"), file.AuditFile)),
+	}
+
+	var errs []error
+	if _, err := parseLogLevel(result.LogLevel); err != nil {
+		errs = append(errs, fmt.Errorf("log level must be debug, info, warn or error: %w", err))
+	}
+	if result.LogFormat != "json" && result.LogFormat != "text" {
+		errs = append(errs, fmt.Errorf("log format must be json or text, got %v", result.LogFormat))
+	}
+	base := storeConfig{ApiUrl: defaultApiUrl, PageSize: defaultPageSize, SyncInterval: defaultSyncInterval}
+	server := base
+	if err := applyEnv(&server, getenv, true); err != nil {
+		errs = append(errs, err)
+	}
+	if flags.ApiUrl != "" {
+		server.ApiUrl = flags.ApiUrl
+	}
+	server.ReadOnly = server.ReadOnly || flags.ReadOnly
+	if len(flags.Types) > 0 {
+		server.Types = flags.Types
+	}
+	result.Server = server
+	result.Server.StoreId, result.Server.DbPath = "", ""
+
+	if len(profiles) == 0 && getenv("FGAMANAGER_PROFILE") != "" {
+		profiles = strings.Split(getenv("FGAMANAGER_PROFILE"), ",")
+	}
+	single := len(profiles)+len(storeArgs) <= 1
+	for _, override := range envOverrides {
+		if override.identity && !single && getenv(override.name) != "" {
+			errs = append(errs, fmt.Errorf("%v applies to a single store, unset it to open %v stores",
+				override.name, len(profiles)+len(storeArgs)))
+		}
+	}
+	for _, name := range profiles {
+		p, found := file.Profiles[name]
+		if !found {
+			errs = append(errs, fmt.Errorf("profile %v not found in %v", name, configPath))
+			continue
+		}
+		config, err := p.toStoreConfig(name, base, getenv)
+		if err == nil {
+			err = applyEnv(&config, getenv, single)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("profile %v: %w", name, err))
+			continue
+		}
+		if flags.ApiUrl != "" {
+			config.ApiUrl = flags.ApiUrl
+		}
+		config.ReadOnly = config.ReadOnly || flags.ReadOnly
+		if len(flags.Types) > 0 {
+			config.Types = flags.Types
+		}
+		result.Stores = append(result.Stores, config)
+	}
+
+	if server.StoreId != "" && len(profiles) == 0 && len(storeArgs) == 0 {
+		storeArgs = []string{server.StoreId}
+	}
+	fromArgs, err := storeConfigs(storeArgs, result.Server)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	if server.DbPath != "" && len(fromArgs) == 1 {
+		fromArgs[0].DbPath = server.DbPath
+	}
+	result.Stores = append(result.Stores, fromArgs...)
+
+	stores := map[string]string{}
+	replicas := map[string]string{}
+	for _, config := range result.Stores {
+		if err := config.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("store %v: %w", config.Name, err))
+		}
+		if other, found := stores[config.StoreId]; found {
+			errs = append(errs, fmt.Errorf("stores %v and %v are the same store %v", other, config.Name, config.StoreId))
+		}
+		stores[config.StoreId] = config.Name
+		if other, found := replicas[config.DbPath]; found && config.DbPath != "" {
+			errs = append(errs, fmt.Errorf("stores %v and %v share the replica %v", other, config.Name, db.RedactDataSource(config.DbPath)))
+		}
+		replicas[config.DbPath] = config.Name
+	}
+	if _, err := url.ParseRequestURI(result.Server.ApiUrl); err != nil {
+		errs = append(errs, fmt.Errorf("api url is malformed: %w", err))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testConfig = `
+logFile: /var/log/fgamanager.log
+profiles:
+  staging:
+    apiUrl: https://staging:8080
+    storeId: 01HME1444HSEY9022AENH1YYKF
+    credentials: env:STAGING_TOKEN
+    dbPath: staging.db
+    syncInterval: 10s
+    pageSize: 100
+    readOnly: true
+    types: [document, folder]
+  local:
+    storeId: 01HQ3V9WJ3JYQ3Z6P8J1C4C0RD
+`
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func envOf(vars map[string]string) func(string) string {
+	return func(name string) string { return vars[name] }
+}
+
+func TestLoadSettings(t *testing.T) {
+	path := writeConfig(t, testConfig)
+
+	t.Run("Profiles", func(t *testing.T) {
+		config, err := loadSettings(cliFlags{ConfigPath: path, Profiles: []string{"staging", "local"}}, envOf(map[string]string{"STAGING_TOKEN": "secret"}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config.LogFile != "/var/log/fgamanager.log" {
+			t.Errorf("Unexpected log file %v", config.LogFile)
+		}
+		expected := []storeConfig{
+			{Name: "staging", ApiUrl: "https://staging:8080", StoreId: "01HME1444HSEY9022AENH1YYKF", DbPath: "staging.db",
+				ApiToken: "secret", SyncInterval: 10 * time.Second, PageSize: 100, ReadOnly: true, Types: []string{"document", "folder"}},
+			{Name: "local", ApiUrl: defaultApiUrl, StoreId: "01HQ3V9WJ3JYQ3Z6P8J1C4C0RD",
+				SyncInterval: defaultSyncInterval, PageSize: defaultPageSize},
+		}
+		if len(config.Stores) != len(expected) {
+			t.Fatalf("Expected %v stores, got %+v", len(expected), config.Stores)
+		}
+		for i := range expected {
+			if !reflect.DeepEqual(config.Stores[i], expected[i]) {
+				t.Errorf("Expected %+v, got %+v", expected[i], config.Stores[i])
+			}
+		}
+	})
+
+	t.Run("Env overrides the profile and flags override env", func(t *testing.T) {
+		tokenFile := filepath.Join(t.TempDir(), "token")
+		_ = os.WriteFile(tokenFile, []byte("from-file\n"), 0600)
+		env := envOf(map[string]string{
+			"FGAMANAGER_PROFILE":       "staging",
+			"FGAMANAGER_PAGE_SIZE":     "20",
+			"FGAMANAGER_SYNC_INTERVAL": "1m",
+			"FGAMANAGER_API_URL":       "https://env:8080",
+			"FGAMANAGER_LOG_FILE":      "env.log",
+			"STAGING_TOKEN":            "secret",
+		})
+		config, err := loadSettings(cliFlags{ConfigPath: path, ApiUrl: "https://flag:8080"}, env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := config.Stores[0]
+		if s.PageSize != 20 || s.SyncInterval != time.Minute || s.ApiUrl != "https://flag:8080" || config.LogFile != "env.log" {
+			t.Errorf("Overrides not applied: %+v %v", s, config.LogFile)
+		}
+		if config.Server.ApiUrl != "https://flag:8080" {
+			t.Errorf("Unexpected server %v", config.Server.ApiUrl)
+		}
+		if token, _ := resolveCredentials("file:"+tokenFile, env); token != "from-file" {
+			t.Errorf("Unexpected token %q", token)
+		}
+	})
+
+	t.Run("Store args use the server settings", func(t *testing.T) {
+		env := envOf(map[string]string{"FGAMANAGER_API_TOKEN": "secret", "FGAMANAGER_DB_PATH": "mine.db"})
+		config, err := loadSettings(cliFlags{ConfigPath: path, StoreIds: []string{"prod=01HME1444HSEY9022AENH1YYKF"}}, env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := config.Stores[0]
+		if s.Name != "prod" || s.ApiToken != "secret" || s.DbPath != "mine.db" || s.ApiUrl != defaultApiUrl {
+			t.Errorf("Unexpected store %+v", s)
+		}
+	})
+
+	t.Run("Store identity env vars need a single store", func(t *testing.T) {
+		home, _ := os.UserHomeDir()
+		config, err := loadSettings(cliFlags{ConfigPath: writeConfig(t, "profiles:\n  a:\n    storeId: 01HME1444HSEY9022AENH1YYKF\n    dbPath: ~/a.db\n")},
+			envOf(map[string]string{"FGAMANAGER_PROFILE": "a"}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := config.Stores[0]; s.DbPath != filepath.Join(home, "a.db") {
+			t.Errorf("Expected the replica in the home directory, got %v", s.DbPath)
+		}
+		env := envOf(map[string]string{"FGAMANAGER_STORE_ID": "01HQ3V9WJ3JYQ3Z6P8J1C4C0RE", "FGAMANAGER_DB_PATH": "mine.db", "STAGING_TOKEN": "secret"})
+		config, err = loadSettings(cliFlags{ConfigPath: path, Profiles: []string{"local"}}, env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := config.Stores[0]; s.StoreId != "01HQ3V9WJ3JYQ3Z6P8J1C4C0RE" || s.DbPath != "mine.db" {
+			t.Errorf("Expected the env store and replica, got %+v", s)
+		}
+		_, err = loadSettings(cliFlags{ConfigPath: path, Profiles: []string{"staging", "local"}}, env)
+		for _, expected := range []string{"FGAMANAGER_STORE_ID applies to a single store", "FGAMANAGER_DB_PATH applies to a single store"} {
+			if err == nil || !strings.Contains(err.Error(), expected) {
+				t.Errorf("Expected %q, got %v", expected, err)
+			}
+		}
+		if err != nil && strings.Contains(err.Error(), "are the same store") {
+			t.Errorf("The env store must not be applied to every profile: %v", err)
+		}
+	})
+
+	t.Run("Read only flag applies to every store", func(t *testing.T) {
+		config, err := loadSettings(cliFlags{ConfigPath: path, Profiles: []string{"local"}, StoreIds: []string{"01HME1444HSEY9022AENH1YYKF"}, ReadOnly: true}, envOf(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range append(config.Stores, config.Server) {
+			if !s.ReadOnly {
+				t.Errorf("Store %v must be read only", s.Name)
+			}
+		}
+	})
+
+	t.Run("Type flags override the profile types", func(t *testing.T) {
+		env := envOf(map[string]string{"FGAMANAGER_TYPES": "team", "STAGING_TOKEN": "secret"})
+		config, err := loadSettings(cliFlags{ConfigPath: path, Profiles: []string{"staging"}}, env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if types := config.Stores[0].Types; !reflect.DeepEqual(types, []string{"team"}) {
+			t.Errorf("Expected env types, got %v", types)
+		}
+		config, err = loadSettings(cliFlags{ConfigPath: path, Profiles: []string{"staging"}, StoreIds: []string{"01HQ3V9WJ3JYQ3Z6P8J1C4C0RE"}, Types: []string{"repo"}}, env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range config.Stores {
+			if !reflect.DeepEqual(s.Types, []string{"repo"}) {
+				t.Errorf("Expected flag types for %v, got %v", s.Name, s.Types)
+			}
+		}
+	})
+
+	t.Run("Every problem is reported", func(t *testing.T) {
+		broken := writeConfig(t, `
+profiles:
+  nostore:
+    pageSize: 500
+  first:
+    storeId: 01HME1444HSEY9022AENH1YYKF
+    dbPath: same.db
+  second:
+    storeId: 01HQ3V9WJ3JYQ3Z6P8J1C4C0RD
+    dbPath: same.db
+  secret:
+    storeId: 01HQ3V9WJ3JYQ3Z6P8J1C4C0RE
+    credentials: env:MISSING
+  types:
+    storeId: 01HQ3V9WJ3JYQ3Z6P8J1C4C0RF
+    types: [document, "user:jack", document]
+`)
+		_, err := loadSettings(cliFlags{ConfigPath: broken, Profiles: []string{"nostore", "first", "second", "secret", "types", "unknown"}}, envOf(nil))
+		if err == nil {
+			t.Fatal("Expected an error")
+		}
+		for _, expected := range []string{"store id missing", "page size", "share the replica", "MISSING is not set", "\"user:jack\" is malformed", "document given more than once", "profile unknown not found"} {
+			if !strings.Contains(err.Error(), expected) {
+				t.Errorf("Expected %q in %v", expected, err)
+			}
+		}
+	})
+
+	t.Run("Config file", func(t *testing.T) {
+		if _, err := loadSettings(cliFlags{}, envOf(map[string]string{"XDG_CONFIG_HOME": t.TempDir()})); err != nil {
+			t.Errorf("A missing default config must be ignored: %v", err)
+		}
+		if _, err := loadSettings(cliFlags{ConfigPath: filepath.Join(t.TempDir(), "missing.yaml")}, envOf(nil)); err == nil {
+			t.Error("A missing explicit config must be refused")
+		}
+		if _, err := loadSettings(cliFlags{ConfigPath: writeConfig(t, "profiles:\n  a:\n    storeid: x\n")}, envOf(nil)); err == nil {
+			t.Error("Unknown keys must be refused")
+		}
+	})
+}
+
+func TestLogSettings(t *testing.T) {
+	config, err := loadSettings(cliFlags{ConfigPath: writeConfig(t, "logLevel: warn\nlogFormat: text\n"), LogLevel: "debug"},
+		envOf(map[string]string{"XDG_STATE_HOME": "/state"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.LogLevel != "debug" || config.LogFormat != "text" || config.LogFile != "/state/fgamanager/fgamanager.log" {
+		t.Errorf("Unexpected log settings %+v", config)
+	}
+
+	if _, err := loadSettings(cliFlags{ConfigPath: writeConfig(t, "logLevel: loud\nlogFormat: xml\n")}, envOf(nil)); err == nil ||
+		!strings.Contains(err.Error(), "log level") || !strings.Contains(err.Error(), "log format") {
+		t.Errorf("Expected log level and format errors, got %v", err)
+	}
+}
@@ -0,0 +1,107 @@
+package db
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// auditLimit caps how many entries the audit page shows
+const auditLimit = 1000
+
+type AuditRepository interface {
+	RecordAudit(entry AuditEntry) error
+	GetAuditLog() ([]AuditEntry, error)
+	ExportAudit(out io.Writer) (int, error)
+}
+
+// TupleKeys are kept one per line in a single column
+type TupleKeys []string
+
+func (k TupleKeys) Value() (driver.Value, error) {
+	return strings.Join(k, "\n"), nil
+}
+
+func (k *TupleKeys) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case string:
+		*k = strings.Split(v, "\n")
+	case []byte:
+		*k = strings.Split(string(v), "\n")
+	default:
+		return fmt.Errorf("unable to scan %T into tuple keys", src)
+	}
+	return nil
+}
+
+// AuditEntry is one write or delete sent to a store and how the server answered
+type AuditEntry struct {
+	Id        int       `db:"id" json:"id"`
+	Timestamp time.Time `db:"timestamp" json:"timestamp"`
+	// Operator is the OS user running fgamanager
+	Operator   string    `db:"operator" json:"operator"`
+	Profile    string    `db:"profile" json:"profile"`
+	ApiUrl     string    `db:"api_url" json:"apiUrl"`
+	StoreId    string    `db:"store_id" json:"storeId"`
+	Operation  string    `db:"operation" json:"operation"`
+	TupleKeys  TupleKeys `db:"tuple_keys" json:"tupleKeys"`
+	StatusCode int       `db:"status_code" json:"statusCode"`
+	Response   string    `db:"response" json:"response"`
+}
+
+// RecordAudit appends an entry, the table refuses updates and deletes
+func (r *SqlxRepository) RecordAudit(entry AuditEntry) error {
+	_, err := r._db.NamedExec(`insert into audit_log (
+                       timestamp,
+                       operator,
+                       profile,
+                       api_url,
+                       store_id,
+                       operation,
+                       tuple_keys,
+                       status_code,
+                       response) values (:timestamp,
+                                         :operator,
+                                         :profile,
+                                         :api_url,
+                                         :store_id,
+                                         :operation,
+                                         :tuple_keys,
+                                         :status_code,
+                                         :response)`, entry)
+	return err
+}
+
+// GetAuditLog lists the latest entries, newest first
+func (r *SqlxRepository) GetAuditLog() ([]AuditEntry, error) {
+	var entries []AuditEntry
+	if err := r._db.Select(&entries, r._db.Rebind("select * from audit_log order by id desc limit ?"), auditLimit); err != nil {
+		return nil, fmt.Errorf("failed to load audit log: %w", err)
+	}
+	return entries, nil
+}
+
+// ExportAudit writes every entry as JSON lines, oldest first
+func (r *SqlxRepository) ExportAudit(out io.Writer) (int, error) {
+	rows, err := r._db.Queryx("select * from audit_log order by id")
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = rows.Close() }()
+	encoder := json.NewEncoder(out)
+	exported := 0
+	for rows.Next() {
+		var entry AuditEntry
+		if err := rows.StructScan(&entry); err != nil {
+			return exported, err
+		}
+		if err := encoder.Encode(entry); err != nil {
+			return exported, err
+		}
+		exported++
+	}
+	return exported, rows.Err()
+}
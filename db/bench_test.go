@@ -0,0 +1,100 @@
+package db
+
+import (
+	"fmt"
+	openfga "github.com/openfga/go-sdk"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// benchPageSize is the size of the pages the sync applies while catching up
+const benchPageSize = 100
+
+// changePage is the page-th page of writes, spread over a few relations and object types
+func changePage(page int) []openfga.TupleChange {
+	changes := make([]openfga.TupleChange, 0, benchPageSize)
+	for i := 0; i < benchPageSize; i++ {
+		n := page*benchPageSize + i
+		key := openfga.NewTupleKey(fmt.Sprintf("user:%v", n), []string{"viewer", "editor", "owner"}[n%3],
+			fmt.Sprintf("%v:%v", []string{"document", "folder", "group", "org"}[n%4], n/10))
+		changes = append(changes, openfga.TupleChange{TupleKey: *key, Operation: openfga.WRITE, Timestamp: time.Now()})
+	}
+	return changes
+}
+
+// syncedReplica is a replica file the sync filled with pages of changes
+func syncedReplica(tb testing.TB, pages int) *SqlxRepository {
+	repo := mustOpen(tb, filepath.Join(tb.TempDir(), "fga.db"))
+	tb.Cleanup(func() { _ = repo.Close() })
+	for page := 0; page < pages; page++ {
+		if err := repo.ApplyChanges(changePage(page), benchConnection(page)); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return repo
+}
+
+func benchConnection(page int) Connection {
+	return Connection{ApiUrl: "http://localhost:8087", StoreId: "01HME1", ContinuationToken: fmt.Sprint(page), LastSync: time.Now()}
+}
+
+func BenchmarkApplyChanges(b *testing.B) {
+	repo := syncedReplica(b, 0)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := repo.ApplyChanges(changePage(i), benchConnection(i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(b.N*benchPageSize)/b.Elapsed().Seconds(), "changes/s")
+}
+
+// BenchmarkReadWhileSyncing runs what the UI reads, a page of the table, its count and the dropdowns, while
+// the sync applies pages of changes as fast as it can
+func BenchmarkReadWhileSyncing(b *testing.B) {
+	repo := syncedReplica(b, 100)
+	relation := "viewer"
+	filter := &Filter{Relation: &relation}
+
+	done := make(chan struct{})
+	var synced atomic.Int64
+	var syncing sync.WaitGroup
+	syncing.Add(1)
+	go func() {
+		defer syncing.Done()
+		for page := 100; ; page++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if err := repo.ApplyChanges(changePage(page), benchConnection(page)); err != nil {
+				b.Error(err)
+				return
+			}
+			synced.Add(benchPageSize)
+		}
+	}()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := repo.Load(0, filter); err != nil {
+				b.Error(err)
+			}
+			if _, err := repo.CountTuples(filter); err != nil {
+				b.Error(err)
+			}
+			if _, err := repo.GetRelations(); err != nil {
+				b.Error(err)
+			}
+		}
+	})
+	b.StopTimer()
+	close(done)
+	syncing.Wait()
+	b.ReportMetric(float64(synced.Load())/b.Elapsed().Seconds(), "changes/s")
+}
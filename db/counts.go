@@ -0,0 +1,82 @@
+package db
+
+import (
+	"fmt"
+	"sort"
+)
+
+// rebuildCountsSql counts the tuples again from scratch
+var rebuildCountsSql = []string{
+	"delete from tuple_counts",
+	`insert into tuple_counts (user_type, relation, object_type, count)
+		select user_type, relation, object_type, count(*) from tuples group by user_type, relation, object_type`,
+}
+
+// TupleCount is how many tuples there are of a user type, relation and object type
+type TupleCount struct {
+	UserType   string `db:"user_type"`
+	Relation   string `db:"relation"`
+	ObjectType string `db:"object_type"`
+	Count      int    `db:"count"`
+}
+
+// CountDrift is a count kept in tuple_counts that doesn't match the tuples
+type CountDrift struct {
+	UserType   string
+	Relation   string
+	ObjectType string
+	Counted    int
+	Actual     int
+}
+
+func (d CountDrift) String() string {
+	return fmt.Sprintf("%v %v %v: %v counted, %v in the replica", d.UserType, d.Relation, d.ObjectType, d.Counted, d.Actual)
+}
+
+// CheckCounts counts the tuples from scratch, returning the kept counts that are off
+func (r *SqlxRepository) CheckCounts() ([]CountDrift, error) {
+	var counted, actual []TupleCount
+	if err := r._db.Select(&counted, "select user_type, relation, object_type, count from tuple_counts"); err != nil {
+		return nil, fmt.Errorf("failed to read the tuple counts: %w", err)
+	}
+	err := r._db.Select(&actual, `select user_type, relation, object_type, count(*) as count from tuples
+		group by user_type, relation, object_type`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count tuples: %w", err)
+	}
+	type group struct{ userType, relation, objectType string }
+	drifts := map[group]*CountDrift{}
+	driftOf := func(c TupleCount) *CountDrift {
+		g := group{c.UserType, c.Relation, c.ObjectType}
+		if drifts[g] == nil {
+			drifts[g] = &CountDrift{UserType: c.UserType, Relation: c.Relation, ObjectType: c.ObjectType}
+		}
+		return drifts[g]
+	}
+	for _, c := range counted {
+		driftOf(c).Counted = c.Count
+	}
+	for _, c := range actual {
+		driftOf(c).Actual = c.Count
+	}
+	var result []CountDrift
+	for _, drift := range drifts {
+		if drift.Counted != drift.Actual {
+			result = append(result, *drift)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].String() < result[j].String() })
+	return result, nil
+}
+
+// RebuildCounts replaces the kept counts by counting the tuples from scratch
+func (r *SqlxRepository) RebuildCounts() error {
+	return r.Transact(func(tx *Tx) error {
+		for _, statement := range rebuildCountsSql {
+			if _, err := tx.tx.Exec(statement); err != nil {
+				return fmt.Errorf("failed to rebuild the tuple counts: %w", err)
+			}
+		}
+		return nil
+	})
+}
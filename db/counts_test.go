@@ -0,0 +1,115 @@
+package db
+
+import (
+	openfga "github.com/openfga/go-sdk"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTupleCounts(t *testing.T) {
+	repo := mustOpen(t, ":memory:")
+	defer repo.Close()
+
+	change := func(operation openfga.TupleOperation, user, relation, object string) openfga.TupleChange {
+		return openfga.TupleChange{
+			TupleKey:  openfga.TupleKey{User: user, Relation: relation, Object: object},
+			Operation: operation,
+			Timestamp: time.Now()}
+	}
+	consistent := func(t *testing.T) {
+		t.Helper()
+		if drifts, err := repo.CheckCounts(); len(drifts) != 0 || err != nil {
+			t.Errorf("Expected the counts to match the tuples, got %v (%v)", drifts, err)
+		}
+	}
+	err := repo.ApplyChanges([]openfga.TupleChange{
+		change(openfga.WRITE, "user:jack", "viewer", "document:1"),
+		change(openfga.WRITE, "user:jack", "viewer", "document:1"),
+		change(openfga.WRITE, "user:jill", "viewer", "document:1"),
+		change(openfga.WRITE, "group:eng#member", "editor", "document:1"),
+		change(openfga.WRITE, "user:jack", "owner", "folder:1"),
+		change(openfga.DELETE, "user:joe", "viewer", "document:1"),
+	}, Connection{ApiUrl: "http://localhost:8087", StoreId: "01HME1", ContinuationToken: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	consistent(t)
+
+	userType, relation, objectType := "user", "viewer", "document"
+	for filter, expected := range map[*Filter]int{
+		nil:                       4,
+		{UserType: &userType}:     3,
+		{Relation: &relation}:     2,
+		{ObjectType: &objectType}: 3,
+		{ObjectType: &objectType, Relation: &relation}: 2,
+	} {
+		if c, err := repo.CountTuples(filter); c != expected || err != nil {
+			t.Errorf("Expected %v tuples for %+v, got %v (%v)", expected, filter, c, err)
+		}
+	}
+
+	t.Run("Values without tuples are not listed", func(t *testing.T) {
+		repo.ApplyChange(change(openfga.DELETE, "user:jack", "owner", "folder:1"))
+		consistent(t)
+		if relations, _ := repo.GetRelations(); !reflect.DeepEqual(relations, []string{"editor", "viewer"}) {
+			t.Errorf("Expected the relations left, got %v", relations)
+		}
+		if objectTypes, _ := repo.GetObjectTypes(); !reflect.DeepEqual(objectTypes, []string{"document"}) {
+			t.Errorf("Expected the object types left, got %v", objectTypes)
+		}
+	})
+
+	t.Run("Prune and scope keep the counts", func(t *testing.T) {
+		_ = repo.MarkStale("user:jill viewer document:1")
+		if pruned, err := repo.Prune(); pruned != 1 || err != nil {
+			t.Fatalf("Expected a tuple pruned, got %v (%v)", pruned, err)
+		}
+		consistent(t)
+		if _, err := repo.ScopeTypes("01HME1", []string{"folder"}); err != nil {
+			t.Fatal(err)
+		}
+		consistent(t)
+		if c, _ := repo.CountTuples(nil); c != 0 {
+			t.Errorf("Expected no tuple left, got %v", c)
+		}
+	})
+
+	t.Run("Snapshot replace counts again", func(t *testing.T) {
+		snapshot, err := repo.NewSnapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = snapshot.Add([]openfga.Tuple{
+			{Key: *openfga.NewTupleKey("user:jack", "viewer", "document:1"), Timestamp: time.Now()},
+			{Key: *openfga.NewTupleKey("user:jill", "viewer", "document:1"), Timestamp: time.Now()},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := snapshot.Replace(nil); err != nil {
+			t.Fatal(err)
+		}
+		consistent(t)
+		if c, _ := repo.CountTuples(&Filter{Relation: &relation}); c != 2 {
+			t.Errorf("Expected the tuples of the snapshot, got %v", c)
+		}
+	})
+
+	t.Run("Drift is found and repaired", func(t *testing.T) {
+		repo._db.MustExec("update tuple_counts set count = 5")
+		repo._db.MustExec("insert into tuple_counts values ('team', 'owner', 'folder', 1)")
+		drifts, err := repo.CheckCounts()
+		expected := []CountDrift{
+			{UserType: "team", Relation: "owner", ObjectType: "folder", Counted: 1, Actual: 0},
+			{UserType: "user", Relation: "viewer", ObjectType: "document", Counted: 5, Actual: 2},
+		}
+		if !reflect.DeepEqual(drifts, expected) || err != nil {
+			t.Errorf("Expected %v, got %v (%v)", expected, drifts, err)
+		}
+		if err := repo.RebuildCounts(); err != nil {
+			t.Fatal(err)
+		}
+		consistent(t)
+	})
+}
@@ -1,191 +1,168 @@
 package db
 
 import (
+	"context"
+	"database/sql"
+	"errors"
 	"fmt"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/mattn/go-sqlite3"
 	openfga "github.com/openfga/go-sdk"
-	"log"
+	"log/slog"
 	"strings"
+	"sync"
 	"time"
 )
 
-var (
-	db         *sqlx.DB
-	Repository TupleRepository
-)
-
+// TupleRepository reads and changes the tuples of a replica
 type TupleRepository interface {
-	CountTuples(filter *Filter) int
-	GetMarkedForDeletion() []Tuple
-	ApplyChange(change openfga.TupleChange)
-	Prune() int
+	CountTuples(filter *Filter) (int, error)
+	Load(offset int, filter *Filter) (*LoadResult, error)
+	GetMarkedForDeletion(owner string) ([]Tuple, error)
+	MarkDeletion(tupleKey, owner string) error
+	MarkStale(tupleKey string) error
+	ApplyChange(change openfga.TupleChange) error
+	Prune() (int, error)
+	GetUserTypes() ([]string, error)
+	GetRelations() ([]string, error)
+	GetObjectTypes() ([]string, error)
+}
+
+// SyncRepository keeps where the sync of a replica stopped and what happened to it
+type SyncRepository interface {
+	ApplyChanges(changes []openfga.TupleChange, connection Connection) error
+	GetConnection(apiUrl, storeId string) *Connection
+	GetContinuationToken(apiUrl, storeId, objectType string) *string
+	UpsertConnection(connection Connection) error
+	ScopeTypes(storeId string, types []string) (int, error)
+	RecordSyncEvent(event SyncEvent) error
+	GetSyncEvents(storeId string) ([]SyncEvent, error)
+	ResetContinuationTokens(storeId string, types []string) error
+	ElectSyncer(ctx context.Context, apiUrl, storeId string) (bool, error)
+	ClaimReplica(storeId string) error
+}
+
+// Repository is the whole data layer of the replica of a store
+type Repository interface {
+	TupleRepository
+	SyncRepository
+	HistoryRepository
+	AuditRepository
+	RepairRepository
+	StatsRepository
+	EnableHistory(enabled bool)
+	Backup(path string) error
+	Close() error
 }
 
+var _ Repository = (*SqlxRepository)(nil)
+
+// SqlxRepository is the replica of a single store, in a SQLite file or shared in PostgreSQL
 type SqlxRepository struct {
-	TupleRepository
 	_db *sqlx.DB
+	// syncConns hold the advisory locks of the stores this instance syncs in a shared replica
+	syncConns map[int64]*sql.Conn
+	syncLock  sync.Mutex
+	// keepHistory tells ApplyChange to also record every change in tuple_changes
+	keepHistory bool
+	// statements are the statements of the sync, prepared once when the replica is opened
+	statements map[string]*sqlx.Stmt
 }
 
-func (r *SqlxRepository) CountTuples(filter *Filter) int {
-	return countTuples(filter)
-}
-
-func (r *SqlxRepository) GetMarkedForDeletion() []Tuple {
-	return getMarkedForDeletion()
+func (r *SqlxRepository) CountTuples(filter *Filter) (int, error) {
+	return r.countTuples(filter)
 }
 
-func (r *SqlxRepository) ApplyChange(change openfga.TupleChange) {
-	applyChange(change)
+// GetMarkedForDeletion returns tuples marked for deletion by owner, or by no one
+func (r *SqlxRepository) GetMarkedForDeletion(owner string) ([]Tuple, error) {
+	return r.getMarkedForDeletion(owner)
 }
 
-func (r *SqlxRepository) Prune() int {
+func (r *SqlxRepository) Prune() (int, error) {
 	affectedRows := 0
-	err := Transact(func() {
-		rows, err := db.Queryx("select tuple_key from pending_actions where action = 'S'")
-		if err != nil {
-			log.Panic("Failed to query stale data")
-		}
+	err := r.Transact(func(tx *Tx) error {
 		var ids []string
-		for rows.Next() {
-			var tupleKey string
-			err = rows.Scan(&tupleKey)
-			if err != nil {
-				log.Printf("Failed to scan row %v", err)
+		if err := tx.tx.Select(&ids, "select tuple_key from pending_actions where action = 'S'"); err != nil {
+			return err
+		}
+		for _, tupleKey := range ids {
+			if err := tx.deleteTuple(tupleKey); err != nil {
+				return err
+			}
+			if _, err := tx.exec(clearPendingSql, tupleKey); err != nil {
+				return err
 			}
-			ids = append(ids, tupleKey)
 		}
-		_ = rows.Close()
-
-		query, args, _ := sqlx.In(`delete from tuples where tuple_key in (?)`, ids)
-		query = db.Rebind(query)
-		db.MustExec(query, args...)
-		query, args, _ = sqlx.In(`delete from pending_actions where tuple_key in (?)`, ids)
-		query = db.Rebind(query)
-		db.MustExec(query, args...)
 		affectedRows = len(ids)
+		return nil
 	})
 	if err != nil {
-		log.Printf("Failed to transact prune")
-		return 0
+		return 0, fmt.Errorf("failed to prune: %w", err)
 	}
-	return affectedRows
+	return affectedRows, nil
 }
 
-func newRepository() TupleRepository {
-	var repo TupleRepository
-	repo = &SqlxRepository{}
-	return repo
+const (
+	// sqliteOptions let the sync, the refreshers and the UI share a replica: readers and the writer don't block
+	// each other in WAL mode, writers wait for their turn instead of failing with "database is locked", and
+	// transactions take the write lock as they begin so two of them can't deadlock upgrading to it
+	sqliteOptions = "_journal_mode=WAL&_busy_timeout=5000&_synchronous=NORMAL&_txlock=immediate"
+	// sqliteConns caps the connections to a SQLite replica, enough for every reader of the UI and the sync
+	sqliteConns = 8
+)
+
+// sqliteConnsOf caps the connections to the SQLite replica at dataSource. An in-memory database is a separate
+// empty one on every connection, so it gets a single connection
+func sqliteConnsOf(dataSource string) int {
+	if strings.Contains(dataSource, ":memory:") || strings.Contains(dataSource, "mode=memory") {
+		return 1
+	}
+	return sqliteConns
 }
 
-// Transact keeps it simple and executes the passed function
-func Transact(f func()) error {
-	tx := db.MustBegin()
-	f()
-	err := tx.Commit()
-	if err != nil {
-		return err
+// sqliteDataSource adds sqliteOptions to the path of a SQLite replica
+func sqliteDataSource(path string) string {
+	if strings.Contains(path, "?") {
+		return path + "&" + sqliteOptions
 	}
-	return nil
+	return path + "?" + sqliteOptions
 }
 
-func setupDb(dataSource string) {
-	_db, err := sqlx.Open("sqlite3", dataSource)
+// Open opens the replica at dataSource, creating and migrating it as needed. dataSource is either the path
+// of a SQLite file or a postgres:// DSN
+func Open(dataSource string) (*SqlxRepository, error) {
+	driver, dataSourceName := driverOf(dataSource), dataSource
+	if driver == "sqlite3" {
+		dataSourceName = sqliteDataSource(dataSource)
+	}
+	db, err := sqlx.Open(driver, dataSourceName)
 	if err != nil {
-		log.Panic(err)
-	}
-	db = _db
-	sts := `
-		CREATE TABLE IF NOT EXISTS tuples(
-			tuple_key text not null primary key,
-		    user_type text not null, 
-			user_id text not null,
-			relation text not null,
-			object_type text not null, 
-			object_id text not null,
-			timestamp timestamp);
-		
-		CREATE INDEX IF NOT EXISTS idx_tuple_content on tuples(user_type, user_id, relation, object_id, object_type);
-		
-		CREATE TABLE IF NOT EXISTS pending_actions (
-		    tuple_key text not null primary key,
-			action text not null);
-
-		CREATE TABLE IF NOT EXISTS connections (
-		    api_url text not null,
-		    store_id text not null primary key ,
-		    continuation_token text,
-		    last_sync timestamp
-		)
-	`
-	db.MustExec(sts)
-	Repository = newRepository()
-	log.Printf("Finished db setup")
-}
-func SetupDb() {
-	setupDb("fga.db")
-}
-
-// applyChange Takes a tuple change straight from the API
-func applyChange(change openfga.TupleChange) {
-	userType, userId := splitTypePair(change.TupleKey.GetUser())
-	relation := change.TupleKey.GetRelation()
-	objectType, objectId := splitTypePair(change.TupleKey.GetObject())
-	tupleKey := fmt.Sprintf("%s %s %s",
-		change.GetTupleKey().User,
-		change.GetTupleKey().Relation,
-		change.GetTupleKey().Object)
-
-	// ensures whatever existing action is cleaned up
-	db.MustExec("delete from pending_actions where tuple_key = ?", tupleKey)
-
-	if change.Operation == openfga.WRITE {
-		sql := `insert into tuples (
-                    tuple_key,
-                    user_type,
-                    user_id,
-                    relation,
-                    object_type,
-                    object_id,
-                    timestamp ) values (:tuple_key,
-                                        :user_type,
-                                        :user_id,
-                                        :relation,
-                                        :object_type,
-                                        :object_id,
-                                        :timestamp) on conflict do update set timestamp = :timestamp`
-		timestamp := change.GetTimestamp()
-		_, err := db.NamedExec(sql, map[string]interface{}{
-			"tuple_key":   tupleKey,
-			"user_type":   userType,
-			"user_id":     userId,
-			"relation":    relation,
-			"object_type": objectType,
-			"object_id":   objectId,
-			"timestamp":   timestamp,
-		})
-
-		if err != nil {
-			log.Fatal(err)
-		}
-
-	} else if change.Operation == openfga.DELETE {
-		sql := `delete from tuples 
-	     		  where 
-				   tuple_key = :tuple_key
-				   `
-		_, err := db.NamedExec(sql, map[string]interface{}{
-			"tuple_key": tupleKey,
-		})
-		if err != nil {
-			log.Fatal(err)
-		}
+		return nil, err
+	}
+	if driver == "sqlite3" {
+		// idle connections are kept, so their statements stay prepared
+		conns := sqliteConnsOf(dataSource)
+		db.SetMaxOpenConns(conns)
+		db.SetMaxIdleConns(conns)
+	}
+	if err := migrate(db, dataSource); err != nil {
+		_ = db.Close()
+		return nil, err
 	}
+	repo := &SqlxRepository{_db: db}
+	if err := repo.prepare(); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	slog.Info("Finished db setup", "replica", RedactDataSource(dataSource))
+	return repo, nil
 }
 
+// Connection is the sync position of a store, for one object type or for every type when Type is empty
 type Connection struct {
 	ApiUrl            string    `db:"api_url"`
 	StoreId           string    `db:"store_id"`
+	Type              string    `db:"type"`
 	ContinuationToken string    `db:"continuation_token"`
 	LastSync          time.Time `db:"last_sync"`
 }
@@ -195,22 +172,17 @@ type Filter struct {
 	UserType   *string
 	Relation   *string
 	ObjectType *string
+	// AsOf reconstructs the tuples as they were at that time from the change history
+	AsOf *time.Time
 }
 
 func (f *Filter) isSet() bool {
-	return f.Search != nil || f.UserType != nil || f.Relation != nil || f.ObjectType != nil
+	return f.hasSearch() || f.UserType != nil || f.Relation != nil || f.ObjectType != nil || f.AsOf != nil
 }
 
-func UpsertConnection(connection Connection) {
-	_, err := db.NamedExec(`
-			insert into connections (api_url, store_id, continuation_token, last_sync) 
-				values (:api_url, :store_id, :continuation_token, :last_sync) on conflict do update 
-			set continuation_token = :continuation_token, 
-			    last_sync = :last_sync
-		`, &connection)
-	if err != nil {
-		log.Fatal(err)
-	}
+// hasSearch tells whether Search is long enough to be used, shorter terms are ignored
+func (f *Filter) hasSearch() bool {
+	return f.Search != nil && len(strings.TrimSpace(*f.Search)) >= minSearchLength
 }
 
 func splitTypePair(typePair string) (string, string) {
@@ -218,14 +190,82 @@ func splitTypePair(typePair string) (string, string) {
 	return split[0], split[1]
 }
 
-func Close() {
-	if db == nil {
-		log.Fatal("Db close called but was not defined")
+func (r *SqlxRepository) Close() error {
+	if r._db == nil {
+		return errors.New("db close called but was not defined")
+	}
+	r.resign()
+	r.closeStatements()
+	return r._db.Close()
+}
+
+// Backup writes a consistent copy of a SQLite replica to path while it's in use. Shared replicas are backed up
+// with the tools of PostgreSQL
+func (r *SqlxRepository) Backup(path string) error {
+	if r._db.DriverName() != "sqlite3" {
+		return errors.New("only SQLite replicas can be backed up, use pg_dump for a shared replica")
+	}
+	_, err := r._db.Exec("VACUUM INTO ?", path)
+	return err
+}
+
+// ClearLocalState empties what only concerns the instance a copy of a SQLite replica was taken from, its pending
+// actions and its audit log, and vacuums the copy so none of it is left in free pages. The audit log stays
+// append only
+func (r *SqlxRepository) ClearLocalState() error {
+	err := r.Transact(func(tx *Tx) error {
+		var triggers []struct {
+			Name string `db:"name"`
+			Sql  string `db:"sql"`
+		}
+		if err := tx.tx.Select(&triggers, `select name, sql from sqlite_master
+			where type = 'trigger' and tbl_name = 'audit_log'`); err != nil {
+			return err
+		}
+		var statements []string
+		for _, trigger := range triggers {
+			statements = append(statements, "drop trigger "+trigger.Name)
+		}
+		statements = append(statements, "delete from pending_actions", "delete from audit_log")
+		for _, trigger := range triggers {
+			statements = append(statements, trigger.Sql)
+		}
+		for _, statement := range statements {
+			if _, err := tx.tx.Exec(statement); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := r._db.Exec("VACUUM"); err != nil {
+		return err
 	}
-	err := db.Close()
+	_, err = r._db.Exec("PRAGMA wal_checkpoint(TRUNCATE)")
+	return err
+}
+
+// KeepAuditLog appends the audit log of the SQLite replica at path, for a replica replacing it to carry on its
+// log. The replica at path must be at the current schema
+func (r *SqlxRepository) KeepAuditLog(path string) error {
+	ctx := context.Background()
+	conn, err := r._db.Connx(ctx)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
+	defer func() { _ = conn.Close() }()
+	// attached on the connection alone, it can't be within a transaction
+	if _, err := conn.ExecContext(ctx, "ATTACH DATABASE ? AS previous", path); err != nil {
+		return err
+	}
+	defer func() { _, _ = conn.ExecContext(ctx, "DETACH DATABASE previous") }()
+	_, err = conn.ExecContext(ctx, `insert into audit_log (timestamp, operator, profile, api_url, store_id, operation,
+		tuple_keys, status_code, response)
+		select timestamp, operator, profile, api_url, store_id, operation, tuple_keys, status_code, response
+		from previous.audit_log order by id`)
+	return err
 }
 
 type Tuple struct {
@@ -261,6 +301,17 @@ type LoadResult struct {
 	total  int
 }
 
+// NewLoadResult is the page of res, loaded out of total tuples matching filter. res must not be empty
+func NewLoadResult(res []TuplePendingAction, filter *Filter, total int) *LoadResult {
+	return &LoadResult{
+		lowerBound: res[0].Row,
+		upperBound: res[len(res)-1].Row,
+		Res:        res,
+		Filter:     filter,
+		total:      total,
+	}
+}
+
 func (l *LoadResult) GetTotal() int {
 	return l.total
 }
@@ -273,74 +324,63 @@ func (l *LoadResult) GetUpperBound() int {
 	return l.upperBound
 }
 
-func Load(offset int, filter *Filter) *LoadResult {
-
-	var params = map[string]interface{}{
-		"offset": offset,
-	}
-
-	var whereClauses []string
-	if filter != nil && filter.Search != nil && len(strings.TrimSpace(*filter.Search)) > 3 {
-		whereClauses = append(whereClauses, "tuples.tuple_key like :query\n")
-		params["query"] = filter.Search
-	}
-	if filter != nil && filter.UserType != nil {
-		whereClauses = append(whereClauses, "tuples.user_type = :userType\n")
-		params["userType"] = filter.UserType
-	}
-	if filter != nil && filter.Relation != nil {
-		whereClauses = append(whereClauses, "tuples.relation = :relation\n")
-		params["relation"] = filter.Relation
-	}
-	if filter != nil && filter.ObjectType != nil {
-		whereClauses = append(whereClauses, "tuples.object_type = :objectType\n")
-		params["objectType"] = filter.ObjectType
-	}
-
-	finalWhere := strings.Join(whereClauses[:], " and ")
-	if finalWhere != "" {
-		finalWhere = " where " + finalWhere
-	}
+// Load reads the page of tuples from offset on, nil when there is none
+func (r *SqlxRepository) Load(offset int, filter *Filter) (*LoadResult, error) {
+	query := compileFilter(filter)
+	query.params["offset"] = offset
 
 	selectClause := fmt.Sprintf(`
-			select tuples.*, p.action from (select *, row_number() over (order by timestamp desc) as row_number from tuples %v) tuples
+			select tuples.*, coalesce(p.action, '') as action from (select *, row_number() over (order by timestamp desc, tuple_key) as row_number from %v%v) tuples
 			         left join pending_actions p on tuples.tuple_key = p.tuple_key 
-			where row_number >= :offset and row_number <= :offset + 200
-			`, finalWhere)
+			where row_number >= :offset and row_number <= :offset + %v
+			`, query.from, query.where, pageSize)
 
-	log.Printf("Load Query: %v\noffset: %v", selectClause, offset)
-	rows, err := db.NamedQuery(selectClause, params)
+	slog.Debug("Load query", "query", selectClause, "offset", offset)
+	rows, err := r._db.NamedQuery(selectClause, query.params)
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("failed to load tuples: %w", err)
 	}
+	defer func() { _ = rows.Close() }()
 
 	var res []TuplePendingAction
 	for rows.Next() {
 		var p TuplePendingAction
-		err = rows.StructScan(&p)
+		if err := rows.StructScan(&p); err != nil {
+			return nil, fmt.Errorf("failed to load tuples: %w", err)
+		}
 		res = append(res, p)
 	}
-	err = rows.Close()
-	if err != nil {
-		log.Panic(err)
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to load tuples: %w", err)
 	}
 	if len(res) == 0 {
-		return nil
+		return nil, nil
 	}
 
-	return &LoadResult{
-		lowerBound: res[0].Row,
-		upperBound: res[len(res)-1].Row,
-		Res:        res,
-		Filter:     filter,
-		total:      Repository.CountTuples(filter),
+	total, err := r.CountTuples(filter)
+	if err != nil {
+		return nil, err
 	}
+	return NewLoadResult(res, filter, total), nil
 }
 
-func GetContinuationToken(apiUrl, storeId string) *string {
+// GetConnection returns the sync state of a store, of its latest synced type when it's type scoped.
+// nil if it was never synced
+func (r *SqlxRepository) GetConnection(apiUrl, storeId string) *Connection {
+	var connection Connection
+	err := r._db.Get(&connection, r._db.Rebind(`select * from connections where api_url = ? and store_id = ?
+                          order by last_sync desc limit 1`), apiUrl, storeId)
+	if err != nil {
+		return nil
+	}
+	return &connection
+}
+
+// GetContinuationToken is where the sync of objectType stopped, objectType is empty when every type is synced
+func (r *SqlxRepository) GetContinuationToken(apiUrl, storeId, objectType string) *string {
 	var token string
-	err := db.Get(&token, `select continuation_token from connections 
-                          where api_url = ? and store_id = ?`, apiUrl, storeId)
+	err := r._db.Get(&token, r._db.Rebind(`select continuation_token from connections 
+                          where api_url = ? and store_id = ? and type = ?`), apiUrl, storeId, objectType)
 
 	if err != nil {
 		return nil
@@ -348,131 +388,132 @@ func GetContinuationToken(apiUrl, storeId string) *string {
 	return &token
 }
 
-func countTuples(filter *Filter) int {
-	selectClause := "select count(*) as count from tuples"
-	var params = make(map[string]interface{})
-	if filter != nil && filter.isSet() {
-		selectClause = fmt.Sprintf("%v where", selectClause)
+// ClaimReplica records storeId as the store of the replica the first time it's opened for one, and refuses a
+// replica of another store. Tuples, counts and pending actions aren't kept by store, so they would mix
+func (r *SqlxRepository) ClaimReplica(storeId string) error {
+	_, err := r._db.Exec(r._db.Rebind(`insert into replica_store (id, store_id) values (1, ?) on conflict do nothing`), storeId)
+	if err != nil {
+		return fmt.Errorf("failed to claim the replica: %w", err)
 	}
-	if filter != nil && filter.Search != nil && len(strings.TrimSpace(*filter.Search)) > 3 {
-		selectClause = fmt.Sprintf("%s tuples.tuple_key like :query\n", selectClause)
-		params["query"] = filter.Search
+	var owner string
+	if err := r._db.Get(&owner, `select store_id from replica_store`); err != nil {
+		return fmt.Errorf("failed to claim the replica: %w", err)
 	}
-	if filter != nil && filter.UserType != nil {
-		if len(params) > 0 {
-			selectClause = fmt.Sprintf("%s and ", selectClause)
-		}
-		selectClause = fmt.Sprintf("%s tuples.user_type = :userType\n", selectClause)
-		params["userType"] = filter.UserType
+	if owner != storeId {
+		return fmt.Errorf("the replica holds store %v, give %v a replica of its own", owner, storeId)
 	}
-	if filter != nil && filter.Relation != nil {
-		if len(params) > 0 {
-			selectClause = fmt.Sprintf("%s and ", selectClause)
-		}
-		selectClause = fmt.Sprintf("%s tuples.relation = :relation\n", selectClause)
-		params["relation"] = filter.Relation
+	return nil
+}
+
+// ScopeTypes keeps only what the replica needs to sync types, or every type when types is empty.
+// The sync positions of other scopes are dropped and, when scoped, the tuples of other object types too.
+// Returns how many tuples were dropped
+func (r *SqlxRepository) ScopeTypes(storeId string, types []string) (int, error) {
+	scopes := types
+	if len(types) == 0 {
+		scopes = []string{""}
+	}
+	tx, err := r._db.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = tx.Rollback() }()
+	query, args, err := sqlx.In(`delete from connections where store_id = ? and type not in (?)`, storeId, scopes)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(tx.Rebind(query), args...); err != nil {
+		return 0, err
 	}
-	if filter != nil && filter.ObjectType != nil {
-		if len(params) > 0 {
-			selectClause = fmt.Sprintf("%s and ", selectClause)
+	dropped := int64(0)
+	if len(types) > 0 {
+		query, args, err = sqlx.In(`delete from tuples where object_type not in (?)`, types)
+		if err != nil {
+			return 0, err
+		}
+		result, err := tx.Exec(tx.Rebind(query), args...)
+		if err != nil {
+			return 0, err
+		}
+		dropped, _ = result.RowsAffected()
+		query, args, err = sqlx.In(`delete from tuple_counts where object_type not in (?)`, types)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := tx.Exec(tx.Rebind(query), args...); err != nil {
+			return 0, err
 		}
-		selectClause = fmt.Sprintf("%s tuples.object_type = :objectType", selectClause)
-		params["objectType"] = filter.ObjectType
+	}
+	return int(dropped), tx.Commit()
+}
+
+func (r *SqlxRepository) countTuples(filter *Filter) (int, error) {
+	query := compileFilter(filter)
+	selectClause := "select count(*) as count from " + query.from + query.where
+	if filter == nil || (!filter.hasSearch() && filter.AsOf == nil) {
+		// types and relations alone are answered by the counts kept as changes are applied
+		selectClause = "select coalesce(sum(count), 0) as count from tuple_counts tuples" + query.where
 	}
 
-	log.Printf("Count query '%v'", selectClause)
+	slog.Debug("Count query", "query", selectClause)
 
-	res, err := db.NamedQuery(selectClause, params)
+	selectClause, args, err := r._db.BindNamed(selectClause, query.params)
 	if err != nil {
-		log.Fatal(err)
-		return 0
+		return 0, fmt.Errorf("failed to count tuples: %w", err)
 	}
-	res.Next()
 	var count int
-	err = res.Scan(&count)
-	if err != nil {
-		return 0
-	}
-	err = res.Close()
-	if err != nil {
-		return 0
+	if err := r._db.Get(&count, selectClause, args...); err != nil {
+		return 0, fmt.Errorf("failed to count tuples: %w", err)
 	}
-	return count
+	return count, nil
 }
 
-func MarkDeletion(tupleKey string) {
-	sql := `insert into pending_actions (tuple_key, action) values (?, 'D') 
+// MarkDeletion marks a tuple for deletion, to be sent by the instances of owner
+func (r *SqlxRepository) MarkDeletion(tupleKey, owner string) error {
+	sql := `insert into pending_actions (tuple_key, action, owner) values (?, 'D', ?) 
             on conflict do nothing `
-	_, err := db.Exec(sql, tupleKey)
-
-	if err != nil {
-		log.Printf("Failed making for deletion %v", err.Error())
+	if _, err := r._db.Exec(r._db.Rebind(sql), tupleKey, owner); err != nil {
+		return fmt.Errorf("failed marking %v for deletion: %w", tupleKey, err)
 	}
+	return nil
 }
 
-func MarkStale(tupleKey string) {
+func (r *SqlxRepository) MarkStale(tupleKey string) error {
 	sql := `insert into pending_actions (tuple_key, action) values (?, 'S') 
-            on conflict do update set action = 'S'`
-	_, err := db.Exec(sql, tupleKey)
-
-	if err != nil {
-		log.Printf("Failed making for deletion %v", err.Error())
+            on conflict (tuple_key) do update set action = 'S'`
+	if _, err := r._db.Exec(r._db.Rebind(sql), tupleKey); err != nil {
+		return fmt.Errorf("failed marking %v as stale: %w", tupleKey, err)
 	}
+	return nil
 }
 
-func getTypes(typeToCount string) []string {
-	result, err := db.Query(fmt.Sprintf("select distinct %v from tuples order by 1", typeToCount))
-	if err != nil {
-		log.Printf("Failed to get user Types %v", err.Error())
-		return []string{"ERROR"}
-	}
-	var userTypes []string
-	for result.Next() {
-		var userType string
-		err := result.Scan(&userType)
-		if err != nil {
-			log.Panic(err)
-		}
-		userTypes = append(userTypes, userType)
+func (r *SqlxRepository) getTypes(typeToCount string) ([]string, error) {
+	var types []string
+	if err := r._db.Select(&types, fmt.Sprintf("select distinct %v from tuple_counts order by 1", typeToCount)); err != nil {
+		return nil, fmt.Errorf("failed to get %v values: %w", typeToCount, err)
 	}
-	err = result.Close()
-	if err != nil {
-		return nil
-	}
-	return userTypes
+	return types, nil
 }
 
-func GetUserTypes() []string {
-	return getTypes("user_type")
+func (r *SqlxRepository) GetUserTypes() ([]string, error) {
+	return r.getTypes("user_type")
 }
 
-func GetRelations() []string {
-	return getTypes("relation")
+func (r *SqlxRepository) GetRelations() ([]string, error) {
+	return r.getTypes("relation")
 }
 
-func GetObjectTypes() []string {
-	return getTypes("object_type")
+func (r *SqlxRepository) GetObjectTypes() ([]string, error) {
+	return r.getTypes("object_type")
 }
 
-func getMarkedForDeletion() []Tuple {
+func (r *SqlxRepository) getMarkedForDeletion(owner string) ([]Tuple, error) {
 	sql := `select tuples.* from tuples join pending_actions on pending_actions.tuple_key = tuples.tuple_key and
-		pending_actions.action = 'D' limit 10
+		pending_actions.action = 'D' and pending_actions.owner in (?, '') limit 10
 	`
-	rows, err := db.Queryx(sql)
-	if err != nil {
-		log.Printf("Failed to fetch marked for deletion")
-		return nil
-	}
 	var results []Tuple
-	for rows.Next() {
-		var tuple Tuple
-		err := rows.StructScan(&tuple)
-		if err != nil {
-			log.Printf("Failed to Scan row %v", err)
-			return nil
-		}
-		results = append(results, tuple)
+	if err := r._db.Select(&results, r._db.Rebind(sql), owner); err != nil {
+		return nil, fmt.Errorf("failed to fetch marked for deletion: %w", err)
 	}
-	_ = rows.Close()
-	return results
+	return results, nil
 }
@@ -1,14 +1,21 @@
 package db
 
 import (
+	"bytes"
+	"fmt"
 	openfga "github.com/openfga/go-sdk"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
 
 func TestCount(t *testing.T) {
-	setupDb(":memory:")
-	defer Close()
+	repo := mustOpen(t, ":memory:")
+	defer repo.Close()
 
 	t.Run("Count ok on write", func(subtest *testing.T) {
 		// given
@@ -21,10 +28,10 @@ func TestCount(t *testing.T) {
 			Timestamp: time.Now()}
 
 		// when
-		Repository.ApplyChange(tupleChange)
+		repo.ApplyChange(tupleChange)
 
 		// then
-		if c := Repository.CountTuples(nil); c != 1 {
+		if c, _ := repo.CountTuples(nil); c != 1 {
 			t.Error("There must be 1 entry")
 		}
 	})
@@ -40,12 +47,376 @@ func TestCount(t *testing.T) {
 			Timestamp: time.Now()}
 
 		// when
-		applyChange(tupleChange)
+		repo.ApplyChange(tupleChange)
 
 		// then
-		if c := Repository.CountTuples(nil); c != 0 {
+		if c, _ := repo.CountTuples(nil); c != 0 {
 			t.Error("There must be 1 entry")
 		}
 	})
 
 }
+
+func TestHistory(t *testing.T) {
+	repo := mustOpen(t, ":memory:")
+	defer repo.Close()
+	repo.EnableHistory(true)
+
+	start := time.Date(2024, 2, 10, 10, 0, 0, 0, time.UTC)
+	change := func(operation openfga.TupleOperation, object string, minutes int) openfga.TupleChange {
+		return openfga.TupleChange{
+			TupleKey: openfga.TupleKey{
+				User:     "user:jack",
+				Relation: "member",
+				Object:   object},
+			Operation: operation,
+			Timestamp: start.Add(time.Duration(minutes) * time.Minute)}
+	}
+	repo.ApplyChange(change(openfga.WRITE, "group:boss", 0))
+	repo.ApplyChange(change(openfga.WRITE, "group:staff", 5))
+	repo.ApplyChange(change(openfga.DELETE, "group:boss", 10))
+
+	t.Run("Tuple history keeps deletes", func(t *testing.T) {
+		history, _ := repo.GetTupleHistory("user:jack member group:boss")
+		if len(history) != 2 {
+			t.Fatalf("Expected 2 changes, got %v", len(history))
+		}
+		if history[0].Operation != "D" || history[1].Operation != "W" {
+			t.Errorf("Expected newest first, got %v then %v", history[0].Operation, history[1].Operation)
+		}
+	})
+
+	t.Run("Object history", func(t *testing.T) {
+		if history, _ := repo.GetObjectHistory("group", "staff"); len(history) != 1 {
+			t.Errorf("Expected 1 change, got %v", len(history))
+		}
+	})
+
+	t.Run("As of reconstructs past state", func(t *testing.T) {
+		for minutes, expected := range map[int]int{-1: 0, 0: 1, 7: 2, 10: 1} {
+			asOf := start.Add(time.Duration(minutes) * time.Minute)
+			if c, _ := repo.CountTuples(&Filter{AsOf: &asOf}); c != expected {
+				t.Errorf("Expected %v tuples at %v, got %v", expected, asOf, c)
+			}
+		}
+		if c, _ := repo.CountTuples(nil); c != 1 {
+			t.Errorf("Current state must have 1 tuple, got %v", c)
+		}
+	})
+}
+
+func TestAuditLog(t *testing.T) {
+	repo := mustOpen(t, ":memory:")
+	defer repo.Close()
+
+	entry := AuditEntry{
+		Timestamp:  time.Now().UTC().Truncate(time.Second),
+		Operator:   "jack",
+		Profile:    "prod",
+		ApiUrl:     "http://localhost:8087",
+		StoreId:    "01HME1",
+		Operation:  "delete",
+		TupleKeys:  TupleKeys{"user:jack member org:acme", "user:jill member org:acme"},
+		StatusCode: 200,
+		Response:   "200 OK",
+	}
+	if err := repo.RecordAudit(entry); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, _ := repo.GetAuditLog()
+	if len(entries) != 1 {
+		t.Fatalf("Expected 1 entry, got %v", len(entries))
+	}
+	entry.Id = entries[0].Id
+	if !reflect.DeepEqual(entries[0], entry) {
+		t.Errorf("Expected %+v, got %+v", entry, entries[0])
+	}
+
+	for _, statement := range []string{"update audit_log set operator = 'jill'", "delete from audit_log"} {
+		if _, err := repo._db.Exec(statement); err == nil {
+			t.Errorf("%v must be refused", statement)
+		}
+	}
+
+	var out bytes.Buffer
+	if exported, err := repo.ExportAudit(&out); err != nil || exported != 1 {
+		t.Errorf("Expected 1 exported entry, got %v (%v)", exported, err)
+	}
+	if !strings.Contains(out.String(), `"tupleKeys":["user:jack member org:acme","user:jill member org:acme"]`) {
+		t.Errorf("Unexpected export %v", out.String())
+	}
+}
+
+func TestApplyChanges(t *testing.T) {
+	repo := mustOpen(t, ":memory:")
+	defer repo.Close()
+	repo.EnableHistory(true)
+
+	change := func(operation openfga.TupleOperation, user string) openfga.TupleChange {
+		return openfga.TupleChange{
+			TupleKey:  openfga.TupleKey{User: user, Relation: "member", Object: "group:boss"},
+			Operation: operation,
+			Timestamp: time.Now()}
+	}
+	connection := func(token string) Connection {
+		return Connection{ApiUrl: "http://localhost:8087", StoreId: "01HME1", ContinuationToken: token, LastSync: time.Now()}
+	}
+	repo.MarkDeletion("user:jack member group:boss", "jack@test")
+
+	err := repo.ApplyChanges([]openfga.TupleChange{
+		change(openfga.WRITE, "user:jack"),
+		change(openfga.WRITE, "user:jill"),
+		change(openfga.DELETE, "user:jill"),
+	}, connection("3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, _ := repo.CountTuples(nil); c != 1 {
+		t.Errorf("Expected 1 tuple, got %v", c)
+	}
+	if token := repo.GetContinuationToken("http://localhost:8087", "01HME1", ""); token == nil || *token != "3" {
+		t.Errorf("Expected token 3, got %v", token)
+	}
+	if marked, _ := repo.GetMarkedForDeletion("jack@test"); len(marked) != 0 {
+		t.Errorf("Applied changes must clear pending actions, got %v", marked)
+	}
+	if history, _ := repo.GetTupleHistory("user:jill member group:boss"); len(history) != 2 {
+		t.Errorf("Expected 2 changes in the history, got %v", len(history))
+	}
+
+	t.Run("Failed batch applies nothing", func(t *testing.T) {
+		repo._db.MustExec("drop table tuple_changes")
+		err := repo.ApplyChanges([]openfga.TupleChange{change(openfga.WRITE, "user:joe")}, connection("4"))
+		if err == nil {
+			t.Fatal("Expected the batch to fail")
+		}
+		if c, _ := repo.CountTuples(nil); c != 1 {
+			t.Errorf("Expected 1 tuple, got %v", c)
+		}
+		if token := repo.GetContinuationToken("http://localhost:8087", "01HME1", ""); *token != "3" {
+			t.Errorf("Expected token 3, got %v", *token)
+		}
+	})
+}
+
+func TestScopeTypes(t *testing.T) {
+	repo := mustOpen(t, ":memory:")
+	defer repo.Close()
+
+	for _, object := range []string{"document:1", "document:2", "folder:1", "team:1"} {
+		repo.ApplyChange(openfga.TupleChange{
+			TupleKey:  openfga.TupleKey{User: "user:jack", Relation: "viewer", Object: object},
+			Operation: openfga.WRITE,
+			Timestamp: time.Now()})
+	}
+	for _, objectType := range []string{"", "document", "team"} {
+		repo.UpsertConnection(Connection{ApiUrl: "http://localhost:8087", StoreId: "01HME1", Type: objectType, ContinuationToken: "TOKEN"})
+	}
+
+	dropped, err := repo.ScopeTypes("01HME1", []string{"document", "folder"})
+	if err != nil || dropped != 1 {
+		t.Errorf("Expected the team tuple to be dropped, got %v (%v)", dropped, err)
+	}
+	if c, _ := repo.CountTuples(nil); c != 3 {
+		t.Errorf("Expected 3 tuples, got %v", c)
+	}
+	for objectType, kept := range map[string]bool{"": false, "document": true, "team": false} {
+		if token := repo.GetContinuationToken("http://localhost:8087", "01HME1", objectType); (token != nil) != kept {
+			t.Errorf("Token of %q kept %v, expected %v", objectType, token != nil, kept)
+		}
+	}
+
+	t.Run("Every type again", func(t *testing.T) {
+		if dropped, err := repo.ScopeTypes("01HME1", nil); err != nil || dropped != 0 {
+			t.Errorf("No tuple must be dropped, got %v (%v)", dropped, err)
+		}
+		if token := repo.GetContinuationToken("http://localhost:8087", "01HME1", "document"); token != nil {
+			t.Errorf("Type tokens must be dropped, got %v", *token)
+		}
+	})
+}
+
+func TestMarkedByOwner(t *testing.T) {
+	repo := mustOpen(t, filepath.Join(t.TempDir(), "fga.db"))
+	defer repo.Close()
+	for _, user := range []string{"user:jack", "user:jill", "user:joe"} {
+		repo.ApplyChange(openfga.TupleChange{TupleKey: *openfga.NewTupleKey(user, "viewer", "document:1"), Operation: openfga.WRITE, Timestamp: time.Now()})
+	}
+	_ = repo.MarkDeletion("user:jack viewer document:1", "jack@prod")
+	_ = repo.MarkDeletion("user:jill viewer document:1", "jill@prod")
+	// marked before marks had owners
+	repo._db.MustExec("insert into pending_actions (tuple_key, action) values ('user:joe viewer document:1', 'D')")
+
+	marked, err := repo.GetMarkedForDeletion("jack@prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, tuple := range marked {
+		keys = append(keys, tuple.TupleKey)
+	}
+	sort.Strings(keys)
+	if expected := []string{"user:jack viewer document:1", "user:joe viewer document:1"}; !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Expected the marks of jack and the ones without owner, got %v", keys)
+	}
+}
+
+func TestClaimReplica(t *testing.T) {
+	repo := mustOpen(t, filepath.Join(t.TempDir(), "fga.db"))
+	defer repo.Close()
+
+	for _, storeId := range []string{"01HME1", "01HME1"} {
+		if err := repo.ClaimReplica(storeId); err != nil {
+			t.Errorf("The replica must be claimed by its store, got %v", err)
+		}
+	}
+	if err := repo.ClaimReplica("01HME2"); err == nil || !strings.Contains(err.Error(), "holds store 01HME1") {
+		t.Errorf("Another store must be refused, got %v", err)
+	}
+}
+
+func TestSyncEvents(t *testing.T) {
+	repo := mustOpen(t, ":memory:")
+	defer repo.Close()
+
+	repo.UpsertConnection(Connection{ApiUrl: "http://localhost:8087", StoreId: "01HME1", ContinuationToken: "TOKEN"})
+	for _, event := range []string{TokenRejected, TokenReset} {
+		err := repo.RecordSyncEvent(SyncEvent{Timestamp: time.Now(), ApiUrl: "http://localhost:8087", StoreId: "01HME1",
+			Event: event, ContinuationToken: "TOKEN", Reason: "invalid_continuation_token"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	events, err := repo.GetSyncEvents("01HME1")
+	if err != nil || len(events) != 2 || events[0].Event != TokenReset {
+		t.Errorf("Expected the reset first, got %+v (%v)", events, err)
+	}
+
+	repo.UpsertConnection(Connection{ApiUrl: "http://localhost:8087", StoreId: "01HME1", Type: "document", ContinuationToken: "TOKEN"})
+	if err := repo.ResetContinuationTokens("01HME1", []string{""}); err != nil {
+		t.Fatal(err)
+	}
+	if token := repo.GetContinuationToken("http://localhost:8087", "01HME1", ""); token != nil {
+		t.Errorf("Token must be dropped, got %v", *token)
+	}
+	if token := repo.GetContinuationToken("http://localhost:8087", "01HME1", "document"); token == nil {
+		t.Error("Tokens of other types must be kept")
+	}
+}
+
+func TestFailuresAreReturned(t *testing.T) {
+	repo := mustOpen(t, ":memory:")
+	repo._db.MustExec("drop table pending_actions")
+
+	if _, err := repo.Load(0, nil); err == nil {
+		t.Error("Expected Load to fail")
+	}
+	if _, err := repo.GetMarkedForDeletion("jack@test"); err == nil {
+		t.Error("Expected GetMarkedForDeletion to fail")
+	}
+	if err := repo.MarkStale("user:jack member group:boss"); err == nil {
+		t.Error("Expected MarkStale to fail")
+	}
+	if err := repo.ApplyChange(openfga.TupleChange{
+		TupleKey:  openfga.TupleKey{User: "user:jack", Relation: "member", Object: "group:boss"},
+		Operation: openfga.WRITE,
+		Timestamp: time.Now()}); err == nil {
+		t.Error("Expected ApplyChange to fail")
+	}
+
+	if err := repo.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.CountTuples(nil); err == nil {
+		t.Error("Expected CountTuples to fail once closed")
+	}
+	if _, err := repo.GetUserTypes(); err == nil {
+		t.Error("Expected GetUserTypes to fail once closed")
+	}
+}
+
+func mustOpen(t testing.TB, dataSource string) *SqlxRepository {
+	t.Helper()
+	repo, err := Open(dataSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return repo
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	repo := syncedReplica(t, 10)
+	var mode string
+	if err := repo._db.Get(&mode, "pragma journal_mode"); err != nil || mode != "wal" {
+		t.Errorf("Expected the replica in WAL mode, got %v (%v)", mode, err)
+	}
+
+	// the sync, the deletion worker and the readers of the UI at once
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for page := 10; page < 30; page++ {
+			if err := repo.ApplyChanges(changePage(page), benchConnection(page)); err != nil {
+				errs <- err
+			}
+		}
+	}()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			if err := repo.MarkDeletion(fmt.Sprintf("user:%v viewer document:%v", i*3, i*3/10), "jack@test"); err != nil {
+				errs <- err
+			}
+		}
+	}()
+	for reader := 0; reader < 4; reader++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				if _, err := repo.Load(0, nil); err != nil {
+					errs <- err
+				}
+				if _, err := repo.CountTuples(nil); err != nil {
+					errs <- err
+				}
+				if _, err := repo.GetObjectTypes(); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if c, _ := repo.CountTuples(nil); c != 30*benchPageSize {
+		t.Errorf("Expected every page applied, got %v tuples", c)
+	}
+}
+
+func TestInMemoryReplica(t *testing.T) {
+	// every connection to :memory: is another empty database
+	repo := mustOpen(t, ":memory:")
+	defer func() { _ = repo.Close() }()
+	if conns := repo._db.Stats().MaxOpenConnections; conns != 1 {
+		t.Errorf("Expected a single connection, got %v", conns)
+	}
+	if err := repo.ApplyChanges(changePage(0), benchConnection(0)); err != nil {
+		t.Fatal(err)
+	}
+	if c, err := repo.CountTuples(nil); err != nil || c != benchPageSize {
+		t.Errorf("Expected %v tuples, got %v (%v)", benchPageSize, c, err)
+	}
+
+	file := mustOpen(t, filepath.Join(t.TempDir(), "fga.db"))
+	defer func() { _ = file.Close() }()
+	if conns := file._db.Stats().MaxOpenConnections; conns != sqliteConns {
+		t.Errorf("Expected %v connections to a file, got %v", sqliteConns, conns)
+	}
+}
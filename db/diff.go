@@ -0,0 +1,194 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"io"
+	"os"
+	"strings"
+)
+
+// sqliteHeader starts every SQLite database file
+const sqliteHeader = "SQLite format 3\x00"
+
+// DiffResult has the tuple keys of each side of a comparison, sorted
+type DiffResult struct {
+	Left      string
+	Right     string
+	OnlyLeft  []string
+	OnlyRight []string
+	Common    []string
+}
+
+// Plan lists the writes and deletes that make the right side match the left side
+func (d *DiffResult) Plan() (writes []string, deletes []string) {
+	return d.OnlyLeft, d.OnlyRight
+}
+
+// IsReplica tells a fgamanager SQLite replica from an exported tuple file
+func IsReplica(path string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = file.Close() }()
+	header := make([]byte, len(sqliteHeader))
+	if _, err := io.ReadFull(file, header); err != nil {
+		return false, nil
+	}
+	return string(header) == sqliteHeader, nil
+}
+
+// ReplicaStoreId reads which store a replica holds, or was synced from when it's older than replica_store
+func ReplicaStoreId(path string) (string, error) {
+	replica, err := sqlx.Open("sqlite3", path)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = replica.Close() }()
+	var storeIds []string
+	if err := replica.Select(&storeIds, "select store_id from replica_store"); err == nil && len(storeIds) == 1 {
+		return storeIds[0], nil
+	}
+	if err := replica.Select(&storeIds, "select distinct store_id from connections"); err != nil {
+		return "", err
+	}
+	if len(storeIds) != 1 {
+		return "", fmt.Errorf("replica %v has %v stores, expected 1", path, len(storeIds))
+	}
+	return storeIds[0], nil
+}
+
+type exportedTuple struct {
+	User     string `json:"user"`
+	Relation string `json:"relation"`
+	Object   string `json:"object"`
+}
+
+// ReadTupleFile parses an exported file. It's either one "user relation object" per line,
+// with # comments, or a JSON array of {"user", "relation", "object"}, optionally in a "tuples" field.
+func ReadTupleFile(path string) ([]string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	trimmed := bytes.TrimSpace(content)
+	if len(trimmed) > 0 && (trimmed[0] == '[' || trimmed[0] == '{') {
+		return readJsonTuples(trimmed)
+	}
+
+	var keys []string
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		parts := strings.Fields(text)
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("%v:%v: expected 'user relation object', got %q", path, line, text)
+		}
+		keys = append(keys, strings.Join(parts, " "))
+	}
+	return keys, scanner.Err()
+}
+
+func readJsonTuples(content []byte) ([]string, error) {
+	var tuples []exportedTuple
+	if content[0] == '{' {
+		var wrapper struct {
+			Tuples []exportedTuple `json:"tuples"`
+		}
+		if err := json.Unmarshal(content, &wrapper); err != nil {
+			return nil, err
+		}
+		tuples = wrapper.Tuples
+	} else if err := json.Unmarshal(content, &tuples); err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(tuples))
+	for _, t := range tuples {
+		if t.User == "" || t.Relation == "" || t.Object == "" {
+			return nil, fmt.Errorf("incomplete tuple %+v", t)
+		}
+		keys = append(keys, fmt.Sprintf("%s %s %s", t.User, t.Relation, t.Object))
+	}
+	return keys, nil
+}
+
+// loadSide fills table with the tuple keys of a replica or of an exported file
+func loadSide(scratch *sqlx.DB, table, path string) error {
+	scratch.MustExec(fmt.Sprintf("create table %v (tuple_key text not null primary key)", table))
+	replica, err := IsReplica(path)
+	if err != nil {
+		return err
+	}
+	if replica {
+		schema := table + "_replica"
+		if _, err := scratch.Exec("attach database ? as "+schema, path); err != nil {
+			return err
+		}
+		_, err = scratch.Exec(fmt.Sprintf("insert into %v select tuple_key from %v.tuples", table, schema))
+		return err
+	}
+
+	keys, err := ReadTupleFile(path)
+	if err != nil {
+		return err
+	}
+	tx := scratch.MustBegin()
+	insert, err := tx.Prepare(fmt.Sprintf("insert into %v (tuple_key) values (?) on conflict do nothing", table))
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	for _, key := range keys {
+		if _, err := insert.Exec(key); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	_ = insert.Close()
+	return tx.Commit()
+}
+
+// Diff compares the tuples of left and right, each either a replica or an exported file
+func Diff(left, right string) (*DiffResult, error) {
+	for _, path := range []string{left, right} {
+		if _, err := os.Stat(path); err != nil {
+			return nil, err
+		}
+	}
+	scratch, err := sqlx.Open("sqlite3", ":memory:")
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = scratch.Close() }()
+	// attached databases and the in memory tables live in a single connection
+	scratch.SetMaxOpenConns(1)
+
+	if err := loadSide(scratch, "left_side", left); err != nil {
+		return nil, fmt.Errorf("unable to read %v: %w", left, err)
+	}
+	if err := loadSide(scratch, "right_side", right); err != nil {
+		return nil, fmt.Errorf("unable to read %v: %w", right, err)
+	}
+
+	result := &DiffResult{Left: left, Right: right}
+	queries := map[*[]string]string{
+		&result.OnlyLeft:  "select tuple_key from left_side except select tuple_key from right_side order by 1",
+		&result.OnlyRight: "select tuple_key from right_side except select tuple_key from left_side order by 1",
+		&result.Common:    "select tuple_key from left_side intersect select tuple_key from right_side order by 1",
+	}
+	for dest, query := range queries {
+		if err := scratch.Select(dest, query); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
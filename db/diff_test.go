@@ -0,0 +1,83 @@
+package db
+
+import (
+	openfga "github.com/openfga/go-sdk"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func replicaWith(t *testing.T, keys ...openfga.TupleKey) string {
+	t.Helper()
+	dataSource := filepath.Join(t.TempDir(), "fga.db")
+	repo := mustOpen(t, dataSource)
+	defer repo.Close()
+	for _, key := range keys {
+		repo.ApplyChange(openfga.TupleChange{TupleKey: key, Operation: openfga.WRITE, Timestamp: time.Now()})
+	}
+	return dataSource
+}
+
+func TestDiff(t *testing.T) {
+	jack := openfga.TupleKey{User: "user:jack", Relation: "member", Object: "group:boss"}
+	anne := openfga.TupleKey{User: "user:anne", Relation: "owner", Object: "doc:budget"}
+	bob := openfga.TupleKey{User: "user:bob", Relation: "viewer", Object: "doc:budget"}
+
+	left := replicaWith(t, jack, anne)
+	right := replicaWith(t, anne, bob)
+	expected := &DiffResult{
+		OnlyLeft:  []string{"user:jack member group:boss"},
+		OnlyRight: []string{"user:bob viewer doc:budget"},
+		Common:    []string{"user:anne owner doc:budget"},
+	}
+
+	check := func(t *testing.T, left, right string) {
+		result, err := Diff(left, right)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected.Left, expected.Right = left, right
+		if !reflect.DeepEqual(result, expected) {
+			t.Errorf("Expected %+v, got %+v", expected, result)
+		}
+		writes, deletes := result.Plan()
+		if !reflect.DeepEqual(writes, expected.OnlyLeft) || !reflect.DeepEqual(deletes, expected.OnlyRight) {
+			t.Errorf("Plan must write only-left and delete only-right, got %v %v", writes, deletes)
+		}
+	}
+
+	t.Run("Two replicas", func(t *testing.T) {
+		check(t, left, right)
+	})
+
+	t.Run("Replica against text export", func(t *testing.T) {
+		export := filepath.Join(t.TempDir(), "tuples.txt")
+		content := "# exported\nuser:anne  owner doc:budget\n\nuser:bob viewer doc:budget\n"
+		if err := os.WriteFile(export, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		check(t, left, export)
+	})
+
+	t.Run("Replica against json export", func(t *testing.T) {
+		export := filepath.Join(t.TempDir(), "tuples.json")
+		content := `{"tuples": [{"user": "user:anne", "relation": "owner", "object": "doc:budget"},
+			{"user": "user:bob", "relation": "viewer", "object": "doc:budget"}]}`
+		if err := os.WriteFile(export, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		check(t, left, export)
+	})
+
+	t.Run("Malformed export", func(t *testing.T) {
+		export := filepath.Join(t.TempDir(), "tuples.txt")
+		if err := os.WriteFile(export, []byte("user:anne owner\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Diff(left, export); err == nil {
+			t.Error("Expected an error for a line without object")
+		}
+	})
+}
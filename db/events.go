@@ -0,0 +1,71 @@
+package db
+
+import (
+	"github.com/jmoiron/sqlx"
+	"time"
+)
+
+// syncEventLimit caps how many events GetSyncEvents returns
+const syncEventLimit = 100
+
+const (
+	// TokenRejected is recorded when the server refuses a continuation token
+	TokenRejected = "token_rejected"
+	// TokenReset is recorded when the tokens of a store are dropped for the sync to start over
+	TokenReset = "token_reset"
+)
+
+// SyncEvent is something that happened to the sync of a store and needed the user
+type SyncEvent struct {
+	Id                int       `db:"id"`
+	Timestamp         time.Time `db:"timestamp"`
+	ApiUrl            string    `db:"api_url"`
+	StoreId           string    `db:"store_id"`
+	Type              string    `db:"type"`
+	Event             string    `db:"event"`
+	ContinuationToken string    `db:"continuation_token"`
+	Reason            string    `db:"reason"`
+}
+
+func (r *SqlxRepository) RecordSyncEvent(event SyncEvent) error {
+	_, err := r._db.NamedExec(`insert into sync_events (
+                       timestamp,
+                       api_url,
+                       store_id,
+                       type,
+                       event,
+                       continuation_token,
+                       reason) values (:timestamp,
+                                       :api_url,
+                                       :store_id,
+                                       :type,
+                                       :event,
+                                       :continuation_token,
+                                       :reason)`, &event)
+	return err
+}
+
+// GetSyncEvents lists the latest events of a store, newest first
+func (r *SqlxRepository) GetSyncEvents(storeId string) ([]SyncEvent, error) {
+	var events []SyncEvent
+	err := r._db.Select(&events, r._db.Rebind(`select * from sync_events where store_id = ? order by id desc limit ?`), storeId, syncEventLimit)
+	return events, err
+}
+
+// ResetContinuationTokens drops the sync positions of types in a store, their next sync starts over. types has
+// an empty type when every type is synced at once
+func (r *SqlxRepository) ResetContinuationTokens(storeId string, types []string) error {
+	query, args, err := sqlx.In(`delete from connections where store_id = ? and type in (?)`, storeId, types)
+	if err != nil {
+		return err
+	}
+	_, err = r._db.Exec(r._db.Rebind(query), args...)
+	return err
+}
+
+// MoveConnections points the sync positions of a store to apiUrl, for a replica synced through another url of
+// the same server
+func (r *SqlxRepository) MoveConnections(storeId, apiUrl string) error {
+	_, err := r._db.Exec(r._db.Rebind(`update connections set api_url = ? where store_id = ?`), apiUrl, storeId)
+	return err
+}
@@ -0,0 +1,62 @@
+package db
+
+import (
+	"fmt"
+	openfga "github.com/openfga/go-sdk"
+	"time"
+)
+
+// historyLimit caps how many changes a history page shows
+const historyLimit = 1000
+
+// EnableHistory turns on recording of tuple changes. Only changes applied from now on are kept,
+// so points in time before that can't be reconstructed
+func (r *SqlxRepository) EnableHistory(enabled bool) {
+	r.keepHistory = enabled
+}
+
+// TupleChange is one write or delete as received from the changes endpoint
+type TupleChange struct {
+	Id         int       `db:"id"`
+	TupleKey   string    `db:"tuple_key"`
+	UserType   string    `db:"user_type"`
+	UserId     string    `db:"user_id"`
+	Relation   string    `db:"relation"`
+	ObjectType string    `db:"object_type"`
+	ObjectId   string    `db:"object_id"`
+	Operation  string    `db:"operation"`
+	Timestamp  time.Time `db:"timestamp"`
+}
+
+func operationCode(operation openfga.TupleOperation) string {
+	if operation == openfga.DELETE {
+		return "D"
+	}
+	return "W"
+}
+
+func (r *SqlxRepository) getChanges(where string, args ...interface{}) ([]TupleChange, error) {
+	var changes []TupleChange
+	err := r._db.Select(&changes, r._db.Rebind(`select * from tuple_changes where `+where+` order by id desc limit ?`),
+		append(args, historyLimit)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load history: %w", err)
+	}
+	return changes, nil
+}
+
+// HistoryRepository reads the changes recorded while history is enabled
+type HistoryRepository interface {
+	GetTupleHistory(tupleKey string) ([]TupleChange, error)
+	GetObjectHistory(objectType, objectId string) ([]TupleChange, error)
+}
+
+// GetTupleHistory lists every change recorded for a tuple, newest first
+func (r *SqlxRepository) GetTupleHistory(tupleKey string) ([]TupleChange, error) {
+	return r.getChanges("tuple_key = ?", tupleKey)
+}
+
+// GetObjectHistory lists every change recorded for any tuple of an object, newest first
+func (r *SqlxRepository) GetObjectHistory(objectType, objectId string) ([]TupleChange, error) {
+	return r.getChanges("object_type = ? and object_id = ?", objectType, objectId)
+}
@@ -0,0 +1,182 @@
+package db
+
+import (
+	"embed"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed migrations/*.sql migrations/postgres/*.sql
+var migrationFiles embed.FS
+
+// migrationDirs has the migrations of each driver, they are versioned apart
+var migrationDirs = map[string]string{"sqlite3": "migrations", "postgres": "migrations/postgres"}
+
+// migrationLockKey keeps two members of a team from migrating a shared replica at once
+const migrationLockKey = 0x66676d6d6967
+
+// migration is one versioned up-migration. Files are named NNNN_description.sql
+type migration struct {
+	version int
+	name    string
+	sql     string
+}
+
+func loadMigrations(dir string) ([]migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, err
+	}
+	var migrations []migration
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		name := entry.Name()
+		prefix, _, found := strings.Cut(name, "_")
+		if !found || !strings.HasSuffix(name, ".sql") {
+			return nil, fmt.Errorf("migration %v is not named NNNN_description.sql", name)
+		}
+		version, err := strconv.Atoi(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("migration %v has no numeric version: %w", name, err)
+		}
+		content, err := migrationFiles.ReadFile(path.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, migration{
+			version: version,
+			name:    strings.TrimSuffix(name, ".sql"),
+			sql:     string(content),
+		})
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].version < migrations[j].version
+	})
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].version == migrations[i-1].version {
+			return nil, fmt.Errorf("duplicated migration version %v", migrations[i].version)
+		}
+	}
+	return migrations, nil
+}
+
+func schemaVersion(db *sqlx.DB) (int, error) {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_version (
+		    version integer not null primary key,
+		    name text not null,
+		    applied_at timestamp not null
+		)`)
+	if err != nil {
+		return 0, err
+	}
+	var version int
+	err = db.Get(&version, "select coalesce(max(version), 0) from schema_version")
+	return version, err
+}
+
+// hasTables tells whether the database was already used, so it is worth a backup
+func hasTables(db *sqlx.DB) (bool, error) {
+	var count int
+	err := db.Get(&count, "select count(*) from sqlite_master where type = 'table' and name != 'schema_version'")
+	return count > 0, err
+}
+
+// backup writes a consistent copy of the database next to it before it gets migrated
+func backup(db *sqlx.DB, dataSource string, version int) (string, error) {
+	backupPath := fmt.Sprintf("%v.v%v-%v.bak", dataSource, version, time.Now().Format("20060102T150405"))
+	if _, err := db.Exec("VACUUM INTO ?", backupPath); err != nil {
+		return "", err
+	}
+	return backupPath, nil
+}
+
+func isFile(dataSource string) bool {
+	info, err := os.Stat(dataSource)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// migrate brings the database to the latest embedded schema version of its driver.
+// Existing file databases are backed up first.
+func migrate(db *sqlx.DB, dataSource string) error {
+	migrations, err := loadMigrations(migrationDirs[db.DriverName()])
+	if err != nil {
+		return err
+	}
+	current, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+
+	var pending []migration
+	for _, m := range migrations {
+		if m.version > current {
+			pending = append(pending, m)
+		}
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	// shared replicas are backed up by their server
+	if isFile(dataSource) {
+		used, err := hasTables(db)
+		if err != nil {
+			return err
+		}
+		if used {
+			backupPath, err := backup(db, dataSource, current)
+			if err != nil {
+				return fmt.Errorf("unable to backup before migrating: %w", err)
+			}
+			slog.Info("Database backed up", "replica", dataSource, "backup", backupPath)
+		}
+	}
+
+	for _, m := range pending {
+		tx, err := db.Beginx()
+		if err != nil {
+			return err
+		}
+		if db.DriverName() == "postgres" {
+			// another member of the team may have migrated it meanwhile
+			var applied int
+			if _, err := tx.Exec("select pg_advisory_xact_lock($1)", migrationLockKey); err != nil {
+				_ = tx.Rollback()
+				return err
+			}
+			if err := tx.Get(&applied, "select coalesce(max(version), 0) from schema_version"); err != nil || applied >= m.version {
+				_ = tx.Rollback()
+				if err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		slog.Info("Applying migration", "replica", RedactDataSource(dataSource), "migration", m.name)
+		if _, err := tx.Exec(m.sql); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("migration %v failed: %w", m.name, err)
+		}
+		if _, err := tx.Exec(tx.Rebind("insert into schema_version (version, name, applied_at) values (?, ?, ?)"),
+			m.version, m.name, time.Now()); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	slog.Info("Schema migrated", "replica", RedactDataSource(dataSource), "from", current, "to", pending[len(pending)-1].version)
+	return nil
+}
@@ -0,0 +1,96 @@
+package db
+
+import (
+	"github.com/jmoiron/sqlx"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func baselineFixture(t *testing.T) string {
+	t.Helper()
+	fixture, err := os.ReadFile(filepath.Join("testdata", "baseline.sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataSource := filepath.Join(t.TempDir(), "fga.db")
+	baseline := sqlx.MustOpen("sqlite3", dataSource)
+	baseline.MustExec(string(fixture))
+	if err := baseline.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return dataSource
+}
+
+func backups(t *testing.T, dataSource string) []string {
+	t.Helper()
+	matches, err := filepath.Glob(dataSource + ".v*.bak")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return matches
+}
+
+func TestMigrate(t *testing.T) {
+	migrations, err := loadMigrations(migrationDirs["sqlite3"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	latest := migrations[len(migrations)-1].version
+
+	t.Run("Migrations are ordered and start at 1", func(t *testing.T) {
+		for i, m := range migrations {
+			if m.version != i+1 {
+				t.Errorf("Expected version %v at position %v, got %v", i+1, i, m.version)
+			}
+		}
+	})
+
+	t.Run("Baseline replica is migrated and backed up", func(t *testing.T) {
+		dataSource := baselineFixture(t)
+
+		repo := mustOpen(t, dataSource)
+		defer repo.Close()
+
+		if v, err := schemaVersion(repo._db); err != nil || v != latest {
+			t.Errorf("Expected version %v, got %v (%v)", latest, v, err)
+		}
+		if c, _ := repo.CountTuples(nil); c != 2 {
+			t.Errorf("Existing tuples must be kept, got %v", c)
+		}
+		if token := repo.GetContinuationToken("http://localhost:8087", "STOREID", ""); token == nil || *token != "TOKEN" {
+			t.Errorf("Existing continuation token must be kept, got %v", token)
+		}
+		if b := backups(t, dataSource); len(b) != 1 {
+			t.Errorf("Expected one backup, got %v", b)
+		}
+		if err := repo.ClaimReplica("OTHER"); err == nil {
+			t.Error("The replica must hold the store it was synced from")
+		}
+	})
+
+	t.Run("Up to date replica is left alone", func(t *testing.T) {
+		dataSource := baselineFixture(t)
+		mustOpen(t, dataSource).Close()
+
+		repo := mustOpen(t, dataSource)
+		defer repo.Close()
+
+		if b := backups(t, dataSource); len(b) != 1 {
+			t.Errorf("No backup expected when nothing is migrated, got %v", b)
+		}
+	})
+
+	t.Run("New replica is not backed up", func(t *testing.T) {
+		dataSource := filepath.Join(t.TempDir(), "fga.db")
+		repo := mustOpen(t, dataSource)
+		defer repo.Close()
+
+		if b := backups(t, dataSource); len(b) != 0 {
+			t.Errorf("No backup expected for a new replica, got %v", b)
+		}
+		if v, _ := schemaVersion(repo._db); v != latest {
+			t.Errorf("Expected version %v, got %v", latest, v)
+		}
+	})
+}
@@ -0,0 +1,22 @@
+-- schema as it was before migrations existed, safe to rerun on old replicas
+CREATE TABLE IF NOT EXISTS tuples(
+    tuple_key text not null primary key,
+    user_type text not null,
+    user_id text not null,
+    relation text not null,
+    object_type text not null,
+    object_id text not null,
+    timestamp timestamp);
+
+CREATE INDEX IF NOT EXISTS idx_tuple_content on tuples(user_type, user_id, relation, object_id, object_type);
+
+CREATE TABLE IF NOT EXISTS pending_actions (
+    tuple_key text not null primary key,
+    action text not null);
+
+CREATE TABLE IF NOT EXISTS connections (
+    api_url text not null,
+    store_id text not null primary key,
+    continuation_token text,
+    last_sync timestamp
+);
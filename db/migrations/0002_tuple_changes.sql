@@ -0,0 +1,15 @@
+-- every change applied from the changes endpoint, only filled when history is enabled
+CREATE TABLE tuple_changes (
+    id integer primary key autoincrement,
+    tuple_key text not null,
+    user_type text not null,
+    user_id text not null,
+    relation text not null,
+    object_type text not null,
+    object_id text not null,
+    operation text not null,
+    timestamp timestamp not null);
+
+CREATE INDEX idx_tuple_changes_key on tuple_changes(tuple_key, timestamp);
+CREATE INDEX idx_tuple_changes_object on tuple_changes(object_type, object_id, timestamp);
+CREATE INDEX idx_tuple_changes_timestamp on tuple_changes(timestamp);
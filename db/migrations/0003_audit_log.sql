@@ -0,0 +1,24 @@
+-- every write and delete fgamanager sent to the store, rows can't be changed or removed
+CREATE TABLE audit_log (
+    id integer primary key autoincrement,
+    timestamp timestamp not null,
+    operator text not null,
+    profile text not null,
+    api_url text not null,
+    store_id text not null,
+    operation text not null,
+    tuple_keys text not null,
+    status_code integer not null,
+    response text not null);
+
+CREATE INDEX idx_audit_log_timestamp on audit_log(timestamp);
+
+CREATE TRIGGER audit_log_no_update BEFORE UPDATE ON audit_log
+BEGIN
+    SELECT RAISE(ABORT, 'audit_log is append only');
+END;
+
+CREATE TRIGGER audit_log_no_delete BEFORE DELETE ON audit_log
+BEGIN
+    SELECT RAISE(ABORT, 'audit_log is append only');
+END;
@@ -0,0 +1,15 @@
+-- a store keeps a continuation token per replicated object type, type is '' when every type is replicated
+CREATE TABLE connections_by_type (
+    api_url text not null,
+    store_id text not null,
+    type text not null default '',
+    continuation_token text,
+    last_sync timestamp,
+    primary key (store_id, type));
+
+INSERT INTO connections_by_type (api_url, store_id, continuation_token, last_sync)
+    SELECT api_url, store_id, continuation_token, last_sync FROM connections;
+
+DROP TABLE connections;
+
+ALTER TABLE connections_by_type RENAME TO connections;
@@ -0,0 +1,12 @@
+-- sync events that need the user, like a continuation token rejected by the server, and what was done about them
+CREATE TABLE sync_events (
+    id integer primary key autoincrement,
+    timestamp timestamp not null,
+    api_url text not null,
+    store_id text not null,
+    type text not null,
+    event text not null,
+    continuation_token text,
+    reason text not null);
+
+CREATE INDEX idx_sync_events_store on sync_events(store_id, id);
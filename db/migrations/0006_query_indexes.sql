@@ -0,0 +1,6 @@
+-- indexes for the queries the UI and the sync run all the time: the type and relation dropdowns and filters,
+-- the tuple table ordered by timestamp and the pending deletions and prunes
+CREATE INDEX idx_tuples_relation on tuples(relation);
+CREATE INDEX idx_tuples_object_type on tuples(object_type, relation);
+CREATE INDEX idx_tuples_timestamp on tuples(timestamp desc, tuple_key);
+CREATE INDEX idx_pending_actions_action on pending_actions(action);
@@ -0,0 +1,11 @@
+-- how many tuples there are of every user type, relation and object type, kept up to date as changes are applied
+-- so the totals and the dropdowns don't scan the tuples. The counts of any other grouping add these up
+CREATE TABLE tuple_counts (
+    user_type text not null,
+    relation text not null,
+    object_type text not null,
+    count integer not null,
+    primary key (user_type, relation, object_type));
+
+INSERT INTO tuple_counts (user_type, relation, object_type, count)
+    select user_type, relation, object_type, count(*) from tuples group by user_type, relation, object_type;
@@ -0,0 +1,5 @@
+-- how many writes and deletes the sync applied every minute, for the rates of the dashboard. Only the last day is kept
+CREATE TABLE sync_activity (
+    minute timestamp not null primary key,
+    writes integer not null,
+    deletes integer not null);
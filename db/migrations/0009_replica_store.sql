@@ -0,0 +1,8 @@
+-- the store a replica holds, recorded when it's first opened for one so two stores never share a replica.
+-- Replicas already synced hold the store of their sync positions
+CREATE TABLE replica_store (
+    id integer not null primary key check (id = 1),
+    store_id text not null);
+
+INSERT INTO replica_store (id, store_id)
+SELECT 1, min(store_id) FROM connections HAVING count(distinct store_id) = 1;
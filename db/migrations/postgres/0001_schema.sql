@@ -0,0 +1,75 @@
+-- the schema of SQLite replicas as of 0005, for replicas shared by a team
+CREATE TABLE tuples (
+    tuple_key text not null primary key,
+    user_type text not null,
+    user_id text not null,
+    relation text not null,
+    object_type text not null,
+    object_id text not null,
+    timestamp timestamptz);
+
+CREATE INDEX idx_tuple_content on tuples(user_type, user_id, relation, object_id, object_type);
+
+CREATE TABLE pending_actions (
+    tuple_key text not null primary key,
+    action text not null);
+
+CREATE TABLE connections (
+    api_url text not null,
+    store_id text not null,
+    type text not null default '',
+    continuation_token text,
+    last_sync timestamptz,
+    primary key (store_id, type));
+
+-- every change applied from the changes endpoint, only filled when the syncer keeps history
+CREATE TABLE tuple_changes (
+    id bigserial primary key,
+    tuple_key text not null,
+    user_type text not null,
+    user_id text not null,
+    relation text not null,
+    object_type text not null,
+    object_id text not null,
+    operation text not null,
+    timestamp timestamptz not null);
+
+CREATE INDEX idx_tuple_changes_key on tuple_changes(tuple_key, timestamp);
+CREATE INDEX idx_tuple_changes_object on tuple_changes(object_type, object_id, timestamp);
+CREATE INDEX idx_tuple_changes_timestamp on tuple_changes(timestamp);
+
+-- every write and delete sent by any member of the team, rows can't be changed or removed
+CREATE TABLE audit_log (
+    id bigserial primary key,
+    timestamp timestamptz not null,
+    operator text not null,
+    profile text not null,
+    api_url text not null,
+    store_id text not null,
+    operation text not null,
+    tuple_keys text not null,
+    status_code integer not null,
+    response text not null);
+
+CREATE INDEX idx_audit_log_timestamp on audit_log(timestamp);
+
+CREATE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_log is append only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_log_no_update BEFORE UPDATE OR DELETE ON audit_log
+    FOR EACH ROW EXECUTE FUNCTION audit_log_append_only();
+
+CREATE TABLE sync_events (
+    id bigserial primary key,
+    timestamp timestamptz not null,
+    api_url text not null,
+    store_id text not null,
+    type text not null,
+    event text not null,
+    continuation_token text,
+    reason text not null);
+
+CREATE INDEX idx_sync_events_store on sync_events(store_id, id);
@@ -0,0 +1,3 @@
+-- who marked a tuple for deletion, every instance sends the deletions of its own operator and profile.
+-- Marks older than the column have no owner and are sent by anyone
+ALTER TABLE pending_actions ADD COLUMN owner text not null default '';
@@ -0,0 +1,88 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	_ "github.com/lib/pq"
+	"hash/fnv"
+	"net/url"
+	"strings"
+)
+
+// IsShared tells a PostgreSQL DSN, for a replica shared by a team, from the path of a SQLite replica
+func IsShared(dataSource string) bool {
+	return strings.HasPrefix(dataSource, "postgres://") || strings.HasPrefix(dataSource, "postgresql://")
+}
+
+// RedactDataSource hides the password of a DSN, for logs and messages
+func RedactDataSource(dataSource string) string {
+	if !IsShared(dataSource) {
+		return dataSource
+	}
+	u, err := url.Parse(dataSource)
+	if err != nil {
+		return "postgres://..."
+	}
+	return u.Redacted()
+}
+
+func driverOf(dataSource string) string {
+	if IsShared(dataSource) {
+		return "postgres"
+	}
+	return "sqlite3"
+}
+
+// syncLockKey is the advisory lock held by the syncer of a store in a shared replica
+func syncLockKey(apiUrl, storeId string) int64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(apiUrl + " " + storeId))
+	return int64(h.Sum64())
+}
+
+// ElectSyncer tells whether this instance syncs the store. A SQLite replica has a single user who always does.
+// In a shared replica only the instance holding the advisory lock of the store does, until it closes the replica
+// or loses its connection. Call it again to keep checking
+func (r *SqlxRepository) ElectSyncer(ctx context.Context, apiUrl, storeId string) (bool, error) {
+	if r._db.DriverName() != "postgres" {
+		return true, nil
+	}
+	key := syncLockKey(apiUrl, storeId)
+	r.syncLock.Lock()
+	defer r.syncLock.Unlock()
+	if held, found := r.syncConns[key]; found {
+		// the lock goes with the session of the connection
+		if err := held.PingContext(ctx); err == nil {
+			return true, nil
+		}
+		_ = held.Close()
+		delete(r.syncConns, key)
+	}
+	conn, err := r._db.Conn(ctx)
+	if err != nil {
+		return false, err
+	}
+	var elected bool
+	err = conn.QueryRowContext(ctx, "select pg_try_advisory_lock($1)", key).Scan(&elected)
+	if err != nil || !elected {
+		_ = conn.Close()
+		return false, err
+	}
+	// kept out of the pool while it holds the lock
+	if r.syncConns == nil {
+		r.syncConns = map[int64]*sql.Conn{}
+	}
+	r.syncConns[key] = conn
+	return true, nil
+}
+
+// resign gives up the sync of a shared replica for another instance to be elected
+func (r *SqlxRepository) resign() {
+	r.syncLock.Lock()
+	defer r.syncLock.Unlock()
+	for key, conn := range r.syncConns {
+		_, _ = conn.ExecContext(context.Background(), "select pg_advisory_unlock_all()")
+		_ = conn.Close()
+		delete(r.syncConns, key)
+	}
+}
@@ -0,0 +1,61 @@
+package db
+
+import "strings"
+
+const (
+	// pageSize is how many rows past the offset Load returns
+	pageSize = 200
+	// minSearchLength avoids full scans for searches like "%a%"
+	minSearchLength = 4
+)
+
+// tupleQuery is a Filter compiled to SQL. It is shared by Load and countTuples so
+// the rows we count are always the rows we page through.
+type tupleQuery struct {
+	// from is the tuples table or, for point in time queries, a subquery aliased as tuples
+	from string
+	// where is either empty or a complete " where ..." clause over from
+	where  string
+	params map[string]interface{}
+}
+
+// asOfSource rebuilds the tuples table from the last change of each tuple up to :asOf
+const asOfSource = `(select tuple_key, user_type, user_id, relation, object_type, object_id, timestamp
+		from (select *, row_number() over (partition by tuple_key order by id desc) as change_number
+		        from tuple_changes where timestamp <= :asOf) changes
+		where change_number = 1 and operation = 'W') tuples`
+
+func compileFilter(filter *Filter) tupleQuery {
+	query := tupleQuery{from: "tuples", params: map[string]interface{}{}}
+	if filter == nil || !filter.isSet() {
+		return query
+	}
+
+	if filter.AsOf != nil {
+		query.from = asOfSource
+		query.params["asOf"] = filter.AsOf.UTC()
+	}
+
+	var clauses []string
+	if filter.hasSearch() {
+		// like ignores case in SQLite only
+		clauses = append(clauses, "lower(tuples.tuple_key) like lower(:query)")
+		query.params["query"] = *filter.Search
+	}
+	if filter.UserType != nil {
+		clauses = append(clauses, "tuples.user_type = :userType")
+		query.params["userType"] = *filter.UserType
+	}
+	if filter.Relation != nil {
+		clauses = append(clauses, "tuples.relation = :relation")
+		query.params["relation"] = *filter.Relation
+	}
+	if filter.ObjectType != nil {
+		clauses = append(clauses, "tuples.object_type = :objectType")
+		query.params["objectType"] = *filter.ObjectType
+	}
+	if len(clauses) > 0 {
+		query.where = " where " + strings.Join(clauses, " and ")
+	}
+	return query
+}
@@ -0,0 +1,209 @@
+package db
+
+import (
+	"crypto/rand"
+	"fmt"
+	openfga "github.com/openfga/go-sdk"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// snapshotTable prefixes the tables holding the tuples read from the server apart from the replica tuples.
+	// Every snapshot has a table of its own, so verifies and resyncs of the same replica don't drop each other's
+	snapshotTable = "tuples_snapshot"
+	// snapshotLeftoverAge is how long after it started a snapshot table is taken for the leftover of an
+	// interrupted snapshot
+	snapshotLeftoverAge = 24 * time.Hour
+	// snapshotLockKey keeps two instances from replacing the tuples of a shared replica at once
+	snapshotLockKey = 0x66676d736e6170
+)
+
+// tuplesTableName matches the name in the create statement of the tuples table
+var tuplesTableName = regexp.MustCompile(`(?i)^create table (if not exists )?"?tuples"?`)
+
+// RepairRepository compares and rebuilds a replica from the tuples the Read endpoint returns
+type RepairRepository interface {
+	NewSnapshot() (Snapshot, error)
+	SampleTuples(n int) ([]string, error)
+	MissingTuples(keys []string) ([]string, error)
+	CheckCounts() ([]CountDrift, error)
+	RebuildCounts() error
+}
+
+// Snapshot holds the tuples read from the server apart from the replica tuples
+type Snapshot interface {
+	Add(tuples []openfga.Tuple) error
+	Compare() (*DiffResult, error)
+	Replace(connections []Connection) error
+	Drop() error
+}
+
+// TupleSnapshot is a copy of the tuples of a store, as the Read endpoint returns them, loaded next to the
+// replica tuples to compare with them or to replace them
+type TupleSnapshot struct {
+	repo *SqlxRepository
+	// table is named after when the snapshot started, with a random suffix
+	table string
+}
+
+// NewSnapshot creates an empty snapshot table shaped like the tuples table, dropping the leftovers of
+// snapshots interrupted long ago
+func (r *SqlxRepository) NewSnapshot() (Snapshot, error) {
+	started := time.Now()
+	if err := r.dropLeftoverSnapshots(started); err != nil {
+		return nil, err
+	}
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return nil, err
+	}
+	table := fmt.Sprintf("%v_%d_%x", snapshotTable, started.Unix(), suffix)
+	if r._db.DriverName() == "postgres" {
+		if _, err := r._db.Exec("create table " + table + " (like tuples including defaults)"); err != nil {
+			return nil, err
+		}
+		return &TupleSnapshot{repo: r, table: table}, nil
+	}
+	var create string
+	if err := r._db.Get(&create, `select sql from sqlite_master where type = 'table' and name = 'tuples'`); err != nil {
+		return nil, err
+	}
+	if !tuplesTableName.MatchString(create) {
+		return nil, fmt.Errorf("unexpected tuples table %v", create)
+	}
+	if _, err := r._db.Exec(tuplesTableName.ReplaceAllString(create, "CREATE TABLE "+table)); err != nil {
+		return nil, err
+	}
+	return &TupleSnapshot{repo: r, table: table}, nil
+}
+
+// dropLeftoverSnapshots drops the snapshot tables started snapshotLeftoverAge before now, and the ones named
+// before they had a start
+func (r *SqlxRepository) dropLeftoverSnapshots(now time.Time) error {
+	query := `select name from sqlite_master where type = 'table' and name like 'tuples\_snapshot%' escape '\'`
+	if r._db.DriverName() == "postgres" {
+		query = `select table_name from information_schema.tables where table_schema = current_schema()
+			and table_name like 'tuples\_snapshot%' escape '\'`
+	}
+	var tables []string
+	if err := r._db.Select(&tables, query); err != nil {
+		return err
+	}
+	for _, table := range tables {
+		parts := strings.Split(strings.TrimPrefix(table, snapshotTable+"_"), "_")
+		if started, err := strconv.ParseInt(parts[0], 10, 64); err == nil && len(parts) == 2 &&
+			now.Sub(time.Unix(started, 0)) < snapshotLeftoverAge {
+			continue
+		}
+		if _, err := r._db.Exec("drop table if exists " + table); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Add loads a page of tuples in a single transaction
+func (s *TupleSnapshot) Add(tuples []openfga.Tuple) error {
+	return s.repo.Transact(func(tx *Tx) error {
+		for _, tuple := range tuples {
+			key := tuple.Key
+			userType, userId := splitTypePair(key.User)
+			objectType, objectId := splitTypePair(key.Object)
+			_, err := tx.exec(`insert into `+s.table+` (tuple_key, user_type, user_id, relation, object_type, object_id, timestamp)
+				values (?, ?, ?, ?, ?, ?, ?) on conflict do nothing`,
+				key.User+" "+key.Relation+" "+key.Object, userType, userId, key.Relation, objectType, objectId, tuple.Timestamp)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Compare lists the tuples of the snapshot missing from the replica, as OnlyLeft, and the tuples of the
+// replica missing from the snapshot, as OnlyRight. Common is left empty
+func (s *TupleSnapshot) Compare() (*DiffResult, error) {
+	result := &DiffResult{Left: "server", Right: "replica"}
+	queries := map[*[]string]string{
+		&result.OnlyLeft:  "select tuple_key from " + s.table + " except select tuple_key from tuples order by 1",
+		&result.OnlyRight: "select tuple_key from tuples except select tuple_key from " + s.table + " order by 1",
+	}
+	for dest, query := range queries {
+		if err := s.repo._db.Select(dest, query); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// Replace swaps the replica tuples for the snapshot and saves the sync positions the changes continue
+// from, in a single transaction. Pending actions are dropped, as they were about the old tuples.
+// SQLite renames the snapshot keeping the indexes and triggers of the tuples table, shared replicas are
+// copied into it as others keep reading them
+func (s *TupleSnapshot) Replace(connections []Connection) error {
+	return s.repo.Transact(func(tx *Tx) error {
+		var statements []string
+		if s.repo._db.DriverName() == "postgres" {
+			statements = []string{
+				fmt.Sprintf("select pg_advisory_xact_lock(%d)", snapshotLockKey),
+				"delete from tuples",
+				"insert into tuples select * from " + s.table,
+				"drop table " + s.table,
+			}
+		} else {
+			var dependents []string
+			err := tx.tx.Select(&dependents, `select sql from sqlite_master where tbl_name = 'tuples' and type in ('index', 'trigger')
+				and sql is not null order by type`)
+			if err != nil {
+				return err
+			}
+			statements = append([]string{
+				"drop table tuples",
+				"alter table " + s.table + " rename to tuples",
+			}, dependents...)
+		}
+		statements = append(append(statements, "delete from pending_actions"), rebuildCountsSql...)
+		for _, statement := range statements {
+			if _, err := tx.tx.Exec(statement); err != nil {
+				return err
+			}
+		}
+		for _, connection := range connections {
+			if err := tx.UpsertConnection(connection); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Drop removes the snapshot table
+func (s *TupleSnapshot) Drop() error {
+	_, err := s.repo._db.Exec("drop table if exists " + s.table)
+	return err
+}
+
+// SampleTuples picks up to n random tuple keys of the replica
+func (r *SqlxRepository) SampleTuples(n int) ([]string, error) {
+	var keys []string
+	err := r._db.Select(&keys, r._db.Rebind("select tuple_key from tuples order by random() limit ?"), n)
+	return keys, err
+}
+
+// MissingTuples returns the keys not in the replica
+func (r *SqlxRepository) MissingTuples(keys []string) ([]string, error) {
+	var missing []string
+	for _, key := range keys {
+		var found int
+		if err := r._db.Get(&found, r._db.Rebind("select count(*) from tuples where tuple_key = ?"), key); err != nil {
+			return nil, err
+		}
+		if found == 0 {
+			missing = append(missing, key)
+		}
+	}
+	return missing, nil
+}
@@ -0,0 +1,100 @@
+package db
+
+import (
+	"fmt"
+	openfga "github.com/openfga/go-sdk"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSnapshot(t *testing.T) {
+	repo := mustOpen(t, ":memory:")
+	defer repo.Close()
+
+	tuple := func(user string) openfga.Tuple {
+		return openfga.Tuple{Key: *openfga.NewTupleKey(user, "viewer", "document:1"), Timestamp: time.Now()}
+	}
+	repo.ApplyChange(openfga.TupleChange{TupleKey: tuple("user:jack").Key, Operation: openfga.WRITE, Timestamp: time.Now()})
+	repo.ApplyChange(openfga.TupleChange{TupleKey: tuple("user:joe").Key, Operation: openfga.WRITE, Timestamp: time.Now()})
+	repo.MarkDeletion("user:jack viewer document:1", "jack@test")
+
+	snapshot, err := repo.NewSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := snapshot.Add([]openfga.Tuple{tuple("user:jack"), tuple("user:jill")}); err != nil {
+		t.Fatal(err)
+	}
+
+	diff, err := snapshot.Compare()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(diff.OnlyLeft, []string{"user:jill viewer document:1"}) || !reflect.DeepEqual(diff.OnlyRight, []string{"user:joe viewer document:1"}) {
+		t.Errorf("Unexpected comparison %+v", diff)
+	}
+
+	var indexes []string
+	schema := `select name from sqlite_master where tbl_name = 'tuples' and type = 'index' and sql is not null order by 1`
+	_ = repo._db.Select(&indexes, schema)
+	err = snapshot.Replace([]Connection{{ApiUrl: "http://localhost:8087", StoreId: "01HME1", ContinuationToken: "TOKEN"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, _ := repo.CountTuples(nil); c != 2 {
+		t.Errorf("Expected the 2 snapshot tuples, got %v", c)
+	}
+	if missing, _ := repo.MissingTuples([]string{"user:jill viewer document:1", "user:joe viewer document:1"}); !reflect.DeepEqual(missing, []string{"user:joe viewer document:1"}) {
+		t.Errorf("Unexpected missing tuples %v", missing)
+	}
+	if marked, _ := repo.GetMarkedForDeletion("jack@test"); len(marked) != 0 {
+		t.Errorf("Pending actions must be dropped, got %v", marked)
+	}
+	if token := repo.GetContinuationToken("http://localhost:8087", "01HME1", ""); token == nil || *token != "TOKEN" {
+		t.Errorf("Expected the token to be saved, got %v", token)
+	}
+	var replaced []string
+	_ = repo._db.Select(&replaced, schema)
+	if len(indexes) == 0 || !reflect.DeepEqual(indexes, replaced) {
+		t.Errorf("Indexes must be kept, had %v, got %v", indexes, replaced)
+	}
+
+	t.Run("Snapshots at once keep tables of their own", func(t *testing.T) {
+		repo := mustOpen(t, filepath.Join(t.TempDir(), "fga.db"))
+		defer repo.Close()
+		repo.ApplyChange(openfga.TupleChange{TupleKey: tuple("user:jack").Key, Operation: openfga.WRITE, Timestamp: time.Now()})
+		long := time.Now().Add(-2 * snapshotLeftoverAge).Unix()
+		for _, leftover := range []string{snapshotTable, fmt.Sprintf("%v_%d_00000000", snapshotTable, long)} {
+			repo._db.MustExec("create table " + leftover + " (tuple_key text)")
+		}
+
+		verifying, err := repo.NewSnapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		resyncing, err := repo.NewSnapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := verifying.Add([]openfga.Tuple{tuple("user:jack")}); err != nil {
+			t.Fatal(err)
+		}
+		if err := resyncing.Add([]openfga.Tuple{tuple("user:jill")}); err != nil {
+			t.Fatal(err)
+		}
+		if err := resyncing.Replace(nil); err != nil {
+			t.Fatal(err)
+		}
+		if diff, err := verifying.Compare(); err != nil || !reflect.DeepEqual(diff.OnlyLeft, []string{"user:jack viewer document:1"}) {
+			t.Errorf("The verify must keep its snapshot while the resync replaces, got %+v (%v)", diff, err)
+		}
+		_ = verifying.Drop()
+		var tables []string
+		_ = repo._db.Select(&tables, "select name from sqlite_master where type = 'table' and name like 'tuples_snapshot%'")
+		if len(tables) != 0 {
+			t.Errorf("Leftovers of interrupted snapshots must be dropped, got %v", tables)
+		}
+	})
+}
@@ -0,0 +1,96 @@
+package db
+
+import (
+	"fmt"
+	"time"
+)
+
+// activityRetention is how long the changes applied per minute are kept
+const activityRetention = 24 * time.Hour
+
+// StatsRepository tells the shape of a replica and how fast its sync goes
+type StatsRepository interface {
+	GetTupleCounts() ([]TupleCount, error)
+	GetTopObjects(limit int) ([]ValueCount, error)
+	GetTopUsers(limit int) ([]ValueCount, error)
+	GetSyncActivity(since time.Time) ([]SyncActivity, error)
+	GetConnections(apiUrl, storeId string) ([]Connection, error)
+	CountPendingActions() (map[string]int, error)
+}
+
+// ValueCount is how many tuples there are of an object or a user
+type ValueCount struct {
+	Value string `db:"value" json:"value"`
+	Count int    `db:"count" json:"count"`
+}
+
+// SyncActivity is how many writes and deletes the sync applied in a minute
+type SyncActivity struct {
+	Minute  time.Time `db:"minute" json:"minute"`
+	Writes  int       `db:"writes" json:"writes"`
+	Deletes int       `db:"deletes" json:"deletes"`
+}
+
+// GetTupleCounts is how many tuples there are of every user type, relation and object type, as kept by the sync
+func (r *SqlxRepository) GetTupleCounts() ([]TupleCount, error) {
+	var counts []TupleCount
+	err := r._db.Select(&counts, "select user_type, relation, object_type, count from tuple_counts order by count desc")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the tuple counts: %w", err)
+	}
+	return counts, nil
+}
+
+// getTop lists the values of expression with the most tuples, up to limit
+func (r *SqlxRepository) getTop(expression, groupBy string, limit int) ([]ValueCount, error) {
+	top := []ValueCount{}
+	query := fmt.Sprintf(`select %v as value, count(*) as count from tuples group by %v order by 2 desc, 1 limit ?`,
+		expression, groupBy)
+	if err := r._db.Select(&top, r._db.Rebind(query), limit); err != nil {
+		return nil, fmt.Errorf("failed to read the top values: %w", err)
+	}
+	return top, nil
+}
+
+// GetTopObjects lists the objects with the most tuples
+func (r *SqlxRepository) GetTopObjects(limit int) ([]ValueCount, error) {
+	return r.getTop("object_type || ':' || object_id", "object_type, object_id", limit)
+}
+
+// GetTopUsers lists the users with the most tuples, usersets included
+func (r *SqlxRepository) GetTopUsers(limit int) ([]ValueCount, error) {
+	return r.getTop("user_type || ':' || user_id", "user_type, user_id", limit)
+}
+
+// GetSyncActivity lists the minutes since the given time the sync applied changes in, oldest first
+func (r *SqlxRepository) GetSyncActivity(since time.Time) ([]SyncActivity, error) {
+	var activity []SyncActivity
+	err := r._db.Select(&activity, r._db.Rebind("select * from sync_activity where minute >= ? order by minute"),
+		since.UTC().Truncate(time.Minute))
+	return activity, err
+}
+
+// GetConnections lists the sync positions of a store, one per type synced
+func (r *SqlxRepository) GetConnections(apiUrl, storeId string) ([]Connection, error) {
+	var connections []Connection
+	err := r._db.Select(&connections, r._db.Rebind(`select * from connections where api_url = ? and store_id = ?
+		order by type`), apiUrl, storeId)
+	return connections, err
+}
+
+// CountPendingActions is how many tuples wait for every pending action, by the action code: D for the ones marked
+// for deletion and S for the stale ones
+func (r *SqlxRepository) CountPendingActions() (map[string]int, error) {
+	var counts []struct {
+		Action string `db:"action"`
+		Count  int    `db:"count"`
+	}
+	if err := r._db.Select(&counts, "select action, count(*) as count from pending_actions group by action"); err != nil {
+		return nil, fmt.Errorf("failed to count the pending actions: %w", err)
+	}
+	result := map[string]int{}
+	for _, count := range counts {
+		result[count.Action] = count.Count
+	}
+	return result, nil
+}
@@ -0,0 +1,63 @@
+package db
+
+import (
+	openfga "github.com/openfga/go-sdk"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	repo := mustOpen(t, ":memory:")
+	defer repo.Close()
+
+	change := func(operation openfga.TupleOperation, user, object string) openfga.TupleChange {
+		return openfga.TupleChange{TupleKey: *openfga.NewTupleKey(user, "viewer", object), Operation: operation, Timestamp: time.Now()}
+	}
+	started := time.Now()
+	err := repo.ApplyChanges([]openfga.TupleChange{
+		change(openfga.WRITE, "user:jack", "document:1"),
+		change(openfga.WRITE, "user:jill", "document:1"),
+		change(openfga.WRITE, "group:eng#member", "document:1"),
+		change(openfga.WRITE, "user:jack", "document:2"),
+		change(openfga.DELETE, "user:jill", "document:1"),
+	}, Connection{ApiUrl: "http://localhost:8087", StoreId: "01HME1", Type: "document", ContinuationToken: "5", LastSync: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if top, err := repo.GetTopObjects(1); !reflect.DeepEqual(top, []ValueCount{{"document:1", 2}}) || err != nil {
+		t.Errorf("Expected document:1 on top, got %v (%v)", top, err)
+	}
+	expected := []ValueCount{{"user:jack", 2}, {"group:eng#member", 1}}
+	if top, err := repo.GetTopUsers(10); !reflect.DeepEqual(top, expected) || err != nil {
+		t.Errorf("Expected %v, got %v (%v)", expected, top, err)
+	}
+	if counts, err := repo.GetTupleCounts(); len(counts) != 2 || counts[0].Count != 2 || err != nil {
+		t.Errorf("Expected the counts of users and groups, got %v (%v)", counts, err)
+	}
+	activity, err := repo.GetSyncActivity(started)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writes, deletes := 0, 0
+	for _, minute := range activity {
+		writes, deletes = writes+minute.Writes, deletes+minute.Deletes
+	}
+	if writes != 4 || deletes != 1 {
+		t.Errorf("Expected 4 writes and a delete, got %v and %v in %v", writes, deletes, activity)
+	}
+	if connections, err := repo.GetConnections("http://localhost:8087", "01HME1"); len(connections) != 1 || connections[0].Type != "document" || err != nil {
+		t.Errorf("Expected the connection of the document type, got %v (%v)", connections, err)
+	}
+
+	t.Run("Pages without changes are no activity", func(t *testing.T) {
+		before, _ := repo.GetSyncActivity(started)
+		if err := repo.ApplyChanges(nil, Connection{ApiUrl: "http://localhost:8087", StoreId: "01HME1", ContinuationToken: "5"}); err != nil {
+			t.Fatal(err)
+		}
+		if after, _ := repo.GetSyncActivity(started); !reflect.DeepEqual(before, after) {
+			t.Errorf("Expected the activity to stay %v, got %v", before, after)
+		}
+	})
+}
@@ -0,0 +1,27 @@
+-- a replica created by fgamanager before schema_version existed
+CREATE TABLE tuples(
+    tuple_key text not null primary key,
+    user_type text not null,
+    user_id text not null,
+    relation text not null,
+    object_type text not null,
+    object_id text not null,
+    timestamp timestamp);
+
+CREATE INDEX idx_tuple_content on tuples(user_type, user_id, relation, object_id, object_type);
+
+CREATE TABLE pending_actions (
+    tuple_key text not null primary key,
+    action text not null);
+
+CREATE TABLE connections (
+    api_url text not null,
+    store_id text not null primary key ,
+    continuation_token text,
+    last_sync timestamp
+);
+
+INSERT INTO tuples VALUES ('user:jack member group:boss', 'user', 'jack', 'member', 'group', 'boss', '2024-02-10 10:00:00');
+INSERT INTO tuples VALUES ('user:anne owner doc:budget', 'user', 'anne', 'owner', 'doc', 'budget', '2024-02-10 11:00:00');
+INSERT INTO pending_actions VALUES ('user:anne owner doc:budget', 'D');
+INSERT INTO connections VALUES ('http://localhost:8087', 'STOREID', 'TOKEN', '2024-02-10 11:00:00');
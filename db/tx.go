@@ -0,0 +1,235 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/jmoiron/sqlx"
+	openfga "github.com/openfga/go-sdk"
+	"time"
+)
+
+const (
+	clearPendingSql = `delete from pending_actions where tuple_key = ?`
+	insertTupleSql  = `insert into tuples (tuple_key, user_type, user_id, relation, object_type, object_id, timestamp)
+			values (?, ?, ?, ?, ?, ?, ?) on conflict (tuple_key) do nothing`
+	touchTupleSql  = `update tuples set timestamp = ? where tuple_key = ?`
+	deleteTupleSql = `delete from tuples where tuple_key = ? returning user_type, relation, object_type`
+	countTupleSql  = `insert into tuple_counts (user_type, relation, object_type, count) values (?, ?, ?, ?)
+			on conflict (user_type, relation, object_type) do update set count = tuple_counts.count + excluded.count`
+	dropCountSql      = `delete from tuple_counts where user_type = ? and relation = ? and object_type = ? and count <= 0`
+	recordActivitySql = `insert into sync_activity (minute, writes, deletes) values (?, ?, ?) on conflict (minute)
+			do update set writes = sync_activity.writes + excluded.writes, deletes = sync_activity.deletes + excluded.deletes`
+	pruneActivitySql = `delete from sync_activity where minute < ?`
+	recordChangeSql  = `insert into tuple_changes (tuple_key, user_type, user_id, relation, object_type, object_id, operation, timestamp)
+			values (?, ?, ?, ?, ?, ?, ?, ?)`
+	upsertConnectionSql = `insert into connections (api_url, store_id, type, continuation_token, last_sync)
+			values (?, ?, ?, ?, ?) on conflict (store_id, type) do update
+			set continuation_token = excluded.continuation_token,
+			    last_sync = excluded.last_sync`
+)
+
+// changeApplied is called after every change a transaction applies, tests use it to crash mid-page
+var changeApplied = func() {}
+
+// Tx is a transaction of the replica, what its operations do is kept only if the function given to
+// Transact returns nil
+type Tx struct {
+	tx          *sqlx.Tx
+	repo        *SqlxRepository
+	keepHistory bool
+	// statements are the prepared statements of the repository bound to the transaction, closed with it
+	statements map[string]*sqlx.Stmt
+}
+
+// Transact runs f in a transaction. It's committed when f returns nil and rolled back when f fails or panics
+func (r *SqlxRepository) Transact(f func(tx *Tx) error) error {
+	sqlTx, err := r._db.Beginx()
+	if err != nil {
+		return err
+	}
+	// does nothing once committed
+	defer func() { _ = sqlTx.Rollback() }()
+	if err := f(&Tx{tx: sqlTx, repo: r, keepHistory: r.keepHistory, statements: map[string]*sqlx.Stmt{}}); err != nil {
+		return err
+	}
+	return sqlTx.Commit()
+}
+
+// prepare prepares the statements of the sync once for the repository. database/sql prepares them again on
+// every connection they run on, once per connection
+func (r *SqlxRepository) prepare() error {
+	r.statements = map[string]*sqlx.Stmt{}
+	for _, query := range []string{clearPendingSql, insertTupleSql, touchTupleSql, deleteTupleSql, countTupleSql, dropCountSql,
+		recordActivitySql, pruneActivitySql, recordChangeSql, upsertConnectionSql} {
+		stmt, err := r._db.Preparex(r._db.Rebind(query))
+		if err != nil {
+			r.closeStatements()
+			return err
+		}
+		r.statements[query] = stmt
+	}
+	return nil
+}
+
+func (r *SqlxRepository) closeStatements() {
+	for _, stmt := range r.statements {
+		_ = stmt.Close()
+	}
+	r.statements = nil
+}
+
+// stmt is query prepared for the transaction
+func (t *Tx) stmt(query string) (*sqlx.Stmt, error) {
+	stmt, found := t.statements[query]
+	if !found {
+		if prepared, found := t.repo.statements[query]; found {
+			stmt = t.tx.Stmtx(prepared)
+		} else {
+			var err error
+			if stmt, err = t.tx.Preparex(t.tx.Rebind(query)); err != nil {
+				return nil, err
+			}
+		}
+		t.statements[query] = stmt
+	}
+	return stmt, nil
+}
+
+func (t *Tx) exec(query string, args ...interface{}) (sql.Result, error) {
+	stmt, err := t.stmt(query)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.Exec(args...)
+}
+
+// writeTuple inserts a tuple, or updates the timestamp of the tuple when it's already there. Only the tuples
+// inserted are counted
+func (t *Tx) writeTuple(tupleKey, userType, userId, relation, objectType, objectId string, timestamp time.Time) error {
+	result, err := t.exec(insertTupleSql, tupleKey, userType, userId, relation, objectType, objectId, timestamp)
+	if err != nil {
+		return err
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if inserted == 0 {
+		_, err = t.exec(touchTupleSql, timestamp, tupleKey)
+		return err
+	}
+	return t.count(userType, relation, objectType, 1)
+}
+
+// deleteTuple deletes a tuple, uncounting it when it was there
+func (t *Tx) deleteTuple(tupleKey string) error {
+	stmt, err := t.stmt(deleteTupleSql)
+	if err != nil {
+		return err
+	}
+	var userType, relation, objectType string
+	err = stmt.QueryRowx(tupleKey).Scan(&userType, &relation, &objectType)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return t.count(userType, relation, objectType, -1)
+}
+
+// count adds delta to the tuples counted for a user type, relation and object type, dropping the counts that
+// reach zero so the dropdowns only list what the replica has
+func (t *Tx) count(userType, relation, objectType string, delta int) error {
+	if _, err := t.exec(countTupleSql, userType, relation, objectType, delta); err != nil {
+		return err
+	}
+	if delta < 0 {
+		_, err := t.exec(dropCountSql, userType, relation, objectType)
+		return err
+	}
+	return nil
+}
+
+// ApplyChange takes a tuple change straight from the API
+func (t *Tx) ApplyChange(change openfga.TupleChange) error {
+	key := change.GetTupleKey()
+	userType, userId := splitTypePair(key.User)
+	objectType, objectId := splitTypePair(key.Object)
+	tupleKey := key.User + " " + key.Relation + " " + key.Object
+	timestamp := change.GetTimestamp()
+
+	// ensures whatever existing action is cleaned up
+	if _, err := t.exec(clearPendingSql, tupleKey); err != nil {
+		return err
+	}
+	if t.keepHistory {
+		_, err := t.exec(recordChangeSql, tupleKey, userType, userId, key.Relation, objectType, objectId,
+			operationCode(change.Operation), timestamp)
+		if err != nil {
+			return err
+		}
+	}
+	var err error
+	switch change.Operation {
+	case openfga.WRITE:
+		err = t.writeTuple(tupleKey, userType, userId, key.Relation, objectType, objectId, timestamp)
+	case openfga.DELETE:
+		err = t.deleteTuple(tupleKey)
+	}
+	if err == nil {
+		changeApplied()
+	}
+	return err
+}
+
+// recordActivity adds the writes and deletes of changes to the activity of the current minute
+func (t *Tx) recordActivity(changes []openfga.TupleChange) error {
+	writes, deletes := 0, 0
+	for _, change := range changes {
+		if change.Operation == openfga.DELETE {
+			deletes++
+		} else {
+			writes++
+		}
+	}
+	minute := time.Now().UTC().Truncate(time.Minute)
+	if _, err := t.exec(recordActivitySql, minute, writes, deletes); err != nil {
+		return err
+	}
+	_, err := t.exec(pruneActivitySql, minute.Add(-activityRetention))
+	return err
+}
+
+// UpsertConnection saves where the sync of a store, or of a type of it, stopped
+func (t *Tx) UpsertConnection(connection Connection) error {
+	_, err := t.exec(upsertConnectionSql, connection.ApiUrl, connection.StoreId, connection.Type,
+		connection.ContinuationToken, connection.LastSync)
+	return err
+}
+
+func (r *SqlxRepository) ApplyChange(change openfga.TupleChange) error {
+	return r.Transact(func(tx *Tx) error { return tx.ApplyChange(change) })
+}
+
+func (r *SqlxRepository) UpsertConnection(connection Connection) error {
+	return r.Transact(func(tx *Tx) error { return tx.UpsertConnection(connection) })
+}
+
+// ApplyChanges applies a page of changes and saves the sync position after it in a single transaction,
+// so the replica never holds a page without its continuation token or the other way around
+func (r *SqlxRepository) ApplyChanges(changes []openfga.TupleChange, connection Connection) error {
+	return r.Transact(func(tx *Tx) error {
+		for _, change := range changes {
+			if err := tx.ApplyChange(change); err != nil {
+				return err
+			}
+		}
+		if len(changes) > 0 {
+			if err := tx.recordActivity(changes); err != nil {
+				return err
+			}
+		}
+		return tx.UpsertConnection(connection)
+	})
+}
@@ -0,0 +1,119 @@
+package db
+
+import (
+	"errors"
+	openfga "github.com/openfga/go-sdk"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// crashReplicaEnv makes the test process crash while applying a page to this replica
+const crashReplicaEnv = "FGAMANAGER_CRASH_REPLICA"
+
+func page(users ...string) []openfga.TupleChange {
+	var changes []openfga.TupleChange
+	for _, user := range users {
+		changes = append(changes, openfga.TupleChange{
+			TupleKey:  openfga.TupleKey{User: user, Relation: "member", Object: "group:boss"},
+			Operation: openfga.WRITE,
+			Timestamp: time.Now()})
+	}
+	return changes
+}
+
+func syncedAt(token string) Connection {
+	return Connection{ApiUrl: "http://localhost:8087", StoreId: "01HME1", ContinuationToken: token, LastSync: time.Now()}
+}
+
+func TestTransact(t *testing.T) {
+	repo := mustOpen(t, ":memory:")
+	defer repo.Close()
+
+	t.Run("Rolls back on panic", func(t *testing.T) {
+		defer func() {
+			if recover() == nil {
+				t.Error("Expected the panic to go through")
+			}
+			if c, _ := repo.CountTuples(nil); c != 0 {
+				t.Errorf("Expected no tuples, got %v", c)
+			}
+		}()
+		_ = repo.Transact(func(tx *Tx) error {
+			if err := tx.ApplyChange(page("user:jack")[0]); err != nil {
+				return err
+			}
+			panic("crash")
+		})
+	})
+
+	t.Run("Rolls back on error", func(t *testing.T) {
+		failure := errors.New("failure")
+		err := repo.Transact(func(tx *Tx) error {
+			if err := tx.UpsertConnection(syncedAt("1")); err != nil {
+				return err
+			}
+			return failure
+		})
+		if err != failure {
+			t.Errorf("Expected the failure, got %v", err)
+		}
+		if token := repo.GetContinuationToken("http://localhost:8087", "01HME1", ""); token != nil {
+			t.Errorf("Expected no token, got %v", *token)
+		}
+	})
+}
+
+func TestCrashMidPage(t *testing.T) {
+	if path := os.Getenv(crashReplicaEnv); path != "" {
+		repo := mustOpen(t, path)
+		repo.EnableHistory(true)
+		applied := 0
+		changeApplied = func() {
+			applied++
+			if applied == 2 {
+				os.Exit(3)
+			}
+		}
+		_ = repo.ApplyChanges(page("user:joe", "user:jane", "user:jim"), syncedAt("2"))
+		t.Fatal("Expected to crash mid-page")
+	}
+
+	path := filepath.Join(t.TempDir(), "fga.db")
+	repo := mustOpen(t, path)
+	repo.EnableHistory(true)
+	if err := repo.ApplyChanges(page("user:jack", "user:jill"), syncedAt("1")); err != nil {
+		t.Fatal(err)
+	}
+	repo.Close()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestCrashMidPage$")
+	cmd.Env = append(os.Environ(), crashReplicaEnv+"="+path)
+	var exit *exec.ExitError
+	if err := cmd.Run(); !errors.As(err, &exit) || exit.ExitCode() != 3 {
+		t.Fatalf("Expected the page to crash, got %v", err)
+	}
+
+	repo = mustOpen(t, path)
+	defer repo.Close()
+	repo.EnableHistory(true)
+	if c, _ := repo.CountTuples(nil); c != 2 {
+		t.Errorf("Expected only the tuples of the first page, got %v", c)
+	}
+	if token := repo.GetContinuationToken("http://localhost:8087", "01HME1", ""); token == nil || *token != "1" {
+		t.Errorf("Expected token 1, got %v", token)
+	}
+
+	// the sync fetches the page again from the saved token
+	if err := repo.ApplyChanges(page("user:joe", "user:jane", "user:jim"), syncedAt("2")); err != nil {
+		t.Fatal(err)
+	}
+	if c, _ := repo.CountTuples(nil); c != 5 {
+		t.Errorf("Expected 5 tuples, got %v", c)
+	}
+	if history, _ := repo.GetTupleHistory("user:joe member group:boss"); len(history) != 1 {
+		t.Errorf("Expected the change applied once, got %v", len(history))
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/gdamore/tcell/v2"
+	"github.com/paulosuzart/fgamanager/db"
+	"github.com/rivo/tview"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// tupleKeysView is a virtual table over a sorted list of tuple keys
+type tupleKeysView struct {
+	tview.TableContentReadOnly
+	keys []string
+}
+
+func (t *tupleKeysView) GetRowCount() int {
+	return len(t.keys) + 1
+}
+
+func (t *tupleKeysView) GetColumnCount() int {
+	return 3
+}
+
+func (t *tupleKeysView) GetCell(row, column int) *tview.TableCell {
+	if row == 0 {
+		return tview.NewTableCell([]string{"USER                                ", "RELATION              ", "OBJECT                                "}[column]).
+			SetSelectable(false)
+	}
+	parts := strings.SplitN(t.keys[row-1], " ", 3)
+	if column >= len(parts) {
+		return nil
+	}
+	return tview.NewTableCell(parts[column]).SetTextColor(tcell.ColorLightCyan)
+}
+
+func printPlan(out io.Writer, writes, deletes []string) {
+	for _, key := range writes {
+		_, _ = fmt.Fprintf(out, "+ %v\n", key)
+	}
+	for _, key := range deletes {
+		_, _ = fmt.Fprintf(out, "- %v\n", key)
+	}
+	_, _ = fmt.Fprintf(out, "%v writes, %v deletes\n", len(writes), len(deletes))
+}
+
+// diffTarget is the store given to apply a plan to. It refuses a store other than the one
+// the right replica came from
+func diffTarget(configs []storeConfig, right string) (*storeConfig, error) {
+	if len(configs) != 1 {
+		return nil, fmt.Errorf("exactly one --storeId or --profile is required to apply a plan")
+	}
+	target := &configs[0]
+	replica, err := db.IsReplica(right)
+	if err != nil || !replica {
+		return target, err
+	}
+	replicaStore, err := db.ReplicaStoreId(right)
+	if err != nil {
+		return nil, err
+	}
+	if replicaStore != target.StoreId {
+		return nil, fmt.Errorf("%v is a replica of store %v, not of %v", right, replicaStore, target.StoreId)
+	}
+	return target, nil
+}
+
+// applyPlanTo sends the plan to the target store, auditing it in the replica of the store
+func applyPlanTo(ctx context.Context, target *storeConfig, journal *auditJournal, writes, deletes []string) error {
+	client, err := newClient(*target)
+	if err != nil {
+		return err
+	}
+	repo, err := db.Open(replicaOf(*target))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = repo.Close() }()
+	return applyPlan(ctx, newFgaService(*target, client, repo, journal), writes, deletes)
+}
+
+func runDiff(ctx context.Context, configs []storeConfig, journal *auditJournal) error {
+	result, err := db.Diff(*diffLeft, *diffRight)
+	if err != nil {
+		return err
+	}
+	writes, deletes := result.Plan()
+	slog.Info("Diff", "left", result.Left, "right", result.Right,
+		"only_left", len(result.OnlyLeft), "only_right", len(result.OnlyRight), "common", len(result.Common))
+
+	if *diffApply {
+		target, err := diffTarget(configs, result.Right)
+		if err != nil {
+			return err
+		}
+		printPlan(os.Stdout, writes, deletes)
+		fmt.Printf("Type the store id %v to apply the plan: ", target.StoreId)
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if strings.TrimSpace(answer) != target.StoreId {
+			return fmt.Errorf("confirmation did not match, nothing applied")
+		}
+		return applyPlanTo(ctx, target, journal, writes, deletes)
+	}
+
+	if *diffPlan {
+		printPlan(os.Stdout, writes, deletes)
+		return nil
+	}
+
+	app := tview.NewApplication()
+	return app.SetRoot(newDiffView(ctx, app, result, configs, journal), true).Run()
+}
+
+func newDiffView(ctx context.Context, app *tview.Application, result *db.DiffResult, configs []storeConfig, journal *auditJournal) tview.Primitive {
+	tabs := []struct {
+		name string
+		keys []string
+	}{
+		{"Only in " + result.Left, result.OnlyLeft},
+		{"Only in " + result.Right, result.OnlyRight},
+		{"Common", result.Common},
+	}
+
+	tabBar := tview.NewTextView().SetDynamicColors(true).SetRegions(true).SetWrap(false)
+	help := tview.NewTextView().SetDynamicColors(true).SetTextAlign(tview.AlignCenter)
+	help.SetText("[blue]<tab>/<1-3>:[white] Switch tab  [green]<ctrl-a>:[white] Apply plan to the store  [blue]<esc>:[white] Quit")
+	pages := tview.NewPages()
+
+	for i, tab := range tabs {
+		_, _ = fmt.Fprintf(tabBar, `["%d"] %d. %v (%d) [""]  `, i, i+1, tab.name, len(tab.keys))
+		table := tview.NewTable().SetContent(&tupleKeysView{keys: tab.keys}).
+			SetSelectable(true, false).SetFixed(1, 0)
+		pages.AddPage(fmt.Sprint(i), table, true, i == 0)
+	}
+	tabBar.Highlight("0")
+	tabBar.SetHighlightedFunc(func(added, _, _ []string) {
+		if len(added) > 0 {
+			pages.SwitchToPage(added[0])
+		}
+	})
+
+	layout := tview.NewFlex().SetDirection(tview.FlexRow).
+		AddItem(tabBar, 1, 0, false).
+		AddItem(pages, 0, 1, true).
+		AddItem(help, 1, 0, false)
+	layout.SetBorder(true).SetTitle(" Diff ")
+
+	root := tview.NewPages().AddPage("diff", layout, true, true)
+	writes, deletes := result.Plan()
+
+	layout.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		current := 0
+		if highlights := tabBar.GetHighlights(); len(highlights) > 0 {
+			_, _ = fmt.Sscan(highlights[0], &current)
+		}
+		switch {
+		case event.Key() == tcell.KeyTab:
+			tabBar.Highlight(fmt.Sprint((current + 1) % len(tabs)))
+			return nil
+		case event.Rune() >= '1' && event.Rune() <= '3':
+			tabBar.Highlight(fmt.Sprint(event.Rune() - '1'))
+			return nil
+		case event.Key() == tcell.KeyEscape:
+			app.Stop()
+			return nil
+		case event.Key() == tcell.KeyCtrlA:
+			target, err := diffTarget(configs, result.Right)
+			if err != nil {
+				help.SetText("[red]" + err.Error())
+				return nil
+			}
+			modal := tview.NewModal().
+				SetText(fmt.Sprintf("Apply %v writes and %v deletes to store %v?", len(writes), len(deletes), target.StoreId)).
+				AddButtons([]string{"Cancel", "Apply"}).
+				SetDoneFunc(func(_ int, label string) {
+					root.RemovePage("confirm")
+					if label != "Apply" {
+						return
+					}
+					help.SetText("Applying plan...")
+					go func() {
+						err := applyPlanTo(ctx, target, journal, writes, deletes)
+						app.QueueUpdateDraw(func() {
+							if err != nil {
+								help.SetText("[red]" + err.Error())
+							} else {
+								help.SetText(fmt.Sprintf("[green]Applied %v writes and %v deletes", len(writes), len(deletes)))
+							}
+						})
+					}()
+				})
+			root.AddPage("confirm", modal, false, true)
+			return nil
+		}
+		return event
+	})
+
+	return root
+}
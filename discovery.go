@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/gdamore/tcell/v2"
+	openfga "github.com/openfga/go-sdk"
+	"github.com/rivo/tview"
+	"log/slog"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// storeAdmin lists, creates and deletes the stores of an OpenFGA server
+type storeAdmin interface {
+	listStores(ctx context.Context) ([]openfga.Store, error)
+	createStore(ctx context.Context, name string) (*openfga.CreateStoreResponse, error)
+	deleteStore(ctx context.Context, storeId string) error
+}
+
+type serverAdmin struct {
+	storeAdmin
+	server storeConfig
+	client *openfga.APIClient
+}
+
+// newServerAdmin connects to the server of a config, its store id is ignored
+func newServerAdmin(server storeConfig) (*serverAdmin, error) {
+	server.Name, server.StoreId, server.DbPath = "", "", ""
+	client, err := newClient(server)
+	if err != nil {
+		return nil, err
+	}
+	return &serverAdmin{server: server, client: client}, nil
+}
+
+func (a *serverAdmin) listStores(ctx context.Context) ([]openfga.Store, error) {
+	var stores []openfga.Store
+	request := a.client.OpenFgaApi.ListStores(ctx).PageSize(100)
+	for {
+		resp, _, err := request.Execute()
+		if err != nil {
+			return nil, err
+		}
+		stores = append(stores, resp.GetStores()...)
+		if resp.GetContinuationToken() == "" {
+			return stores, nil
+		}
+		request = request.ContinuationToken(resp.GetContinuationToken())
+	}
+}
+
+func (a *serverAdmin) createStore(ctx context.Context, name string) (*openfga.CreateStoreResponse, error) {
+	resp, _, err := a.client.OpenFgaApi.CreateStore(ctx).Body(openfga.CreateStoreRequest{Name: name}).Execute()
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("Created store", "operation", "create_store", "store", resp.Name, "store_id", resp.Id)
+	return &resp, nil
+}
+
+func (a *serverAdmin) deleteStore(ctx context.Context, storeId string) error {
+	// DeleteStore acts on the store of the client
+	server := a.server
+	server.StoreId = storeId
+	client, err := newClient(server)
+	if err != nil {
+		return err
+	}
+	if _, err := client.OpenFgaApi.DeleteStore(ctx).Execute(); err != nil {
+		return err
+	}
+	slog.Info("Deleted store", "operation", "delete_store", "store_id", storeId)
+	return nil
+}
+
+// findStore looks a store up by id among the stores of the server
+func findStore(ctx context.Context, admin storeAdmin, storeId string) (*openfga.Store, error) {
+	stores, err := admin.listStores(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range stores {
+		if s.Id == storeId {
+			return &s, nil
+		}
+	}
+	return nil, fmt.Errorf("store %v not found", storeId)
+}
+
+// confirmationOf is what has to be typed to delete a store
+func confirmationOf(s *openfga.Store) string {
+	if s.Name != "" {
+		return s.Name
+	}
+	return s.Id
+}
+
+// centered wraps p to show it as a dialog over the current page
+func centered(p tview.Primitive, width, height int) tview.Primitive {
+	return tview.NewFlex().
+		AddItem(nil, 0, 1, false).
+		AddItem(tview.NewFlex().SetDirection(tview.FlexRow).
+			AddItem(nil, 0, 1, false).
+			AddItem(p, height, 1, true).
+			AddItem(nil, 0, 1, false), width, 1, true).
+		AddItem(nil, 0, 1, false)
+}
+
+// storeBrowser lists the stores of a server to open, create or delete them
+type storeBrowser struct {
+	*tview.Pages
+	app    *tview.Application
+	admin  storeAdmin
+	server storeConfig
+	table  *tview.Table
+	status *tview.TextView
+	stores []openfga.Store
+	// onOpen is called with the store picked with enter
+	onOpen func(config storeConfig)
+	// inSession tells stores that can't be deleted because they are open
+	inSession func(storeId string) bool
+}
+
+func newStoreBrowser(app *tview.Application, admin *serverAdmin, onOpen func(storeConfig), onDone func()) *storeBrowser {
+	b := &storeBrowser{
+		Pages:     tview.NewPages(),
+		app:       app,
+		admin:     admin,
+		server:    admin.server,
+		table:     tview.NewTable().SetSelectable(true, false).SetFixed(1, 0),
+		status:    tview.NewTextView().SetDynamicColors(true).SetTextAlign(tview.AlignCenter),
+		onOpen:    onOpen,
+		inSession: func(string) bool { return false },
+	}
+	b.table.SetBorder(true).SetTitle(fmt.Sprintf(" Stores at %v ", admin.server.ApiUrl))
+	b.table.SetSelectedFunc(func(row, _ int) {
+		if row > 0 && row <= len(b.stores) {
+			s := b.stores[row-1]
+			config := b.server
+			config.Name, config.StoreId = s.Name, s.Id
+			b.onOpen(config)
+		}
+	})
+	b.table.SetDoneFunc(func(key tcell.Key) {
+		if key == tcell.KeyEscape {
+			onDone()
+		}
+	})
+	b.table.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		row, _ := b.table.GetSelection()
+		if b.server.ReadOnly && (event.Key() == tcell.KeyCtrlN || event.Key() == tcell.KeyCtrlD) {
+			b.setError(errReadOnly)
+			return nil
+		}
+		switch event.Key() {
+		case tcell.KeyCtrlN:
+			b.showCreate()
+			return nil
+		case tcell.KeyCtrlD:
+			if row > 0 && row <= len(b.stores) {
+				b.showDelete(b.stores[row-1])
+			}
+			return nil
+		case tcell.KeyCtrlR:
+			b.refresh()
+			return nil
+		}
+		return event
+	})
+
+	layout := tview.NewFlex().SetDirection(tview.FlexRow).
+		AddItem(b.table, 0, 1, true).
+		AddItem(b.status, 1, 0, false)
+	b.AddPage("list", layout, true, true)
+	b.setHelp()
+	return b
+}
+
+func (b *storeBrowser) setHelp() {
+	b.status.SetText("[blue]<enter>:[white] Open  [green]<ctrl-n>:[white] Create  [red]<ctrl-d>:[white] Delete  [blue]<ctrl-r>:[white] Reload  [blue]<esc>:[white] Return")
+}
+
+func (b *storeBrowser) setError(err error) {
+	b.status.SetText("[red]" + err.Error())
+}
+
+// refresh reloads the stores from the server in the background
+func (b *storeBrowser) refresh() {
+	b.status.SetText("Loading stores...")
+	go func() {
+		stores, err := b.admin.listStores(context.Background())
+		b.app.QueueUpdateDraw(func() {
+			if err != nil {
+				slog.Error("Failed to list stores", "api_url", b.server.ApiUrl, "err", err)
+				b.setError(err)
+				return
+			}
+			b.stores = stores
+			b.fill()
+			b.setHelp()
+		})
+	}()
+}
+
+func (b *storeBrowser) fill() {
+	b.table.Clear()
+	for column, header := range []string{"NAME                          ", "STORE ID                      ", "CREATED                  ", "OPEN "} {
+		b.table.SetCell(0, column, tview.NewTableCell(header).SetSelectable(false))
+	}
+	for i, s := range b.stores {
+		open := ""
+		if b.inSession(s.Id) {
+			open = "*"
+		}
+		b.table.SetCell(i+1, 0, tview.NewTableCell(s.Name).SetTextColor(tcell.ColorLightCyan))
+		b.table.SetCell(i+1, 1, tview.NewTableCell(s.Id).SetTextColor(tcell.ColorLightCyan))
+		b.table.SetCell(i+1, 2, tview.NewTableCell(s.CreatedAt.Local().Format(time.DateTime)).SetTextColor(tcell.ColorLightCyan))
+		b.table.SetCell(i+1, 3, tview.NewTableCell(open).SetTextColor(tcell.ColorDarkOrange))
+	}
+	if len(b.stores) == 0 {
+		b.table.SetCell(1, 0, tview.NewTableCell("No stores, <ctrl-n> creates one").SetSelectable(false))
+	}
+	b.table.Select(1, 0)
+}
+
+func (b *storeBrowser) closeDialog() {
+	b.RemovePage("dialog")
+	b.app.SetFocus(b.table)
+}
+
+func (b *storeBrowser) showCreate() {
+	form := tview.NewForm()
+	form.AddInputField("Name", "", 40, nil, nil)
+	form.AddButton("Create", func() {
+		name := form.GetFormItem(0).(*tview.InputField).GetText()
+		if name == "" {
+			return
+		}
+		b.closeDialog()
+		go func() {
+			_, err := b.admin.createStore(context.Background(), name)
+			b.app.QueueUpdateDraw(func() {
+				if err != nil {
+					b.setError(err)
+					return
+				}
+				b.refresh()
+			})
+		}()
+	})
+	form.AddButton("Cancel", b.closeDialog)
+	form.SetBorder(true).SetTitle(" New store ")
+	b.AddPage("dialog", centered(form, 60, 7), true, true)
+	b.app.SetFocus(form)
+}
+
+func (b *storeBrowser) showDelete(s openfga.Store) {
+	if b.inSession(s.Id) {
+		b.setError(fmt.Errorf("store %v is open in this session and can't be deleted", confirmationOf(&s)))
+		return
+	}
+	confirmation := confirmationOf(&s)
+	form := tview.NewForm()
+	form.AddInputField(fmt.Sprintf("Type %q to confirm", confirmation), "", 40, nil, nil)
+	form.AddButton("Delete", func() {
+		if form.GetFormItem(0).(*tview.InputField).GetText() != confirmation {
+			b.closeDialog()
+			b.setError(fmt.Errorf("confirmation did not match, store %v not deleted", s.Id))
+			return
+		}
+		b.closeDialog()
+		go func() {
+			err := b.admin.deleteStore(context.Background(), s.Id)
+			b.app.QueueUpdateDraw(func() {
+				if err != nil {
+					b.setError(err)
+					return
+				}
+				b.refresh()
+			})
+		}()
+	})
+	form.AddButton("Cancel", b.closeDialog)
+	form.SetBorder(true).SetTitle(fmt.Sprintf(" Delete store %v ", s.Id))
+	b.AddPage("dialog", centered(form, 80, 7), true, true)
+	b.app.SetFocus(form)
+}
+
+// pickStore runs a store browser until a store is picked, nil if the user quits
+func pickStore(admin *serverAdmin) (*storeConfig, error) {
+	app := tview.NewApplication()
+	var picked *storeConfig
+	browser := newStoreBrowser(app, admin, func(config storeConfig) {
+		picked = &config
+		app.Stop()
+	}, app.Stop)
+	browser.refresh()
+	if err := app.SetRoot(browser, true).SetFocus(browser.table).Run(); err != nil {
+		return nil, err
+	}
+	return picked, nil
+}
+
+// runStoreCommand runs the store list, create and delete commands against the server
+func runStoreCommand(ctx context.Context, server storeConfig) error {
+	admin, err := newServerAdmin(server)
+	if err != nil {
+		return err
+	}
+	if server.ReadOnly && !storeListCommand.Happened() {
+		return errReadOnly
+	}
+	switch {
+	case storeCreateCommand.Happened():
+		created, err := admin.createStore(ctx, *storeCreateName)
+		if err != nil {
+			return err
+		}
+		fmt.Println(created.Id)
+	case storeDeleteCommand.Happened():
+		s, err := findStore(ctx, admin, *storeDeleteId)
+		if err != nil {
+			return err
+		}
+		confirmation := confirmationOf(s)
+		fmt.Printf("Type %q to delete store %v: ", confirmation, s.Id)
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if strings.TrimSpace(answer) != confirmation {
+			return fmt.Errorf("confirmation did not match, store %v not deleted", s.Id)
+		}
+		return admin.deleteStore(ctx, s.Id)
+	default:
+		stores, err := admin.listStores(ctx)
+		if err != nil {
+			return err
+		}
+		out := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		_, _ = fmt.Fprintln(out, "ID\tNAME\tCREATED")
+		for _, s := range stores {
+			_, _ = fmt.Fprintf(out, "%v\t%v\t%v\n", s.Id, s.Name, s.CreatedAt.Local().Format(time.DateTime))
+		}
+		return out.Flush()
+	}
+	return nil
+}
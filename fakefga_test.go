@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	openfga "github.com/openfga/go-sdk"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeFga is an in memory stand-in for the parts of the OpenFGA API fgamanager uses
+type fakeFga struct {
+	lock    sync.Mutex
+	stores  []openfga.Store
+	changes map[string][]openfga.TupleChange
+	// failures are answered in order to the next changes requests
+	failures []int
+	// pageSizes are the page sizes asked for by every changes request
+	pageSizes []int
+	server    *httptest.Server
+	nextId    int
+}
+
+func newFakeFga(t *testing.T) *fakeFga {
+	f := &fakeFga{changes: map[string][]openfga.TupleChange{}}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+// storeId makes valid ULIDs, the SDK refuses anything else
+func (f *fakeFga) storeId() string {
+	f.nextId++
+	return fmt.Sprintf("01HME1444HSEY9022AENH%05d", f.nextId)
+}
+
+func (f *fakeFga) addStore(name string) openfga.Store {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	s := openfga.Store{Id: f.storeId(), Name: name, CreatedAt: time.Now(), UpdatedAt: time.Now()}
+	f.stores = append(f.stores, s)
+	return s
+}
+
+// addChanges appends tuple changes to the changes of a store
+func (f *fakeFga) addChanges(storeId string, operation openfga.TupleOperation, tupleKeys ...string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, tupleKey := range tupleKeys {
+		key, _ := parseTupleKey(tupleKey)
+		f.changes[storeId] = append(f.changes[storeId], openfga.TupleChange{
+			TupleKey:  *key,
+			Operation: operation,
+			Timestamp: time.Now(),
+		})
+	}
+}
+
+func (f *fakeFga) failWith(statuses ...int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.failures = append(f.failures, statuses...)
+}
+
+func writeJson(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func (f *fakeFga) serve(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "stores" && r.Method == http.MethodGet:
+		f.listStores(w, r)
+	case len(parts) == 1 && parts[0] == "stores" && r.Method == http.MethodPost:
+		var body openfga.CreateStoreRequest
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		s := f.addStore(body.Name)
+		writeJson(w, http.StatusCreated, openfga.CreateStoreResponse{Id: s.Id, Name: s.Name, CreatedAt: s.CreatedAt, UpdatedAt: s.UpdatedAt})
+	case len(parts) == 2 && parts[0] == "stores" && r.Method == http.MethodDelete:
+		f.deleteStore(w, parts[1])
+	case len(parts) == 3 && parts[0] == "stores" && parts[2] == "read" && r.Method == http.MethodPost:
+		f.read(w, r, parts[1])
+	case len(parts) == 3 && parts[0] == "stores" && parts[2] == "changes" && r.Method == http.MethodGet:
+		f.readChanges(w, r, parts[1])
+	default:
+		writeJson(w, http.StatusNotFound, map[string]string{"code": "undefined_endpoint", "message": r.URL.Path})
+	}
+}
+
+func (f *fakeFga) listStores(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	pageSize, err := strconv.Atoi(r.URL.Query().Get("page_size"))
+	if err != nil {
+		pageSize = 50
+	}
+	start, _ := strconv.Atoi(r.URL.Query().Get("continuation_token"))
+	end := min(start+pageSize, len(f.stores))
+	resp := openfga.ListStoresResponse{Stores: f.stores[start:end]}
+	if end < len(f.stores) {
+		resp.ContinuationToken = strconv.Itoa(end)
+	}
+	writeJson(w, http.StatusOK, resp)
+}
+
+func (f *fakeFga) deleteStore(w http.ResponseWriter, storeId string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for i, s := range f.stores {
+		if s.Id == storeId {
+			f.stores = append(f.stores[:i], f.stores[i+1:]...)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+	writeJson(w, http.StatusNotFound, map[string]string{"code": "store_id_not_found", "message": storeId})
+}
+
+// readChanges pages through the changes of a store, or of a type of it. The continuation token is the offset
+// of the next page
+func (f *fakeFga) readChanges(w http.ResponseWriter, r *http.Request, storeId string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if len(f.failures) > 0 {
+		status := f.failures[0]
+		f.failures = f.failures[1:]
+		writeJson(w, status, map[string]string{"code": "fake_failure", "message": http.StatusText(status)})
+		return
+	}
+	changes, found := f.changes[storeId]
+	if !found {
+		writeJson(w, http.StatusNotFound, map[string]string{"code": "store_id_not_found", "message": storeId})
+		return
+	}
+	pageSize, err := strconv.Atoi(r.URL.Query().Get("page_size"))
+	if err != nil {
+		pageSize = 50
+	}
+	f.pageSizes = append(f.pageSizes, pageSize)
+	if objectType := r.URL.Query().Get("type"); objectType != "" {
+		var ofType []openfga.TupleChange
+		for _, change := range changes {
+			if strings.HasPrefix(change.TupleKey.Object, objectType+":") {
+				ofType = append(ofType, change)
+			}
+		}
+		changes = ofType
+	}
+	start := 0
+	if token := r.URL.Query().Get("continuation_token"); token != "" {
+		if start, err = strconv.Atoi(token); err != nil || start > len(changes) {
+			writeJson(w, http.StatusBadRequest, map[string]string{"code": "invalid_continuation_token", "message": token})
+			return
+		}
+	}
+	end := min(start+pageSize, len(changes))
+	token := strconv.Itoa(end)
+	writeJson(w, http.StatusOK, openfga.ReadChangesResponse{Changes: changes[start:end], ContinuationToken: &token})
+}
+
+// tuples replays the changes of a store into the tuples it has now, sorted by key
+func (f *fakeFga) tuples(storeId string) []openfga.Tuple {
+	current := map[string]openfga.Tuple{}
+	for _, change := range f.changes[storeId] {
+		key := change.TupleKey.User + " " + change.TupleKey.Relation + " " + change.TupleKey.Object
+		if change.Operation == openfga.WRITE {
+			current[key] = openfga.Tuple{Key: change.TupleKey, Timestamp: change.Timestamp}
+		} else {
+			delete(current, key)
+		}
+	}
+	var keys []string
+	for key := range current {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var tuples []openfga.Tuple
+	for _, key := range keys {
+		tuples = append(tuples, current[key])
+	}
+	return tuples
+}
+
+// read pages through the tuples of a store, or looks for a single tuple when the whole key is given
+func (f *fakeFga) read(w http.ResponseWriter, r *http.Request, storeId string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	var request openfga.ReadRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeJson(w, http.StatusBadRequest, map[string]string{"code": "validation_error", "message": err.Error()})
+		return
+	}
+	tuples := f.tuples(storeId)
+	if key := request.TupleKey; key != nil {
+		var found []openfga.Tuple
+		for _, tuple := range tuples {
+			if tuple.Key.User == key.GetUser() && tuple.Key.Relation == key.GetRelation() && tuple.Key.Object == key.GetObject() {
+				found = append(found, tuple)
+			}
+		}
+		writeJson(w, http.StatusOK, openfga.ReadResponse{Tuples: found})
+		return
+	}
+	start, _ := strconv.Atoi(request.GetContinuationToken())
+	end := min(start+int(request.GetPageSize()), len(tuples))
+	resp := openfga.ReadResponse{Tuples: tuples[start:end]}
+	if end < len(tuples) {
+		resp.ContinuationToken = strconv.Itoa(end)
+	}
+	writeJson(w, http.StatusOK, resp)
+}
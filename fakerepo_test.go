@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"errors"
+	openfga "github.com/openfga/go-sdk"
+	"github.com/paulosuzart/fgamanager/db"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// fakeRepoPageSize keeps the pages of the fake small, so tests page through a few tuples
+const fakeRepoPageSize = 5
+
+// fakeRepo is an in memory stand-in for the replica of a store, covering tuples and sync positions.
+// Anything else panics through the nil embedded Repository
+type fakeRepo struct {
+	db.Repository
+	lock        sync.Mutex
+	tuples      map[string]db.Tuple
+	pending     map[string]string
+	owners      map[string]string
+	connections map[string]db.Connection
+	events      []db.SyncEvent
+	// err makes every call fail, as a replica gone missing would
+	err error
+	// failApply is how many of the next ApplyChanges fail
+	failApply int
+	// notElected makes another instance the syncer of the replica
+	notElected bool
+}
+
+func newFakeRepo() *fakeRepo {
+	return &fakeRepo{tuples: map[string]db.Tuple{}, pending: map[string]string{}, owners: map[string]string{}, connections: map[string]db.Connection{}}
+}
+
+func (r *fakeRepo) fail(err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.err = err
+}
+
+func (r *fakeRepo) elect(elected bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.notElected = !elected
+}
+
+// like matches the same patterns as the like of sqlite, ignoring case
+func like(pattern, value string) bool {
+	expression := regexp.QuoteMeta(pattern)
+	expression = strings.NewReplacer("%", ".*", "_", ".").Replace(expression)
+	matched, _ := regexp.MatchString("(?i)^"+expression+"$", value)
+	return matched
+}
+
+// filtered are the tuples matching filter in the order Load returns them, numbered from 1
+func (r *fakeRepo) filtered(filter *db.Filter) ([]db.Tuple, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	if filter != nil && filter.AsOf != nil {
+		return nil, errors.New("as of filters are not supported by the fake replica")
+	}
+	var result []db.Tuple
+	for _, tuple := range r.tuples {
+		if filter != nil {
+			if (filter.UserType != nil && *filter.UserType != tuple.UserType) ||
+				(filter.Relation != nil && *filter.Relation != tuple.Relation) ||
+				(filter.ObjectType != nil && *filter.ObjectType != tuple.ObjectType) ||
+				(filter.Search != nil && !like(*filter.Search, tuple.TupleKey)) {
+				continue
+			}
+		}
+		result = append(result, tuple)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if !result[i].Timestamp.Equal(result[j].Timestamp) {
+			return result[i].Timestamp.After(result[j].Timestamp)
+		}
+		return result[i].TupleKey < result[j].TupleKey
+	})
+	for i := range result {
+		result[i].Row = i + 1
+	}
+	return result, nil
+}
+
+func (r *fakeRepo) CountTuples(filter *db.Filter) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	tuples, err := r.filtered(filter)
+	return len(tuples), err
+}
+
+func (r *fakeRepo) Load(offset int, filter *db.Filter) (*db.LoadResult, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	tuples, err := r.filtered(filter)
+	if err != nil {
+		return nil, err
+	}
+	var res []db.TuplePendingAction
+	for i := range tuples {
+		if tuples[i].Row >= offset && tuples[i].Row <= offset+fakeRepoPageSize {
+			action := &db.PendingAction{Action: r.pending[tuples[i].TupleKey]}
+			res = append(res, db.TuplePendingAction{Tuple: &tuples[i], PendingAction: action})
+		}
+	}
+	if len(res) == 0 {
+		return nil, nil
+	}
+	return db.NewLoadResult(res, filter, len(tuples)), nil
+}
+
+func (r *fakeRepo) GetMarkedForDeletion(owner string) ([]db.Tuple, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.err != nil {
+		return nil, r.err
+	}
+	var marked []db.Tuple
+	for tupleKey, action := range r.pending {
+		if tuple, found := r.tuples[tupleKey]; found && action == Delete.String() && (r.owners[tupleKey] == owner || r.owners[tupleKey] == "") {
+			marked = append(marked, tuple)
+		}
+	}
+	return marked, nil
+}
+
+func (r *fakeRepo) mark(tupleKey string, action Action) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.err != nil {
+		return r.err
+	}
+	r.pending[tupleKey] = action.String()
+	return nil
+}
+
+func (r *fakeRepo) MarkDeletion(tupleKey, owner string) error {
+	r.lock.Lock()
+	r.owners[tupleKey] = owner
+	r.lock.Unlock()
+	return r.mark(tupleKey, Delete)
+}
+
+func (r *fakeRepo) MarkStale(tupleKey string) error {
+	return r.mark(tupleKey, Stale)
+}
+
+func (r *fakeRepo) applyChange(change openfga.TupleChange) {
+	key := change.GetTupleKey()
+	tupleKey := key.User + " " + key.Relation + " " + key.Object
+	delete(r.pending, tupleKey)
+	if change.GetOperation() == openfga.DELETE {
+		delete(r.tuples, tupleKey)
+		return
+	}
+	userType, userId, _ := strings.Cut(key.User, ":")
+	objectType, objectId, _ := strings.Cut(key.Object, ":")
+	r.tuples[tupleKey] = db.Tuple{TupleKey: tupleKey, UserType: userType, UserId: userId, Relation: key.Relation,
+		ObjectType: objectType, ObjectId: objectId, Timestamp: change.GetTimestamp()}
+}
+
+func (r *fakeRepo) ApplyChange(change openfga.TupleChange) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.err != nil {
+		return r.err
+	}
+	r.applyChange(change)
+	return nil
+}
+
+func (r *fakeRepo) Prune() (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.err != nil {
+		return 0, r.err
+	}
+	pruned := 0
+	for tupleKey, action := range r.pending {
+		if action == Stale.String() {
+			delete(r.tuples, tupleKey)
+			delete(r.pending, tupleKey)
+			pruned++
+		}
+	}
+	return pruned, nil
+}
+
+func (r *fakeRepo) values(value func(db.Tuple) string) ([]string, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.err != nil {
+		return nil, r.err
+	}
+	seen := map[string]bool{}
+	var values []string
+	for _, tuple := range r.tuples {
+		if v := value(tuple); !seen[v] {
+			seen[v] = true
+			values = append(values, v)
+		}
+	}
+	sort.Strings(values)
+	return values, nil
+}
+
+func (r *fakeRepo) GetUserTypes() ([]string, error) {
+	return r.values(func(t db.Tuple) string { return t.UserType })
+}
+
+func (r *fakeRepo) GetRelations() ([]string, error) {
+	return r.values(func(t db.Tuple) string { return t.Relation })
+}
+
+func (r *fakeRepo) GetObjectTypes() ([]string, error) {
+	return r.values(func(t db.Tuple) string { return t.ObjectType })
+}
+
+func connectionKey(apiUrl, storeId, objectType string) string {
+	return apiUrl + " " + storeId + " " + objectType
+}
+
+// ApplyChanges applies every change and saves the connection, or nothing at all when it fails
+func (r *fakeRepo) ApplyChanges(changes []openfga.TupleChange, connection db.Connection) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.err != nil {
+		return r.err
+	}
+	if r.failApply > 0 {
+		r.failApply--
+		return errors.New("disk I/O error")
+	}
+	for _, change := range changes {
+		r.applyChange(change)
+	}
+	r.connections[connectionKey(connection.ApiUrl, connection.StoreId, connection.Type)] = connection
+	return nil
+}
+
+func (r *fakeRepo) GetConnection(apiUrl, storeId string) *db.Connection {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var latest *db.Connection
+	for _, connection := range r.connections {
+		if connection.ApiUrl == apiUrl && connection.StoreId == storeId && (latest == nil || connection.LastSync.After(latest.LastSync)) {
+			c := connection
+			latest = &c
+		}
+	}
+	return latest
+}
+
+func (r *fakeRepo) GetContinuationToken(apiUrl, storeId, objectType string) *string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	connection, found := r.connections[connectionKey(apiUrl, storeId, objectType)]
+	if !found {
+		return nil
+	}
+	return &connection.ContinuationToken
+}
+
+func (r *fakeRepo) UpsertConnection(connection db.Connection) error {
+	return r.ApplyChanges(nil, connection)
+}
+
+func (r *fakeRepo) ScopeTypes(storeId string, types []string) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.err != nil {
+		return 0, r.err
+	}
+	scopes := map[string]bool{}
+	for _, objectType := range types {
+		scopes[objectType] = true
+	}
+	for key, connection := range r.connections {
+		if connection.StoreId == storeId && ((len(types) == 0 && connection.Type != "") || (len(types) > 0 && !scopes[connection.Type])) {
+			delete(r.connections, key)
+		}
+	}
+	dropped := 0
+	for tupleKey, tuple := range r.tuples {
+		if len(types) > 0 && !scopes[tuple.ObjectType] {
+			delete(r.tuples, tupleKey)
+			dropped++
+		}
+	}
+	return dropped, nil
+}
+
+func (r *fakeRepo) RecordSyncEvent(event db.SyncEvent) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.err != nil {
+		return r.err
+	}
+	r.events = append(r.events, event)
+	return nil
+}
+
+func (r *fakeRepo) GetSyncEvents(storeId string) ([]db.SyncEvent, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var events []db.SyncEvent
+	for i := len(r.events) - 1; i >= 0; i-- {
+		if r.events[i].StoreId == storeId {
+			events = append(events, r.events[i])
+		}
+	}
+	return events, r.err
+}
+
+func (r *fakeRepo) ResetContinuationTokens(storeId string, types []string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.err != nil {
+		return r.err
+	}
+	for key, connection := range r.connections {
+		for _, objectType := range types {
+			if connection.StoreId == storeId && connection.Type == objectType {
+				delete(r.connections, key)
+			}
+		}
+	}
+	return nil
+}
+
+func (r *fakeRepo) ElectSyncer(context.Context, string, string) (bool, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return !r.notElected && r.err == nil, r.err
+}
+
+func (r *fakeRepo) EnableHistory(bool) {}
+
+func (r *fakeRepo) Close() error {
+	return nil
+}
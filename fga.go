@@ -5,33 +5,81 @@ import (
 	"fmt"
 	openfga "github.com/openfga/go-sdk"
 	"github.com/paulosuzart/fgamanager/db"
-	"log"
+	"log/slog"
 	"strings"
 	"time"
 )
 
-func create(ctx context.Context, tupleKey string) {
+const (
+	// maxTuplesPerWrite is the default limit of tuples OpenFGA accepts in a single Write
+	maxTuplesPerWrite = 100
+	// catchUpBatch is how many changes catch-up applies per transaction
+	catchUpBatch = 1000
+)
+
+func parseTupleKey(tupleKey string) (*openfga.TupleKey, error) {
 	keyParts := strings.Split(tupleKey, " ")
 	if len(keyParts) != 3 {
-		log.Printf("Unable to create tuple %v", tupleKey)
+		return nil, fmt.Errorf("tuple %q is not in the form 'user relation object'", tupleKey)
+	}
+	return openfga.NewTupleKey(keyParts[0], keyParts[1], keyParts[2]), nil
+}
+
+func create(ctx context.Context, fga fgaService, tupleKey string) {
+	key, err := parseTupleKey(tupleKey)
+	if err != nil {
+		slog.Warn("Unable to create tuple", "operation", "write", "tuple", tupleKey, "err", err)
 		return
 	}
-	user := keyParts[0]
-	relation := keyParts[1]
-	object := keyParts[2]
-	key := openfga.NewTupleKey(user, relation, object)
 	tuple := openfga.NewWriteRequestWrites([]openfga.TupleKey{*key})
 
-	err := fga.write(ctx, tuple)
+	_, err = fga.write(ctx, tuple)
 
 	if err != nil {
-		log.Printf("Error writing tuple: %v", err)
+		slog.Error("Error writing tuple", "operation", "write", "tuple", tupleKey, "err", err)
 	}
 }
 
-func deleteMarked(ctx context.Context) {
+// applyPlan sends writes and then deletes in batches OpenFGA accepts, stopping at the first failure
+func applyPlan(ctx context.Context, fga fgaService, writes, deletes []string) error {
+	for start := 0; start < len(writes); start += maxTuplesPerWrite {
+		var keys []openfga.TupleKey
+		for _, tupleKey := range writes[start:min(start+maxTuplesPerWrite, len(writes))] {
+			key, err := parseTupleKey(tupleKey)
+			if err != nil {
+				return err
+			}
+			keys = append(keys, *key)
+		}
+		if _, err := fga.write(ctx, openfga.NewWriteRequestWrites(keys)); err != nil {
+			return fmt.Errorf("failed writing %v tuples after %v: %w", len(keys), start, err)
+		}
+		slog.Info("Plan wrote tuples", "operation", "write", "count", len(keys))
+	}
+	for start := 0; start < len(deletes); start += maxTuplesPerWrite {
+		var keys []openfga.TupleKeyWithoutCondition
+		for _, tupleKey := range deletes[start:min(start+maxTuplesPerWrite, len(deletes))] {
+			key, err := parseTupleKey(tupleKey)
+			if err != nil {
+				return err
+			}
+			keys = append(keys, openfga.TupleKeyWithoutCondition{User: key.User, Relation: key.Relation, Object: key.Object})
+		}
+		if _, err := fga.delete(ctx, keys); err != nil {
+			return fmt.Errorf("failed deleting %v tuples after %v: %w", len(keys), start, err)
+		}
+		slog.Info("Plan deleted tuples", "operation", "delete", "count", len(keys))
+	}
+	return nil
+}
+
+// deleteMarked sends the deletions marked by owner through fga, so they are audited as sent by who marked them
+func deleteMarked(ctx context.Context, repo db.TupleRepository, owner string, fga fgaService, logger *slog.Logger, metrics *storeMetrics) {
 	for {
-		results := db.Repository.GetMarkedForDeletion()
+		results, err := repo.GetMarkedForDeletion(owner)
+		if err != nil {
+			logger.Error("Failed to load the tuples marked for deletion", "operation", "delete", "err", err)
+		}
 		if results != nil {
 			for _, tuple := range results {
 				deleteTuple := openfga.TupleKeyWithoutCondition{
@@ -41,93 +89,153 @@ func deleteMarked(ctx context.Context) {
 				}
 				deletes := []openfga.TupleKeyWithoutCondition{deleteTuple}
 				resp, err := fga.delete(ctx, deletes)
-				if err != nil && resp.StatusCode != 200 {
-					log.Printf("Error deleting tuples %v: %v", err, resp)
+				failed := err != nil && (resp == nil || resp.StatusCode != 200)
+				if failed {
+					logger.Error("Error deleting tuple", "operation", "delete", "tuple", tuple.TupleKey, "err", err)
 				}
+				metrics.delete(!failed)
 
-				if resp.StatusCode == 400 {
-					log.Printf("Mark tuple as stale %v", deleteTuple)
-					db.MarkStale(tuple.TupleKey)
+				if resp != nil && resp.StatusCode == 400 {
+					logger.Warn("Marking tuple as stale", "operation", "stale", "tuple", tuple.TupleKey)
+					if err := repo.MarkStale(tuple.TupleKey); err != nil {
+						logger.Error("Failed to mark tuple as stale", "operation", "stale", "tuple", tuple.TupleKey, "err", err)
+					}
 				}
 			}
 
 		}
-		time.Sleep(10 * time.Second)
+		if !wait(ctx, 10*time.Second) {
+			return
+		}
 	}
 }
 
-func read(ctx context.Context, watchUpdatesChan chan WatchUpdate) {
+// read keeps the replica in sync with the changes of the store until ctx is done or the sync fails
+// for good. Failures that may go away are retried with backoff.
+// While pages come full, read catches up: it asks for the largest pages, fetches them back to back and
+// applies up to catchUpBatch changes per transaction.
+// objectType scopes the sync to the changes of a type with a continuation token of its own, every type
+// is synced when it's empty
+func read(ctx context.Context, s *store, objectType string, watchUpdatesChan chan WatchUpdate) {
+	update := WatchUpdate{Store: s, Type: objectType, Status: syncStatus{State: catchingUp}}
+	token := s.repo.GetContinuationToken(s.ApiUrl, s.StoreId, objectType)
+	catchUp := true
+	catchUpStarted := time.Now()
+	applied := 0
+	// pending are fetched but not applied yet, token is the position after them
+	var pending []openfga.TupleChange
 	for {
-		var lastWatchUpdate *WatchUpdate
-		token := db.GetContinuationToken(fgaClient.GetConfig().ApiUrl, fgaClient.GetStoreId())
-		request := fgaClient.OpenFgaApi.ReadChanges(ctx).PageSize(50)
+		pageSize := s.PageSize
+		if catchUp {
+			pageSize = maxPageSize
+		}
+		request := s.client.OpenFgaApi.ReadChanges(ctx).PageSize(pageSize)
+		if objectType != "" {
+			request = request.Type_(objectType)
+		}
 		if token != nil {
 			request = request.ContinuationToken(*token)
 		}
-		resp, _, err := request.Execute()
-
-		if err != nil {
-			log.Printf("Failure on change fetch: %v", err)
-			errStr := fmt.Sprintf("%v", err)
-			if lastWatchUpdate != nil {
-				lastWatchUpdate.WatchEnabled = "Error"
-				watchUpdatesChan <- *lastWatchUpdate
-			} else {
-				lastWatchUpdate = &WatchUpdate{
-					Token:        &errStr,
-					Writes:       -1,
-					Deletes:      -1,
-					WatchEnabled: "true",
-				}
-				watchUpdatesChan <- *lastWatchUpdate
-				continue
-			}
-		}
+		requested := time.Now()
+		resp, httpResponse, err := request.Execute()
+		s.metrics.read(objectType, time.Since(requested), err)
 
+		var changes []openfga.TupleChange
 		writes := 0
 		deletes := 0
-		err = db.Transact(func() {
-			db.UpsertConnection(db.Connection{
-				ApiUrl:            fgaClient.GetConfig().ApiUrl,
-				StoreId:           fgaClient.GetStoreId(),
-				ContinuationToken: resp.GetContinuationToken(),
-				LastSync:          time.Now(),
-			})
+		if err == nil {
+			changes = resp.GetChanges()
+			newToken := resp.GetContinuationToken()
+			token = &newToken
+			pending = append(pending, changes...)
+			full := len(changes) == int(pageSize)
+			if full && !catchUp {
+				catchUp = true
+				catchUpStarted = time.Now()
+				applied = 0
+			}
+			catchUp = full
+			if full && len(pending) < catchUpBatch {
+				continue
+			}
 
-			for _, c := range resp.GetChanges() {
-				db.Repository.ApplyChange(c)
+			for _, c := range pending {
 				if c.GetOperation() == openfga.WRITE {
 					writes++
 				} else if c.GetOperation() == openfga.DELETE {
 					deletes++
 				}
 			}
-		})
-		if err != nil {
-			log.Printf("Failure on change fetch: %v", err)
-			errStr := fmt.Sprintf("%v", err)
-			if lastWatchUpdate != nil {
-				lastWatchUpdate.WatchEnabled = "Error"
-				watchUpdatesChan <- *lastWatchUpdate
+			err = s.repo.ApplyChanges(pending, db.Connection{
+				ApiUrl:            s.ApiUrl,
+				StoreId:           s.StoreId,
+				Type:              objectType,
+				ContinuationToken: newToken,
+				LastSync:          time.Now(),
+			})
+			if err == nil {
+				applied += len(pending)
+				s.metrics.apply(writes, deletes)
+				if len(pending) > 0 {
+					s.bus.publish(newChangeEvent(s, pending))
+				}
 			} else {
-				lastWatchUpdate = &WatchUpdate{
-					Token:        &errStr,
-					Writes:       -1,
-					Deletes:      -1,
-					WatchEnabled: "true",
+				// nothing was applied, start over from the saved position
+				token = s.repo.GetContinuationToken(s.ApiUrl, s.StoreId, objectType)
+			}
+			pending = nil
+			// the replica failed, not the server
+			httpResponse = nil
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err != nil {
+			status := &update.Status
+			status.Failures++
+			status.LastError = err.Error()
+			delay := s.backoff.delay(status.Failures)
+			switch {
+			case tokenRejected(err):
+				status.State = rejected
+				event := db.SyncEvent{Timestamp: time.Now(), ApiUrl: s.ApiUrl, StoreId: s.StoreId, Type: objectType,
+					Event: db.TokenRejected, Reason: err.Error()}
+				if token != nil {
+					event.ContinuationToken = *token
 				}
-				watchUpdatesChan <- *lastWatchUpdate
-				continue
+				if err := s.repo.RecordSyncEvent(event); err != nil {
+					s.log.Error("Failed to record sync event", "operation", "sync", "type", objectType, "err", err)
+				}
+			case retryable(httpResponse, err):
+				status.State = backingOff
+				status.RetryAt = time.Now().Add(delay)
+			default:
+				status.State = failed
+			}
+			s.log.Error("Failure on change fetch", "operation", "sync", "type", objectType, "state", status.State.String(), "failures", status.Failures, "err", err)
+			s.publish(update, watchUpdatesChan)
+			if status.State == failed || status.State == rejected || !wait(ctx, delay) {
+				return
 			}
+			continue
+		}
+
+		status := syncStatus{State: caughtUp, LastError: update.Status.LastError, LastSuccess: time.Now()}
+		if catchUp {
+			status.State = catchingUp
+			status.Applied = applied
+			status.Rate = float64(applied) / time.Since(catchUpStarted).Seconds()
+		} else if len(changes) > 0 {
+			status.State = syncing
+		}
+		update = WatchUpdate{Store: s, Type: objectType, Token: token, Writes: writes, Deletes: deletes, Status: status}
+		s.publish(update, watchUpdatesChan)
+		if catchUp {
+			continue
 		}
-		lastWatchUpdate = &WatchUpdate{
-			Token:        token,
-			Writes:       writes,
-			Deletes:      deletes,
-			WatchEnabled: "true",
+		if !wait(ctx, s.SyncInterval) {
+			return
 		}
-		watchUpdatesChan <- *lastWatchUpdate
-		time.Sleep(2 * time.Second)
 	}
-
 }
@@ -2,9 +2,16 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	openfga "github.com/openfga/go-sdk"
 	"github.com/paulosuzart/fgamanager/db"
+	"log/slog"
 	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -14,12 +21,23 @@ type mockRepo struct {
 	GetMarkedForDeletionFunc func() []db.Tuple
 }
 
-func (r mockRepo) GetMarkedForDeletion() []db.Tuple {
-	return r.GetMarkedForDeletionFunc()
+func (r mockRepo) GetMarkedForDeletion(_ string) ([]db.Tuple, error) {
+	return r.GetMarkedForDeletionFunc(), nil
 }
 
-func (r mockRepo) CountTuples(_ *db.Filter) int {
-	return 0
+func (r mockRepo) CountTuples(_ *db.Filter) (int, error) {
+	return 0, nil
+}
+
+// openReplica opens a replica closed once the test is done
+func openReplica(t *testing.T, dataSource string) *db.SqlxRepository {
+	t.Helper()
+	repo, err := db.Open(dataSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = repo.Close() })
+	return repo
 }
 
 type mockFga struct {
@@ -32,13 +50,13 @@ func (m mockFga) delete(ctx context.Context, deletes []openfga.TupleKeyWithoutCo
 	return m.deleteFunc(ctx, deletes)
 }
 
-func (m mockFga) write(ctx context.Context, tuple *openfga.WriteRequestWrites) error {
-	return m.writeFunc(ctx, tuple)
+func (m mockFga) write(ctx context.Context, tuple *openfga.WriteRequestWrites) (*http.Response, error) {
+	return nil, m.writeFunc(ctx, tuple)
 }
 
 func Test(t *testing.T) {
 
-	db.Repository = mockRepo{
+	repo := mockRepo{
 		GetMarkedForDeletionFunc: func() []db.Tuple {
 			return []db.Tuple{
 				{
@@ -54,7 +72,7 @@ func Test(t *testing.T) {
 	}
 	t.Run("Test Delete", func(t *testing.T) {
 		invokedChan := make(chan interface{})
-		fga = mockFga{deleteFunc: func(ctx context.Context, deletes []openfga.TupleKeyWithoutCondition) (*http.Response, error) {
+		fga := mockFga{deleteFunc: func(ctx context.Context, deletes []openfga.TupleKeyWithoutCondition) (*http.Response, error) {
 			if len(deletes) == 0 {
 				t.Error("At least one tuple for deletion is expected")
 			}
@@ -65,22 +83,23 @@ func Test(t *testing.T) {
 			return &http.Response{StatusCode: 200}, nil
 		}}
 		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-		go deleteMarked(ctx)
+		go deleteMarked(ctx, repo, "jack@test", fga, slog.Default(), nil)
 		<-invokedChan
 		cancel()
 	})
 
 	t.Run("Test Write valid tuple string", func(t *testing.T) {
 		var called = false
-		fga = mockFga{writeFunc: func(ctx context.Context, tuple *openfga.WriteRequestWrites) error {
+		fga := mockFga{writeFunc: func(ctx context.Context, tuple *openfga.WriteRequestWrites) error {
 			if tuple == nil {
 				t.Fatal("Tuple to be written can't be null. One tuple expected")
 			}
 			called = true
 			return nil
 		}}
-		ctx, _ := context.WithTimeout(context.Background(), 3*time.Second)
-		create(ctx, "folder:zoo owner doc:turtles")
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		create(ctx, fga, "folder:zoo owner doc:turtles")
 		if !called {
 			t.Error("No write not called")
 		}
@@ -89,18 +108,108 @@ func Test(t *testing.T) {
 
 	t.Run("Test Write invalid tuple string", func(t *testing.T) {
 		var called = false
-		fga = mockFga{writeFunc: func(ctx context.Context, tuple *openfga.WriteRequestWrites) error {
+		fga := mockFga{writeFunc: func(ctx context.Context, tuple *openfga.WriteRequestWrites) error {
 			if tuple == nil {
 				t.Fatal("Tuple to be written can't be null. One tuple expected")
 			}
 			called = true
 			return nil
 		}}
-		ctx, _ := context.WithTimeout(context.Background(), 3*time.Second)
-		create(ctx, "folder:zoo owner h doc:turtles")
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		create(ctx, fga, "folder:zoo owner h doc:turtles")
 		if called {
 			t.Error("Write should not be called for invalid tuple")
 		}
 
 	})
+
+	t.Run("Test apply plan in batches", func(t *testing.T) {
+		var writes, deletes []int
+		fga := mockFga{
+			writeFunc: func(ctx context.Context, tuple *openfga.WriteRequestWrites) error {
+				writes = append(writes, len(tuple.TupleKeys))
+				return nil
+			},
+			deleteFunc: func(ctx context.Context, keys []openfga.TupleKeyWithoutCondition) (*http.Response, error) {
+				deletes = append(deletes, len(keys))
+				return &http.Response{StatusCode: 200}, nil
+			}}
+		var toWrite []string
+		for i := 0; i < 150; i++ {
+			toWrite = append(toWrite, fmt.Sprintf("user:%v member group:staff", i))
+		}
+		err := applyPlan(context.Background(), fga, toWrite, []string{"user:jack member group:boss"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(writes, []int{100, 50}) || !reflect.DeepEqual(deletes, []int{1}) {
+			t.Errorf("Unexpected batches, writes %v deletes %v", writes, deletes)
+		}
+	})
+
+	t.Run("Test apply plan stops on invalid tuple", func(t *testing.T) {
+		fga := mockFga{writeFunc: func(ctx context.Context, tuple *openfga.WriteRequestWrites) error {
+			t.Error("Nothing must be written")
+			return nil
+		}}
+		if err := applyPlan(context.Background(), fga, []string{"user:jack member"}, nil); err == nil {
+			t.Error("Expected an error for an invalid tuple")
+		}
+	})
+
+	t.Run("Test read only store refuses writes and deletes", func(t *testing.T) {
+		fga := newFgaService(storeConfig{ReadOnly: true}, nil, nil, nil)
+		if err := applyPlan(context.Background(), fga, []string{"user:jack member org:acme"}, nil); !errors.Is(err, errReadOnly) {
+			t.Errorf("Expected a read only error, got %v", err)
+		}
+		if err := applyPlan(context.Background(), fga, nil, []string{"user:jack member org:acme"}); !errors.Is(err, errReadOnly) {
+			t.Errorf("Expected a read only error, got %v", err)
+		}
+		if _, writable := newFgaService(storeConfig{}, nil, nil, nil).(*auditedFga); !writable {
+			t.Error("Expected a writable service")
+		}
+	})
+
+	t.Run("Test writes and deletes are audited", func(t *testing.T) {
+		replica := openReplica(t, ":memory:")
+		journalPath := filepath.Join(t.TempDir(), "audit.jsonl")
+		journal, err := openAuditJournal(journalPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer journal.close()
+
+		fga := &auditedFga{
+			inner: mockFga{
+				writeFunc: func(ctx context.Context, tuple *openfga.WriteRequestWrites) error {
+					return nil
+				},
+				deleteFunc: func(ctx context.Context, deletes []openfga.TupleKeyWithoutCondition) (*http.Response, error) {
+					return &http.Response{StatusCode: 400, Status: "400 Bad Request"}, fmt.Errorf("invalid tuple")
+				},
+			},
+			config:  storeConfig{Name: "prod", ApiUrl: "http://localhost:8087", StoreId: "01HME1"},
+			repo:    replica,
+			journal: journal,
+		}
+		if err := applyPlan(context.Background(), fga, []string{"user:jack member org:acme"}, []string{"user:jill member org:acme"}); err == nil {
+			t.Error("Expected the delete to fail")
+		}
+
+		entries, _ := replica.GetAuditLog()
+		if len(entries) != 2 {
+			t.Fatalf("Expected 2 entries, got %v", len(entries))
+		}
+		if d := entries[0]; d.Operation != "delete" || d.StatusCode != 400 || d.Response != "invalid tuple" || d.Profile != "prod" || d.Operator == "" {
+			t.Errorf("Unexpected delete entry %+v", d)
+		}
+		if w := entries[1]; w.Operation != "write" || !reflect.DeepEqual([]string(w.TupleKeys), []string{"user:jack member org:acme"}) {
+			t.Errorf("Unexpected write entry %+v", w)
+		}
+		lines, _ := os.ReadFile(journalPath)
+		if strings.Count(string(lines), "\n") != 2 {
+			t.Errorf("Expected 2 journal lines, got %v", string(lines))
+		}
+	})
 }
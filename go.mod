@@ -7,9 +7,11 @@ require (
 	github.com/gdamore/tcell/v2 v2.7.0
 	github.com/ggwhite/go-masker v1.1.0
 	github.com/jmoiron/sqlx v1.3.5
+	github.com/lib/pq v1.10.9
 	github.com/mattn/go-sqlite3 v1.14.22
 	github.com/openfga/go-sdk v0.3.5
 	github.com/rivo/tview v0.0.0-20240204151237-861aa94d61c8
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gdamore/tcell/v2"
+	"github.com/paulosuzart/fgamanager/db"
+	"github.com/rivo/tview"
+	"time"
+)
+
+// asOfLayouts are the accepted formats for the "As of" filter, local time unless a zone is given
+var asOfLayouts = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"}
+
+func parseAsOf(text string) (*time.Time, error) {
+	for _, layout := range asOfLayouts {
+		if asOf, err := time.ParseInLocation(layout, text, time.Local); err == nil {
+			return &asOf, nil
+		}
+	}
+	return nil, fmt.Errorf("%q is not a valid time, use YYYY-MM-DD hh:mm:ss", text)
+}
+
+// historyView is a full screen page listing changes of a tuple or an object
+type historyView struct {
+	*tview.Table
+}
+
+func newHistoryView(onDone func()) *historyView {
+	table := tview.NewTable().SetSelectable(true, false).SetFixed(1, 0)
+	table.SetBorder(true)
+	table.SetDoneFunc(func(key tcell.Key) {
+		if key == tcell.KeyEscape {
+			onDone()
+		}
+	})
+	return &historyView{Table: table}
+}
+
+func (h *historyView) show(title string, changes []db.TupleChange) {
+	h.Clear()
+	h.SetTitle(fmt.Sprintf(" History of %v (%v changes) - <esc> to return ", title, len(changes)))
+	for column, header := range []string{"TIMESTAMP ↓             ", "OPERATION ", "USER                           ", "RELATION              ", "OBJECT                         "} {
+		h.SetCell(0, column, tview.NewTableCell(header).SetSelectable(false))
+	}
+	if len(changes) == 0 {
+		h.SetCell(1, 0, tview.NewTableCell("No changes recorded, is --history enabled?").SetSelectable(false))
+	}
+	for i, change := range changes {
+		row := i + 1
+		operation := tview.NewTableCell(change.Operation).SetTextColor(tcell.ColorLightGreen)
+		if change.Operation == Delete.String() {
+			operation.SetTextColor(tcell.ColorLightCoral)
+		}
+		h.SetCell(row, 0, tview.NewTableCell(change.Timestamp.String()).SetTextColor(tcell.ColorLightCyan))
+		h.SetCell(row, 1, operation)
+		h.SetCell(row, 2, tview.NewTableCell(change.UserType+":"+change.UserId).SetTextColor(tcell.ColorLightCyan))
+		h.SetCell(row, 3, tview.NewTableCell(change.Relation).SetTextColor(tcell.ColorLightCyan))
+		h.SetCell(row, 4, tview.NewTableCell(change.ObjectType+":"+change.ObjectId).SetTextColor(tcell.ColorLightCyan))
+	}
+	h.ScrollToBeginning()
+	h.Select(1, 0)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logRingSize is how many records the log page keeps
+const logRingSize = 1000
+
+// logEntry is a log record as the log page shows it
+type logEntry struct {
+	Time    time.Time
+	Level   slog.Level
+	Message string
+	Attrs   string
+}
+
+// logRing keeps the latest log records in memory for the log page
+type logRing struct {
+	lock    sync.Mutex
+	entries []logEntry
+	next    int
+	// added counts every record ever added, the log page uses it to know when to refresh
+	added int
+}
+
+func newLogRing(size int) *logRing {
+	return &logRing{entries: make([]logEntry, 0, size)}
+}
+
+func (r *logRing) add(entry logEntry) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if len(r.entries) < cap(r.entries) {
+		r.entries = append(r.entries, entry)
+	} else {
+		r.entries[r.next] = entry
+		r.next = (r.next + 1) % len(r.entries)
+	}
+	r.added++
+}
+
+// count is how many records were ever added
+func (r *logRing) count() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.added
+}
+
+// list returns the records at minLevel or above, oldest first, and how many were ever added
+func (r *logRing) list(minLevel slog.Level) ([]logEntry, int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var entries []logEntry
+	for i := range r.entries {
+		entry := r.entries[(r.next+i)%len(r.entries)]
+		if entry.Level >= minLevel {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, r.added
+}
+
+// ringHandler sends records to the log file handler and keeps a copy in the ring
+type ringHandler struct {
+	slog.Handler
+	ring *logRing
+	// attrs and group were given to WithAttrs and WithGroup, already formatted
+	attrs []string
+	group string
+}
+
+func (h *ringHandler) Handle(ctx context.Context, record slog.Record) error {
+	attrs := append([]string(nil), h.attrs...)
+	record.Attrs(func(a slog.Attr) bool {
+		attrs = append(attrs, h.group+a.String())
+		return true
+	})
+	h.ring.add(logEntry{Time: record.Time, Level: record.Level, Message: record.Message, Attrs: strings.Join(attrs, " ")})
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h *ringHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	formatted := append([]string(nil), h.attrs...)
+	for _, a := range attrs {
+		formatted = append(formatted, h.group+a.String())
+	}
+	return &ringHandler{Handler: h.Handler.WithAttrs(attrs), ring: h.ring, attrs: formatted, group: h.group}
+}
+
+func (h *ringHandler) WithGroup(name string) slog.Handler {
+	return &ringHandler{Handler: h.Handler.WithGroup(name), ring: h.ring, attrs: h.attrs, group: h.group + name + "."}
+}
+
+// parseLogLevel accepts debug, info, warn and error
+func parseLogLevel(text string) (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(text))
+	return level, err
+}
+
+// defaultLogPath keeps the log of each user apart, in $XDG_STATE_HOME
+func defaultLogPath(getenv func(string) string) string {
+	base := getenv("XDG_STATE_HOME")
+	if base == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return filepath.Join(os.TempDir(), fmt.Sprintf("fgamanager-%v.log", os.Getuid()))
+		}
+		base = filepath.Join(home, ".local", "state")
+	}
+	return filepath.Join(base, "fgamanager", "fgamanager.log")
+}
+
+// setupLogging makes slog, and the log package through it, write to the log file and the ring
+func setupLogging(config *settings, ring *logRing) (io.Closer, error) {
+	if err := os.MkdirAll(filepath.Dir(config.LogFile), 0700); err != nil {
+		return nil, err
+	}
+	logFile, err := os.OpenFile(config.LogFile, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	level, _ := parseLogLevel(config.LogLevel)
+	options := &slog.HandlerOptions{Level: level, AddSource: level <= slog.LevelDebug}
+	var handler slog.Handler = slog.NewJSONHandler(logFile, options)
+	if config.LogFormat == "text" {
+		handler = slog.NewTextHandler(logFile, options)
+	}
+	slog.SetDefault(slog.New(&ringHandler{Handler: handler, ring: ring}))
+	return logFile, nil
+}
+
+var levelColors = map[slog.Level]string{
+	slog.LevelDebug: "gray",
+	slog.LevelInfo:  "white",
+	slog.LevelWarn:  "orange",
+	slog.LevelError: "red",
+}
+
+// logView is a full screen page tailing the latest log records
+type logView struct {
+	*tview.TextView
+	ring     *logRing
+	minLevel slog.Level
+	shown    int
+}
+
+func newLogView(ring *logRing, onDone func()) *logView {
+	v := &logView{
+		TextView: tview.NewTextView().SetDynamicColors(true).SetScrollable(true),
+		ring:     ring,
+		minLevel: slog.LevelInfo,
+	}
+	v.SetBorder(true)
+	v.SetDoneFunc(func(key tcell.Key) {
+		if key == tcell.KeyEscape {
+			onDone()
+		}
+	})
+	v.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		levels := map[rune]slog.Level{'d': slog.LevelDebug, 'i': slog.LevelInfo, 'w': slog.LevelWarn, 'e': slog.LevelError}
+		if level, found := levels[event.Rune()]; found {
+			v.minLevel = level
+			v.refresh(true)
+			return nil
+		}
+		return event
+	})
+	return v
+}
+
+// refresh shows new records and follows the tail, unless nothing was added since the last time
+func (v *logView) refresh(force bool) {
+	entries, added := v.ring.list(v.minLevel)
+	if !force && added == v.shown {
+		return
+	}
+	v.shown = added
+	v.SetTitle(fmt.Sprintf(" Log, %v and above - <d/i/w/e> to change the level, <esc> to return ", v.minLevel))
+	var text strings.Builder
+	for _, entry := range entries {
+		color := levelColors[entry.Level]
+		if color == "" {
+			color = "white"
+		}
+		_, _ = fmt.Fprintf(&text, "[gray]%v [%v]%-5v[white] %v [lightcyan]%v[white]\n",
+			entry.Time.Format(time.TimeOnly), color, entry.Level, tview.Escape(entry.Message), tview.Escape(entry.Attrs))
+	}
+	v.SetText(text.String())
+	v.ScrollToEnd()
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"testing"
+)
+
+func TestLogRing(t *testing.T) {
+	ring := newLogRing(3)
+	var out bytes.Buffer
+	logger := slog.New(&ringHandler{Handler: slog.NewJSONHandler(&out, &slog.HandlerOptions{Level: slog.LevelDebug}), ring: ring})
+	storeLogger := logger.With("store_id", "01HME1").WithGroup("sync")
+
+	logger.Debug("first")
+	logger.Info("second")
+	storeLogger.Warn("third", "operation", "read")
+	logger.Error("fourth")
+
+	entries, added := ring.list(slog.LevelDebug)
+	if added != 4 || len(entries) != 3 {
+		t.Fatalf("Expected 3 of 4 entries kept, got %v of %v", len(entries), added)
+	}
+	if entries[0].Message != "second" || entries[2].Message != "fourth" {
+		t.Errorf("Expected the latest entries oldest first, got %+v", entries)
+	}
+	if entries[1].Attrs != "store_id=01HME1 sync.operation=read" {
+		t.Errorf("Unexpected attrs %q", entries[1].Attrs)
+	}
+	if warnings, _ := ring.list(slog.LevelWarn); len(warnings) != 2 {
+		t.Errorf("Expected 2 entries at warn and above, got %v", len(warnings))
+	}
+
+	lines := bytes.Split(bytes.TrimSpace(out.Bytes()), []byte("\n"))
+	if len(lines) != 4 {
+		t.Fatalf("Every record must reach the log file, got %v", len(lines))
+	}
+	var record map[string]interface{}
+	if err := json.Unmarshal(lines[2], &record); err != nil {
+		t.Fatal(err)
+	}
+	if record["store_id"] != "01HME1" || record["sync"].(map[string]interface{})["operation"] != "read" {
+		t.Errorf("Unexpected record %v", record)
+	}
+}
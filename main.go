@@ -2,72 +2,121 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/akamensky/argparse"
 	openfga "github.com/openfga/go-sdk"
 	"github.com/paulosuzart/fgamanager/db"
 	"github.com/rivo/tview"
-	"log"
+	"log/slog"
 	"net/http"
-	"net/url"
 	"os"
+	"strings"
 	"testing"
 )
 
 var (
-	parser     = argparse.NewParser("fgamanager", "fgamanager")
-	apiUrl     = parser.String("a", "apiUrl", &argparse.Options{Default: "http://localhost:8087", Help: "OpenFGA API Url"})
-	storeId    = parser.String("s", "storeId", &argparse.Options{Required: true, Help: "The Store Id to connect to"})
-	pruneStale = parser.Flag("p", "prune", &argparse.Options{Required: false, Default: false, Help: "Causes fgamanager to prune stale entries on startup"})
+	parser      = argparse.NewParser("fgamanager", "fgamanager")
+	apiUrl      = parser.String("a", "apiUrl", &argparse.Options{Help: "OpenFGA API Url. Default: " + defaultApiUrl})
+	storeIds    = parser.StringList("s", "storeId", &argparse.Options{Help: "The Store Id to connect to, as [name=]storeId[@apiUrl]. Repeat it to manage several stores, leave it out to pick one"})
+	configPath  = parser.String("c", "config", &argparse.Options{Help: "Config file with the connection profiles. Default: $XDG_CONFIG_HOME/fgamanager/config.yaml"})
+	profiles    = parser.StringList("P", "profile", &argparse.Options{Help: "Profile of the config file to connect to. Repeat it to manage several stores"})
+	pruneStale  = parser.Flag("p", "prune", &argparse.Options{Required: false, Default: false, Help: "Causes fgamanager to prune stale entries on startup"})
+	keepHistory = parser.Flag("H", "history", &argparse.Options{Required: false, Default: false, Help: "Keeps every change in a local history, required for as of filters"})
+	readOnly    = parser.Flag("", "read-only", &argparse.Options{Required: false, Default: false, Help: "Refuses every write and delete, for every store"})
+	objectTypes = parser.StringList("t", "type", &argparse.Options{Help: "Object type to replicate. Repeat it to replicate several types, leave it out to replicate every type"})
+	logFilePath = parser.String("", "log-file", &argparse.Options{Help: "Log file. Default: $XDG_STATE_HOME/fgamanager/fgamanager.log"})
+	logLevel    = parser.Selector("", "log-level", []string{"debug", "info", "warn", "error"}, &argparse.Options{Help: "Lowest level logged. Default: info"})
+	logFormat   = parser.Selector("", "log-format", []string{"json", "text"}, &argparse.Options{Help: "Format of the log file. Default: json"})
+	auditFile   = parser.String("", "audit-file", &argparse.Options{Help: "Also appends every write and delete sent to OpenFGA to this JSON lines file"})
+
+	tuiCommand  = parser.NewCommand("tui", "Browses and manages the store tuples. The default command")
+	diffCommand = parser.NewCommand("diff", "Compares two replicas or a replica and an exported tuple file")
+	diffLeft    = diffCommand.String("l", "left", &argparse.Options{Default: "fga.db", Help: "Source replica or exported tuple file"})
+	diffRight   = diffCommand.String("r", "right", &argparse.Options{Required: true, Help: "Target replica or exported tuple file"})
+	diffPlan    = diffCommand.Flag("", "plan", &argparse.Options{Help: "Prints the writes and deletes making right match left instead of opening the diff view"})
+	diffApply   = diffCommand.Flag("", "apply", &argparse.Options{Help: "Applies the plan to the store given by --storeId after confirmation"})
+
+	auditCommand = parser.NewCommand("audit", "Exports the audit log of every write and delete sent from a replica as JSON lines")
+	auditDb      = auditCommand.String("d", "db", &argparse.Options{Default: "fga.db", Help: "Replica to export the audit log of"})
+	auditOutput  = auditCommand.String("o", "output", &argparse.Options{Help: "File to export to. Default: stdout"})
+
+	resyncCommand = parser.NewCommand("resync", "Rebuilds the replica of every store given from the Read endpoint")
+	verifyCommand = parser.NewCommand("verify", "Compares the replica of every store given with the Read endpoint and lists the missing and extra tuples")
+	verifySample  = verifyCommand.Int("n", "sample", &argparse.Options{Help: "Checks this many random replica tuples and first server tuples instead of every tuple"})
+
+	syncCommand    = parser.NewCommand("sync", "Keeps the replica of every store given in sync without the TUI, until interrupted")
+	metricsAddress = syncCommand.String("m", "metrics", &argparse.Options{Help: "Serves Prometheus metrics at /metrics on this address, like :9464"})
+
+	statsCommand = parser.NewCommand("stats", "Prints the tuple counts, top objects and users, sync rates and lag of the replica of every store given")
+	statsJson    = statsCommand.Flag("", "json", &argparse.Options{Help: "Prints the stats as JSON"})
+
+	snapshotCommand     = parser.NewCommand("snapshot", "Pushes the replica of every store given to S3 compatible storage, or pulls it back")
+	snapshotPushCommand = snapshotCommand.NewCommand("push", "Uploads a compressed copy of the replica, taken while it may be in use")
+	snapshotPullCommand = snapshotCommand.NewCommand("pull", "Downloads the replica, backing up the one in place. fgamanager must not have it open")
+	snapshotUrl         = snapshotCommand.String("u", "url", &argparse.Options{Required: true, Help: "Bucket and prefix of the snapshots, as s3://bucket/prefix"})
+	snapshotEndpoint    = snapshotCommand.String("e", "endpoint", &argparse.Options{Help: "S3 compatible endpoint, like http://localhost:9000 for MinIO. Default: $AWS_ENDPOINT_URL_S3 or AWS"})
+
+	storeCommand       = parser.NewCommand("store", "Lists, creates and deletes the stores at --apiUrl")
+	storeListCommand   = storeCommand.NewCommand("list", "Lists the stores")
+	storeCreateCommand = storeCommand.NewCommand("create", "Creates a store and prints its id")
+	storeCreateName    = storeCreateCommand.String("n", "name", &argparse.Options{Required: true, Help: "Name of the new store"})
+	storeDeleteCommand = storeCommand.NewCommand("delete", "Deletes a store after typing its name to confirm")
+	storeDeleteId      = storeDeleteCommand.String("i", "id", &argparse.Options{Required: true, Help: "Id of the store to delete"})
 )
 
+// withDefaultCommand keeps `fgamanager -s <storeId>` working by running tui when no command is given
+func withDefaultCommand(args []string) []string {
+	if len(args) > 1 && !strings.HasPrefix(args[1], "-") {
+		return args
+	}
+	return append([]string{args[0], tuiCommand.GetName()}, args[1:]...)
+}
+
 func init() {
 	if testing.Testing() {
-		testId := "TESTID"
-		storeId = &testId
 		return
 	}
-	err := parser.Parse(os.Args)
-	if err != nil {
-		fmt.Printf("Error: %v", err)
-		os.Exit(1)
+	if len(os.Args) == 2 && (os.Args[1] == "-h" || os.Args[1] == "--help") {
+		fmt.Print(parser.Usage(nil))
+		os.Exit(0)
 	}
-	if _, err := url.Parse(*apiUrl); err != nil {
-		panic("Api URL is malformed")
+	err := parser.Parse(withDefaultCommand(os.Args))
+	if err != nil {
+		fmt.Print(parser.Usage(err))
 		os.Exit(1)
 	}
 }
 
-var (
-	fgaClient *openfga.APIClient
-	fga       fgaService
-)
-
 type WatchUpdate struct {
+	// Store is where the update comes from and Type the object type synced, empty when every type is
+	Store           *store
+	Type            string
 	Writes, Deletes int
 	Token           *string
-	WatchEnabled    string
+	Status          syncStatus
 }
 
 type fgaService interface {
-	write(ctx context.Context, tuple *openfga.WriteRequestWrites) error
+	write(ctx context.Context, tuple *openfga.WriteRequestWrites) (*http.Response, error)
 	delete(ctx context.Context, deletes []openfga.TupleKeyWithoutCondition) (*http.Response, error)
 }
 
 type fgaWrapper struct {
 	fgaService
+	client *openfga.APIClient
 }
 
-func (f *fgaWrapper) write(ctx context.Context, tuple *openfga.WriteRequestWrites) error {
-	_, _, err := fgaClient.OpenFgaApi.Write(ctx).
+func (f *fgaWrapper) write(ctx context.Context, tuple *openfga.WriteRequestWrites) (*http.Response, error) {
+	_, resp, err := f.client.OpenFgaApi.Write(ctx).
 		Body(openfga.WriteRequest{
 			Writes: tuple,
 		}).Execute()
-	return err
+	return resp, err
 }
 
 func (f *fgaWrapper) delete(ctx context.Context, deletes []openfga.TupleKeyWithoutCondition) (*http.Response, error) {
-	_, resp, err := fgaClient.OpenFgaApi.
+	_, resp, err := f.client.OpenFgaApi.
 		Write(ctx).
 		Body(openfga.WriteRequest{
 			Deletes: &openfga.WriteRequestDeletes{
@@ -75,51 +124,184 @@ func (f *fgaWrapper) delete(ctx context.Context, deletes []openfga.TupleKeyWitho
 	return resp, err
 }
 
+var errReadOnly = errors.New("the store is read only")
+
+// readOnlyFga refuses every write and delete before it reaches the server
+type readOnlyFga struct {
+	fgaService
+}
+
+func (r *readOnlyFga) write(context.Context, *openfga.WriteRequestWrites) (*http.Response, error) {
+	return nil, errReadOnly
+}
+
+func (r *readOnlyFga) delete(context.Context, []openfga.TupleKeyWithoutCondition) (*http.Response, error) {
+	return nil, errReadOnly
+}
+
+// newFgaService is the only way to get a fgaService, so read only stores are enforced and
+// everything sent is audited on every path
+func newFgaService(config storeConfig, client *openfga.APIClient, audit db.AuditRepository, journal *auditJournal) fgaService {
+	if config.ReadOnly {
+		return &readOnlyFga{}
+	}
+	return &auditedFga{inner: &fgaWrapper{client: client}, config: config, repo: audit, journal: journal}
+}
+
 func main() {
-	// log to custom file
-	LOG_FILE := "/tmp/fgamanager.log"
-	// open log file
-	logFile, err := os.OpenFile(LOG_FILE, os.O_APPEND|os.O_RDWR|os.O_CREATE, 0644)
+	os.Exit(run())
+}
+
+// run returns the exit code instead of exiting, so the replicas, the audit journal and the log are always
+// closed and flushed and the terminal restored before fgamanager exits
+func run() int {
+	config, err := loadSettings(cliFlags{
+		ConfigPath: *configPath,
+		Profiles:   *profiles,
+		StoreIds:   *storeIds,
+		ApiUrl:     *apiUrl,
+		ReadOnly:   *readOnly,
+		Types:      *objectTypes,
+		AuditFile:  *auditFile,
+		LogFile:    *logFilePath,
+		LogLevel:   *logLevel,
+		LogFormat:  *logFormat,
+	}, os.Getenv)
 	if err != nil {
-		log.Panic(err)
+		fmt.Printf("Invalid configuration:\n%v\n", err)
+		return 1
 	}
-	defer func(logFile *os.File) {
-		err := logFile.Close()
-		if err != nil {
 
+	logs := newLogRing(logRingSize)
+	logFile, err := setupLogging(config, logs)
+	if err != nil {
+		fmt.Printf("Unable to open the log file %v: %v\n", config.LogFile, err)
+		return 1
+	}
+	defer func() { _ = logFile.Close() }()
+
+	if auditCommand.Happened() {
+		if err := runAuditExport(); err != nil {
+			slog.Error("Audit export failed", "err", err)
+			fmt.Printf("Error: %v\n", err)
+			return 1
 		}
-	}(logFile)
+		return 0
+	}
 
-	// Set log out put and enjoy :)
-	log.SetOutput(logFile)
+	journal, err := openAuditJournal(config.AuditFile)
+	if err != nil {
+		fmt.Printf("Unable to open the audit file %v: %v\n", config.AuditFile, err)
+		return 1
+	}
+	defer journal.close()
 
-	// optional: log date-time, filename, and line number
-	log.SetFlags(log.Lshortfile | log.LstdFlags)
+	if diffCommand.Happened() {
+		if err := runDiff(context.Background(), config.Stores, journal); err != nil {
+			slog.Error("Diff failed", "err", err)
+			fmt.Printf("Error: %v\n", err)
+			return 1
+		}
+		return 0
+	}
 
-	db.SetupDb()
-	defer db.Close()
+	if resyncCommand.Happened() {
+		if err := runResync(context.Background(), config.Stores); err != nil {
+			slog.Error("Resync failed", "err", err)
+			fmt.Printf("Error: %v\n", err)
+			return 1
+		}
+		return 0
+	}
 
-	if pruneStale != nil && *pruneStale {
-		log.Printf("Will prune stale entries...")
-		rowsAffected := db.Repository.Prune()
-		log.Printf("%v rows pruned", rowsAffected)
+	if verifyCommand.Happened() {
+		if err := runVerify(context.Background(), config.Stores, *verifySample); err != nil {
+			slog.Error("Verify failed", "err", err)
+			fmt.Printf("Error: %v\n", err)
+			return 1
+		}
+		return 0
 	}
 
-	configuration, err := openfga.NewConfiguration(openfga.Configuration{
-		ApiUrl:  *apiUrl,
-		StoreId: *storeId,
-	})
-	fgaClient = openfga.NewAPIClient(configuration)
-	fga = &fgaWrapper{}
+	if syncCommand.Happened() {
+		if err := runSync(config.Stores, journal, *metricsAddress); err != nil {
+			slog.Error("Sync failed", "err", err)
+			fmt.Printf("Error: %v\n", err)
+			return 1
+		}
+		return 0
+	}
 
-	if err != nil {
-		log.Panic("Unable to create openfga config")
+	if statsCommand.Happened() {
+		if err := runStats(context.Background(), config.Stores, *statsJson, os.Stdout); err != nil {
+			slog.Error("Stats failed", "err", err)
+			fmt.Printf("Error: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	if snapshotCommand.Happened() {
+		err := runSnapshot(context.Background(), config.Stores, *snapshotUrl, *snapshotEndpoint, snapshotPullCommand.Happened())
+		if err != nil {
+			slog.Error("Snapshot failed", "err", err)
+			fmt.Printf("Error: %v\n", err)
+			return 1
+		}
+		return 0
 	}
+
+	if storeCommand.Happened() {
+		if err := runStoreCommand(context.Background(), config.Server); err != nil {
+			slog.Error("Store command failed", "err", err)
+			fmt.Printf("Error: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	configs := config.Stores
+	if len(configs) == 0 {
+		admin, err := newServerAdmin(config.Server)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return 1
+		}
+		picked, err := pickStore(admin)
+		if err != nil {
+			slog.Error("Store picker failed", "err", err)
+			fmt.Printf("Error: %v\n", err)
+			return 1
+		}
+		if picked == nil {
+			return 0
+		}
+		configs = append(configs, *picked)
+	}
+
+	ctx := context.Background()
+	stores := newSession(ctx)
+	stores.journal = journal
+	defer stores.close()
+	for _, c := range configs {
+		if _, err := stores.add(c); err != nil {
+			slog.Error("Unable to open store", "store_id", c.StoreId, "err", err)
+			fmt.Printf("Unable to open store %v: %v\n", c.StoreId, err)
+			return 1
+		}
+	}
+
 	app := tview.NewApplication()
-	root := AddComponents(context.Background(), app)
+	root := AddComponents(ctx, app, stores, logs)
 
 	if err := app.SetRoot(root, true).SetFocus(root).Run(); err != nil {
-		log.Panic(err)
+		slog.Error("UI failed", "err", err)
+		fmt.Printf("Error: %v\n", err)
+		return 1
 	}
-
+	if err, _ := failure.Load().(error); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return 1
+	}
+	return 0
 }
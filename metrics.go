@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// readLatencyBuckets are the upper bounds of the ReadChanges latency histogram, in seconds
+var readLatencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// pendingStates name the pending action codes of the replica
+var pendingStates = map[string]string{"D": "deletion", "S": "stale"}
+
+// histogram counts observations by the buckets they fall in, as Prometheus histograms do
+type histogram struct {
+	// counts has a count per bucket plus one for the observations above the last bucket
+	counts []int
+	sum    float64
+	count  int
+}
+
+func (h *histogram) observe(value float64) {
+	if h.counts == nil {
+		h.counts = make([]int, len(readLatencyBuckets)+1)
+	}
+	i := sort.SearchFloat64s(readLatencyBuckets, value)
+	h.counts[i]++
+	h.sum += value
+	h.count++
+}
+
+// storeMetrics counts what the sync and the deletion worker of a store did since fgamanager started. A nil
+// storeMetrics counts nothing, for stores opened outside of a session
+type storeMetrics struct {
+	lock sync.Mutex
+	// applied is by operation, readErrors and readLatency by type synced, deletions by result
+	applied     map[string]int
+	readErrors  map[string]int
+	readLatency map[string]*histogram
+	deletions   map[string]int
+}
+
+func newStoreMetrics() *storeMetrics {
+	return &storeMetrics{applied: map[string]int{}, readErrors: map[string]int{}, readLatency: map[string]*histogram{},
+		deletions: map[string]int{}}
+}
+
+// read records a ReadChanges request of objectType, how long it took and whether it failed
+func (m *storeMetrics) read(objectType string, took time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.readLatency[objectType] == nil {
+		m.readLatency[objectType] = &histogram{}
+	}
+	m.readLatency[objectType].observe(took.Seconds())
+	if err != nil {
+		m.readErrors[objectType]++
+	}
+}
+
+// apply records the changes applied to the replica
+func (m *storeMetrics) apply(writes, deletes int) {
+	if m == nil {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.applied["write"] += writes
+	m.applied["delete"] += deletes
+}
+
+// delete records a tuple the deletion worker sent to the server
+func (m *storeMetrics) delete(succeeded bool) {
+	if m == nil {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if succeeded {
+		m.deletions["success"]++
+	} else {
+		m.deletions["failure"]++
+	}
+}
+
+// family is a metric in the Prometheus text format, its samples written under a single header
+type family struct {
+	name, help, kind string
+	samples          []string
+}
+
+// add adds a sample of the family, or of a series of it like _bucket when suffix is given. labels go in
+// name, value pairs
+func (f *family) add(suffix string, value float64, labels ...string) {
+	var pairs []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[i+1])
+		pairs = append(pairs, fmt.Sprintf(`%v="%v"`, labels[i], value))
+	}
+	f.samples = append(f.samples, fmt.Sprintf("%v%v{%v} %v", f.name, suffix, strings.Join(pairs, ","),
+		strconv.FormatFloat(value, 'g', -1, 64)))
+}
+
+func (f *family) writeTo(out io.Writer) {
+	_, _ = fmt.Fprintf(out, "# HELP %v %v\n# TYPE %v %v\n", f.name, f.help, f.name, f.kind)
+	for _, sample := range f.samples {
+		_, _ = fmt.Fprintln(out, sample)
+	}
+}
+
+// sortedKeys are the keys of counts in order, so the samples come in the same order on every scrape
+func sortedKeys[V any](counts map[string]V) []string {
+	var keys []string
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// writeMetrics writes the metrics of every store in the Prometheus text format. What the replica tells is read
+// as it's scraped, a replica that fails to tell it is left out and logged
+func writeMetrics(out io.Writer, stores []*store, now time.Time) {
+	tuples := &family{name: "fgamanager_replica_tuples", kind: "gauge", help: "Tuples in the replica."}
+	lag := &family{name: "fgamanager_sync_lag_seconds", kind: "gauge",
+		help: "Seconds since the replica was last synced, by type synced."}
+	pending := &family{name: "fgamanager_pending_actions", kind: "gauge",
+		help: "Tuples waiting for a pending action, by state."}
+	applied := &family{name: "fgamanager_changes_applied_total", kind: "counter",
+		help: "Changes applied to the replica, by operation."}
+	latency := &family{name: "fgamanager_read_changes_duration_seconds", kind: "histogram",
+		help: "Latency of the ReadChanges requests, by type synced."}
+	readErrors := &family{name: "fgamanager_read_changes_errors_total", kind: "counter",
+		help: "Failed ReadChanges requests, by type synced."}
+	deletions := &family{name: "fgamanager_deletions_total", kind: "counter",
+		help: "Tuples marked for deletion sent to the server, by result."}
+
+	for _, s := range stores {
+		store := []string{"store", s.Name, "store_id", s.StoreId}
+		if count, err := s.repo.CountTuples(nil); err == nil {
+			tuples.add("", float64(count), store...)
+		} else {
+			s.log.Warn("Failed to count the tuples for the metrics", "operation", "metrics", "err", err)
+		}
+		if connections, err := s.repo.GetConnections(s.ApiUrl, s.StoreId); err == nil {
+			for _, connection := range connections {
+				if !connection.LastSync.IsZero() {
+					lag.add("", now.Sub(connection.LastSync).Seconds(), append(store, "type", connection.Type)...)
+				}
+			}
+		} else {
+			s.log.Warn("Failed to read the sync positions for the metrics", "operation", "metrics", "err", err)
+		}
+		if counts, err := s.repo.CountPendingActions(); err == nil {
+			for _, action := range sortedKeys(pendingStates) {
+				pending.add("", float64(counts[action]), append(store, "state", pendingStates[action])...)
+			}
+		} else {
+			s.log.Warn("Failed to count the pending actions for the metrics", "operation", "metrics", "err", err)
+		}
+
+		m := s.metrics
+		if m == nil {
+			continue
+		}
+		m.lock.Lock()
+		for _, operation := range []string{"write", "delete"} {
+			applied.add("", float64(m.applied[operation]), append(store, "operation", operation)...)
+		}
+		for _, objectType := range sortedKeys(m.readLatency) {
+			h := m.readLatency[objectType]
+			labels := append(store, "type", objectType)
+			cumulative := 0
+			for i, bound := range readLatencyBuckets {
+				cumulative += h.counts[i]
+				latency.add("_bucket", float64(cumulative), append(labels, "le", strconv.FormatFloat(bound, 'g', -1, 64))...)
+			}
+			latency.add("_bucket", float64(h.count), append(labels, "le", "+Inf")...)
+			latency.add("_sum", h.sum, labels...)
+			latency.add("_count", float64(h.count), labels...)
+			readErrors.add("", float64(m.readErrors[objectType]), labels...)
+		}
+		for _, result := range []string{"success", "failure"} {
+			deletions.add("", float64(m.deletions[result]), append(store, "result", result)...)
+		}
+		m.lock.Unlock()
+	}
+	for _, f := range []*family{tuples, lag, pending, applied, latency, readErrors, deletions} {
+		f.writeTo(out)
+	}
+}
+
+// serveMetrics serves the metrics of the stores of a session at /metrics on address until ctx is done
+func serveMetrics(ctx context.Context, address string, stores *session) (net.Addr, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeMetrics(w, stores.list(), time.Now())
+	})
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			slog.Error("Metrics server failed", "operation", "metrics", "address", address, "err", err)
+		}
+	}()
+	return listener.Addr(), nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	openfga "github.com/openfga/go-sdk"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	fake := newFakeFga(t)
+	fake.addChanges(syncStoreId, openfga.WRITE, "user:1 viewer document:1", "user:2 viewer document:1", "user:3 viewer document:1")
+	fake.addChanges(syncStoreId, openfga.DELETE, "user:1 viewer document:1")
+	s := newSyncedStore(t, fake)
+	s.metrics = newStoreMetrics()
+	syncUntil(t, s, func(u WatchUpdate) bool { return u.Status.State == caughtUp })
+	_ = s.repo.MarkDeletion("user:2 viewer document:1", "jack@test")
+	_ = s.repo.MarkStale("user:3 viewer document:1")
+	s.metrics.delete(true)
+	s.metrics.delete(false)
+	s.metrics.delete(false)
+	s.metrics.read("document", 3*time.Second, errors.New("unavailable"))
+
+	var out bytes.Buffer
+	writeMetrics(&out, []*store{s}, time.Now())
+	labels := fmt.Sprintf(`store="test",store_id="%v"`, syncStoreId)
+	for _, expected := range []string{
+		"# TYPE fgamanager_replica_tuples gauge\nfgamanager_replica_tuples{" + labels + "} 2\n",
+		"fgamanager_sync_lag_seconds{" + labels + `,type=""} `,
+		"fgamanager_pending_actions{" + labels + `,state="deletion"} 1` + "\n",
+		"fgamanager_pending_actions{" + labels + `,state="stale"} 1` + "\n",
+		"fgamanager_changes_applied_total{" + labels + `,operation="write"} 3` + "\n",
+		"fgamanager_changes_applied_total{" + labels + `,operation="delete"} 1` + "\n",
+		"# TYPE fgamanager_read_changes_duration_seconds histogram\n",
+		"fgamanager_read_changes_duration_seconds_bucket{" + labels + `,type="",le="+Inf"} `,
+		"fgamanager_read_changes_duration_seconds_bucket{" + labels + `,type="document",le="2.5"} 0` + "\n",
+		"fgamanager_read_changes_duration_seconds_bucket{" + labels + `,type="document",le="5"} 1` + "\n",
+		"fgamanager_read_changes_duration_seconds_sum{" + labels + `,type="document"} 3` + "\n",
+		"fgamanager_read_changes_errors_total{" + labels + `,type=""} 0` + "\n",
+		"fgamanager_read_changes_errors_total{" + labels + `,type="document"} 1` + "\n",
+		"fgamanager_deletions_total{" + labels + `,result="success"} 1` + "\n",
+		"fgamanager_deletions_total{" + labels + `,result="failure"} 2` + "\n",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Expected %q in\n%v", expected, out.String())
+		}
+	}
+
+	t.Run("Label values are escaped", func(t *testing.T) {
+		f := &family{name: "fgamanager_test"}
+		f.add("", 1.5, "store", "say \"hi\"\\\n")
+		if expected := `fgamanager_test{store="say \"hi\"\\\n"} 1.5`; f.samples[0] != expected {
+			t.Errorf("Expected %v, got %v", expected, f.samples[0])
+		}
+	})
+
+	t.Run("Served at /metrics", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		address, err := serveMetrics(ctx, "127.0.0.1:0", &session{stores: []*store{s}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.Get("http://" + address.String() + "/metrics")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") ||
+			!strings.Contains(string(body), "fgamanager_replica_tuples{"+labels+"} 2") {
+			t.Errorf("Expected the metrics, got %v %v", resp.Status, string(body))
+		}
+	})
+}
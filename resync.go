@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	openfga "github.com/openfga/go-sdk"
+	"github.com/paulosuzart/fgamanager/db"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// readPageSize is the largest page the Read endpoint returns
+const readPageSize = 100
+
+// verifyListLimit caps how many missing and extra tuples verify prints for each store
+const verifyListLimit = 20
+
+var errDrift = errors.New("the replica drifted from the server, run resync to repair it")
+
+// ofTypes tells whether the object of a tuple is of one of types, every object is when types is empty
+func ofTypes(types []string, object string) bool {
+	if len(types) == 0 {
+		return true
+	}
+	objectType, _, _ := strings.Cut(object, ":")
+	for _, t := range types {
+		if t == objectType {
+			return true
+		}
+	}
+	return false
+}
+
+// readTuples pages through the tuples of the store, of types only when given, until onPage fails or
+// limit tuples were passed to it. No limit when limit is 0. Returns how many tuples were passed
+func readTuples(ctx context.Context, s *store, limit int, onPage func([]openfga.Tuple) error) (int, error) {
+	read := 0
+	var token *string
+	for {
+		pageSize := int32(readPageSize)
+		resp, _, err := s.client.OpenFgaApi.Read(ctx).
+			Body(openfga.ReadRequest{PageSize: &pageSize, ContinuationToken: token}).Execute()
+		if err != nil {
+			return read, err
+		}
+		var page []openfga.Tuple
+		for _, tuple := range resp.GetTuples() {
+			if ofTypes(s.Types, tuple.Key.Object) && (limit == 0 || read+len(page) < limit) {
+				page = append(page, tuple)
+			}
+		}
+		if err := onPage(page); err != nil {
+			return read, err
+		}
+		read += len(page)
+		if resp.GetContinuationToken() == "" || (limit > 0 && read >= limit) {
+			return read, nil
+		}
+		next := resp.GetContinuationToken()
+		token = &next
+	}
+}
+
+// resync rebuilds the replica of a store from the Read endpoint and swaps it for the replica tuples at once.
+// The sync continues from the positions the replica had, taken before reading so the changes made while reading
+// are applied again afterwards. Types whose position is lost catch up from the first change, in the background
+func resync(ctx context.Context, s *store, out io.Writer) error {
+	if _, err := s.repo.ScopeTypes(s.StoreId, s.Types); err != nil {
+		return err
+	}
+	var connections []db.Connection
+	for _, objectType := range s.syncedTypes() {
+		token := s.repo.GetContinuationToken(s.ApiUrl, s.StoreId, objectType)
+		if token == nil {
+			s.log.Info("Continuation token lost, the sync catches up from the first change", "operation", "resync", "type", objectType)
+			continue
+		}
+		connections = append(connections, db.Connection{ApiUrl: s.ApiUrl, StoreId: s.StoreId, Type: objectType,
+			ContinuationToken: *token, LastSync: time.Now()})
+	}
+
+	snapshot, err := s.repo.NewSnapshot()
+	if err != nil {
+		return err
+	}
+	read, err := readTuples(ctx, s, 0, snapshot.Add)
+	if err != nil {
+		_ = snapshot.Drop()
+		return err
+	}
+	if err := snapshot.Replace(connections); err != nil {
+		_ = snapshot.Drop()
+		return err
+	}
+	s.log.Info("Replica rebuilt", "operation", "resync", "tuples", read)
+	_, _ = fmt.Fprintf(out, "%v: replica %v rebuilt with %v tuples\n", s.Name, db.RedactDataSource(s.DbPath), read)
+	return nil
+}
+
+// exists tells whether the server has a tuple
+func exists(ctx context.Context, s *store, tupleKey string) (bool, error) {
+	key, err := parseTupleKey(tupleKey)
+	if err != nil {
+		return false, err
+	}
+	resp, _, err := s.client.OpenFgaApi.Read(ctx).Body(openfga.ReadRequest{
+		TupleKey: &openfga.ReadRequestTupleKey{User: &key.User, Relation: &key.Relation, Object: &key.Object},
+	}).Execute()
+	return len(resp.GetTuples()) > 0, err
+}
+
+// verify compares the replica of a store with the Read endpoint and prints the missing and extra tuples.
+// When sample is set, only sample random replica tuples are looked for on the server and the first sample
+// tuples of the server in the replica
+func verify(ctx context.Context, s *store, sample int, out io.Writer) (bool, error) {
+	result := &db.DiffResult{}
+	checked := 0
+	if sample > 0 {
+		_, err := readTuples(ctx, s, sample, func(tuples []openfga.Tuple) error {
+			var keys []string
+			for _, tuple := range tuples {
+				keys = append(keys, tuple.Key.User+" "+tuple.Key.Relation+" "+tuple.Key.Object)
+			}
+			missing, err := s.repo.MissingTuples(keys)
+			result.OnlyLeft = append(result.OnlyLeft, missing...)
+			checked += len(keys)
+			return err
+		})
+		if err != nil {
+			return false, err
+		}
+		keys, err := s.repo.SampleTuples(sample)
+		if err != nil {
+			return false, err
+		}
+		for _, key := range keys {
+			found, err := exists(ctx, s, key)
+			if err != nil {
+				return false, err
+			}
+			if !found {
+				result.OnlyRight = append(result.OnlyRight, key)
+			}
+		}
+		checked += len(keys)
+	} else {
+		snapshot, err := s.repo.NewSnapshot()
+		if err != nil {
+			return false, err
+		}
+		defer func() { _ = snapshot.Drop() }()
+		if checked, err = readTuples(ctx, s, 0, snapshot.Add); err != nil {
+			return false, err
+		}
+		if result, err = snapshot.Compare(); err != nil {
+			return false, err
+		}
+	}
+
+	lastSync := "never"
+	if connection := s.repo.GetConnection(s.ApiUrl, s.StoreId); connection != nil {
+		lastSync = connection.LastSync.Format(time.DateTime)
+	}
+	_, _ = fmt.Fprintf(out, "%v: %v tuples checked, %v missing from the replica, %v extra in the replica (last sync %v)\n",
+		s.Name, checked, len(result.OnlyLeft), len(result.OnlyRight), lastSync)
+	for _, side := range []struct {
+		prefix string
+		keys   []string
+	}{{"  missing ", result.OnlyLeft}, {"  extra   ", result.OnlyRight}} {
+		prefix, keys := side.prefix, side.keys
+		for _, key := range keys[:min(len(keys), verifyListLimit)] {
+			_, _ = fmt.Fprintln(out, prefix+key)
+		}
+		if len(keys) > verifyListLimit {
+			_, _ = fmt.Fprintf(out, "%v... %v more\n", prefix, len(keys)-verifyListLimit)
+		}
+	}
+	s.log.Info("Replica verified", "operation", "verify", "checked", checked, "missing", len(result.OnlyLeft), "extra", len(result.OnlyRight))
+	countsOff, err := checkCounts(s, out)
+	return len(result.OnlyLeft) > 0 || len(result.OnlyRight) > 0 || countsOff, err
+}
+
+// checkCounts counts the tuples of the replica from scratch and lists the counts kept as changes are applied
+// that are off. The replica is left as it is, resync rebuilds them
+func checkCounts(s *store, out io.Writer) (bool, error) {
+	drifts, err := s.repo.CheckCounts()
+	if err != nil || len(drifts) == 0 {
+		return false, err
+	}
+	_, _ = fmt.Fprintf(out, "%v: %v tuple counts are off\n", s.Name, len(drifts))
+	for _, drift := range drifts[:min(len(drifts), verifyListLimit)] {
+		_, _ = fmt.Fprintln(out, "  count   "+drift.String())
+	}
+	if len(drifts) > verifyListLimit {
+		_, _ = fmt.Fprintf(out, "  count   ... %v more\n", len(drifts)-verifyListLimit)
+	}
+	s.log.Warn("Tuple counts are off", "operation", "verify", "off", len(drifts))
+	return true, nil
+}
+
+// openForRepair opens the replica of every store given, without syncing them
+func openForRepair(configs []storeConfig) ([]*store, error) {
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("give the stores with --storeId or --profile")
+	}
+	// keeps track of the replicas taken like a session does, without starting the stores
+	opened := &session{}
+	for _, config := range configs {
+		if config.DbPath == "" {
+			config.DbPath = opened.replicaPath(config.StoreId)
+		}
+		s, err := newStore(config, nil)
+		if err != nil {
+			return opened.stores, err
+		}
+		opened.stores = append(opened.stores, s)
+	}
+	return opened.stores, nil
+}
+
+func runResync(ctx context.Context, configs []storeConfig) error {
+	stores, err := openForRepair(configs)
+	for _, s := range stores {
+		defer s.close()
+	}
+	if err != nil {
+		return err
+	}
+	for _, s := range stores {
+		// the syncer of a shared replica would keep applying changes over the rebuilt one
+		elected, err := s.repo.ElectSyncer(ctx, s.ApiUrl, s.StoreId)
+		if err != nil {
+			return err
+		}
+		if !elected {
+			return fmt.Errorf("another instance syncs the shared replica of %v, close it first", s.Name)
+		}
+		if err := resync(ctx, s, os.Stdout); err != nil {
+			return fmt.Errorf("resync of %v failed: %w", s.Name, err)
+		}
+	}
+	return nil
+}
+
+func runVerify(ctx context.Context, configs []storeConfig, sample int) error {
+	stores, err := openForRepair(configs)
+	for _, s := range stores {
+		defer s.close()
+	}
+	if err != nil {
+		return err
+	}
+	drifted := false
+	for _, s := range stores {
+		storeDrifted, err := verify(ctx, s, sample, os.Stdout)
+		if err != nil {
+			return fmt.Errorf("verify of %v failed: %w", s.Name, err)
+		}
+		drifted = drifted || storeDrifted
+	}
+	if drifted {
+		return errDrift
+	}
+	return nil
+}
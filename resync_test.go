@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	openfga "github.com/openfga/go-sdk"
+	"github.com/paulosuzart/fgamanager/db"
+	"strings"
+	"testing"
+	"time"
+)
+
+func driftedStore(t *testing.T) (*fakeFga, *store) {
+	fake := newFakeFga(t)
+	var tupleKeys []string
+	for i := 0; i < 2*readPageSize+10; i++ {
+		tupleKeys = append(tupleKeys, fmt.Sprintf("user:%v viewer document:1", i))
+	}
+	fake.addChanges(syncStoreId, openfga.WRITE, tupleKeys...)
+	fake.addChanges(syncStoreId, openfga.DELETE, "user:0 viewer document:1")
+	s := newSyncedStore(t, fake)
+	for _, change := range []openfga.TupleChange{
+		{TupleKey: *openfga.NewTupleKey("user:0", "viewer", "document:1"), Operation: openfga.WRITE, Timestamp: time.Now()},
+		{TupleKey: *openfga.NewTupleKey("user:1", "viewer", "document:1"), Operation: openfga.WRITE, Timestamp: time.Now()},
+	} {
+		s.repo.ApplyChange(change)
+	}
+	s.repo.MarkDeletion("user:1 viewer document:1", "jack@test")
+	return fake, s
+}
+
+func TestResync(t *testing.T) {
+	t.Run("Lost token", func(t *testing.T) {
+		fake, s := driftedStore(t)
+		var out bytes.Buffer
+		if err := resync(context.Background(), s, &out); err != nil {
+			t.Fatal(err)
+		}
+		if c, _ := s.repo.CountTuples(nil); c != len(fake.tuples(syncStoreId)) {
+			t.Errorf("Expected %v tuples, got %v", len(fake.tuples(syncStoreId)), c)
+		}
+		if missing, _ := s.repo.MissingTuples([]string{"user:0 viewer document:1"}); len(missing) != 1 {
+			t.Error("Deleted tuples must be dropped")
+		}
+		if marked, _ := s.repo.GetMarkedForDeletion("jack@test"); len(marked) != 0 {
+			t.Errorf("Pending actions must be dropped, got %v", marked)
+		}
+		if token := s.repo.GetContinuationToken(s.ApiUrl, s.StoreId, ""); token != nil {
+			t.Errorf("Expected the sync to catch up from the first change, got token %v", *token)
+		}
+		if !strings.Contains(out.String(), "rebuilt with 209 tuples") {
+			t.Errorf("Unexpected output %v", out.String())
+		}
+		if drifted, err := verify(context.Background(), s, 0, &out); drifted || err != nil {
+			t.Errorf("Resynced replica must not drift, got %v (%v)", drifted, err)
+		}
+		syncUntil(t, s, func(u WatchUpdate) bool { return u.Status.State == caughtUp })
+		if drifted, err := verify(context.Background(), s, 0, &out); drifted || err != nil {
+			t.Errorf("Catching up must not drift the replica, got %v (%v)", drifted, err)
+		}
+	})
+
+	t.Run("Kept token", func(t *testing.T) {
+		_, s := driftedStore(t)
+		s.repo.UpsertConnection(db.Connection{ApiUrl: s.ApiUrl, StoreId: s.StoreId, ContinuationToken: "7"})
+		if err := resync(context.Background(), s, &bytes.Buffer{}); err != nil {
+			t.Fatal(err)
+		}
+		if token := s.repo.GetContinuationToken(s.ApiUrl, s.StoreId, ""); *token != "7" {
+			t.Errorf("Expected the replica token to be kept, got %v", *token)
+		}
+	})
+}
+
+func TestVerify(t *testing.T) {
+	for name, sample := range map[string]int{"Full": 0, "Sample": 1000} {
+		t.Run(name, func(t *testing.T) {
+			_, s := driftedStore(t)
+			var out bytes.Buffer
+			drifted, err := verify(context.Background(), s, sample, &out)
+			if err != nil || !drifted {
+				t.Fatalf("Expected a drift, got %v (%v)", drifted, err)
+			}
+			for _, expected := range []string{"208 missing from the replica, 1 extra in the replica", "  extra   user:0 viewer document:1", "... 188 more"} {
+				if !strings.Contains(out.String(), expected) {
+					t.Errorf("Expected %q in %v", expected, out.String())
+				}
+			}
+			if strings.Contains(out.String(), "counts") {
+				t.Errorf("The counts of the replica were right, got %v", out.String())
+			}
+		})
+	}
+
+	t.Run("Counts", func(t *testing.T) {
+		_, s := driftedStore(t)
+		counts := &offCounts{Repository: s.repo}
+		s.repo = counts
+		var out bytes.Buffer
+		drifted, err := verify(context.Background(), s, 1000, &out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := "  count   user viewer document: 5 counted, 2 in the replica"; !strings.Contains(out.String(), expected) {
+			t.Errorf("Expected %q in %v", expected, out.String())
+		}
+		if !drifted {
+			t.Error("Counts that are off must fail the verify")
+		}
+		if counts.rebuilt {
+			t.Error("Verify must leave the replica as it is")
+		}
+	})
+}
+
+// offCounts is a replica whose tuple counts are off until rebuilt
+type offCounts struct {
+	db.Repository
+	rebuilt bool
+}
+
+func (o *offCounts) CheckCounts() ([]db.CountDrift, error) {
+	if o.rebuilt {
+		return nil, nil
+	}
+	return []db.CountDrift{{UserType: "user", Relation: "viewer", ObjectType: "document", Counted: 5, Actual: 2}}, nil
+}
+
+func (o *offCounts) RebuildCounts() error {
+	o.rebuilt = true
+	return o.Repository.RebuildCounts()
+}
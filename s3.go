@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRegion = "us-east-1"
+	// metadataPrefix is how S3 tells user metadata from the other headers of an object
+	metadataPrefix = "X-Amz-Meta-"
+	// emptyPayloadHash is the SHA-256 of an empty body, as requests without one are signed
+	emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// objectStore is a bucket of S3 or of an S3 compatible storage, like MinIO
+type objectStore struct {
+	// endpoint is empty for AWS, whose buckets are addressed by host name. Other endpoints take the bucket in the path
+	endpoint     *url.URL
+	bucket       string
+	prefix       string
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	client       *http.Client
+	now          func() time.Time
+}
+
+// newObjectStore connects to the bucket of location, given as s3://bucket/prefix. Credentials and region come from
+// the usual AWS environment variables, the endpoint from AWS_ENDPOINT_URL_S3 or AWS_ENDPOINT_URL unless given
+func newObjectStore(location, endpoint string, getenv func(string) string) (*objectStore, error) {
+	u, err := url.Parse(location)
+	if err != nil || u.Scheme != "s3" || u.Host == "" {
+		return nil, fmt.Errorf("invalid snapshot location %q, expected s3://bucket/prefix", location)
+	}
+	store := &objectStore{
+		bucket:       u.Host,
+		prefix:       strings.TrimPrefix(u.Path, "/"),
+		region:       firstOf(getenv("AWS_REGION"), getenv("AWS_DEFAULT_REGION"), defaultRegion),
+		accessKey:    getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: getenv("AWS_SESSION_TOKEN"),
+		client:       http.DefaultClient,
+		now:          time.Now,
+	}
+	if store.prefix != "" && !strings.HasSuffix(store.prefix, "/") {
+		store.prefix += "/"
+	}
+	if store.accessKey == "" || store.secretKey == "" {
+		return nil, errors.New("set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY to reach the snapshot bucket")
+	}
+	if endpoint = firstOf(endpoint, getenv("AWS_ENDPOINT_URL_S3"), getenv("AWS_ENDPOINT_URL")); endpoint != "" {
+		if store.endpoint, err = url.Parse(endpoint); err != nil || store.endpoint.Host == "" {
+			return nil, fmt.Errorf("invalid S3 endpoint %q", endpoint)
+		}
+	}
+	return store, nil
+}
+
+func firstOf(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// objectUrl is where the object at key of the prefix is
+func (o *objectStore) objectUrl(key string) *url.URL {
+	if o.endpoint == nil {
+		return &url.URL{Scheme: "https", Host: fmt.Sprintf("%v.s3.%v.amazonaws.com", o.bucket, o.region),
+			Path: "/" + o.prefix + key}
+	}
+	u := *o.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + o.bucket + "/" + o.prefix + key
+	return &u
+}
+
+// String is the location of the prefix, for messages
+func (o *objectStore) String() string {
+	return "s3://" + o.bucket + "/" + o.prefix
+}
+
+// put uploads size bytes of body as the object at key, with metadata. payloadHash is the hex SHA-256 of body
+func (o *objectStore) put(ctx context.Context, key string, body io.Reader, size int64, payloadHash string, metadata map[string]string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, o.objectUrl(key).String(), body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/gzip")
+	for name, value := range metadata {
+		req.Header.Set(metadataPrefix+name, value)
+	}
+	resp, err := o.do(req, payloadHash)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	return nil
+}
+
+// get downloads the object at key, returning its body and metadata. The body must be closed
+func (o *objectStore) get(ctx context.Context, key string) (io.ReadCloser, map[string]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, o.objectUrl(key).String(), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := o.do(req, emptyPayloadHash)
+	if err != nil {
+		return nil, nil, err
+	}
+	metadata := map[string]string{}
+	for name, values := range resp.Header {
+		if strings.HasPrefix(name, metadataPrefix) {
+			metadata[strings.ToLower(strings.TrimPrefix(name, metadataPrefix))] = values[0]
+		}
+	}
+	return resp.Body, metadata, nil
+}
+
+// s3Error is the body S3 answers failed requests with
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// do signs and sends a request, turning the answers other than 2xx into errors
+func (o *objectStore) do(req *http.Request, payloadHash string) (*http.Response, error) {
+	if o.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", o.sessionToken)
+	}
+	signRequest(req, payloadHash, o.region, o.accessKey, o.secretKey, o.now())
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer func() { _ = resp.Body.Close() }()
+	var answer s3Error
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if xml.Unmarshal(body, &answer) != nil || answer.Code == "" {
+		return nil, fmt.Errorf("%v %v: %v", req.Method, req.URL.Path, resp.Status)
+	}
+	return nil, fmt.Errorf("%v %v: %v (%v)", req.Method, req.URL.Path, answer.Message, answer.Code)
+}
+
+// signRequest adds the AWS Signature Version 4 of the request, signing the host and every header set
+func signRequest(req *http.Request, payloadHash, region, accessKey, secretKey string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.Join(strings.Fields(strings.Join(values, ",")), " ")
+	}
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uriEncode(req.URL.Path, false),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hexHash([]byte(canonicalRequest))
+
+	key := []byte("AWS4" + secretKey)
+	for _, part := range []string{date, region, "s3", "aws4_request"} {
+		key = hmacOf(key, part)
+	}
+	signature := hex.EncodeToString(hmacOf(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%v/%v, SignedHeaders=%v, Signature=%v",
+		accessKey, scope, signedHeaders, signature))
+}
+
+func hmacOf(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func hexHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// uriEncode escapes everything but the unreserved characters, as SigV4 expects. Slashes are kept in paths
+func uriEncode(value string, encodeSlash bool) string {
+	var encoded strings.Builder
+	for _, b := range []byte(value) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9', b == '-', b == '_', b == '.', b == '~':
+			encoded.WriteByte(b)
+		case b == '/' && !encodeSlash:
+			encoded.WriteByte(b)
+		default:
+			encoded.WriteString(fmt.Sprintf("%%%02X", b))
+		}
+	}
+	return encoded.String()
+}
+
+func canonicalQuery(query url.Values) string {
+	var params []string
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, uriEncode(name, true)+"="+uriEncode(value, true))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/paulosuzart/fgamanager/db"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// snapshotKey is the object a store snapshot is kept in, every push replaces the previous one
+func snapshotKey(storeId string) string {
+	return storeId + ".db.gz"
+}
+
+// pushSnapshot uploads a compressed copy of the replica of a store, taken while it may be syncing. The store id,
+// continuation token of every type synced and tuple count of the copy go along as metadata. The pending actions and the audit log of
+// this instance stay out of it
+func pushSnapshot(ctx context.Context, s *store, bucket *objectStore, out io.Writer) error {
+	dir, err := os.MkdirTemp("", "fgamanager-snapshot")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	copyPath := filepath.Join(dir, "replica.db")
+	if err := s.repo.Backup(copyPath); err != nil {
+		return err
+	}
+	if err := clearLocalState(copyPath); err != nil {
+		return err
+	}
+	metadata, err := snapshotMetadata(copyPath, s.ApiUrl, s.StoreId)
+	if err != nil {
+		return err
+	}
+
+	compressed, err := os.Create(copyPath + ".gz")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = compressed.Close() }()
+	hash := sha256.New()
+	if err := compress(copyPath, io.MultiWriter(compressed, hash)); err != nil {
+		return err
+	}
+	size, err := compressed.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := compressed.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := bucket.put(ctx, snapshotKey(s.StoreId), compressed, size, hex.EncodeToString(hash.Sum(nil)), metadata); err != nil {
+		return err
+	}
+	s.log.Info("Snapshot pushed", "operation", "snapshot", "location", bucket.String()+snapshotKey(s.StoreId),
+		"bytes", size, "tuples", metadata["tuple-count"])
+	_, _ = fmt.Fprintf(out, "%v: snapshot with %v tuples pushed to %v%v (%v bytes)\n", s.Name, metadata["tuple-count"],
+		bucket, snapshotKey(s.StoreId), size)
+	return nil
+}
+
+// clearLocalState empties the pending actions and the audit log of the replica at path
+func clearLocalState(path string) error {
+	replica, err := db.Open(path)
+	if err != nil {
+		return err
+	}
+	err = replica.ClearLocalState()
+	if closeErr := replica.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// snapshotMetadata describes the copy of a replica, read from the copy so it matches what's uploaded. The token
+// of a replica synced by type goes as continuation-tokens, every type=token pair query encoded
+func snapshotMetadata(path, apiUrl, storeId string) (map[string]string, error) {
+	replica, err := db.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = replica.Close() }()
+	count, err := replica.CountTuples(nil)
+	if err != nil {
+		return nil, err
+	}
+	metadata := map[string]string{
+		"store-id":    storeId,
+		"api-url":     apiUrl,
+		"tuple-count": strconv.Itoa(count),
+		"created":     time.Now().UTC().Format(time.RFC3339),
+	}
+	connections, err := replica.GetConnections(apiUrl, storeId)
+	if err != nil {
+		return nil, err
+	}
+	tokens := url.Values{}
+	for _, connection := range connections {
+		tokens.Set(connection.Type, connection.ContinuationToken)
+	}
+	if token, found := tokens[""]; found && len(tokens) == 1 {
+		metadata["continuation-token"] = token[0]
+	} else if len(tokens) > 0 {
+		metadata["continuation-tokens"] = tokens.Encode()
+	}
+	return metadata, nil
+}
+
+func compress(path string, out io.Writer) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = in.Close() }()
+	writer := gzip.NewWriter(out)
+	if _, err := io.Copy(writer, in); err != nil {
+		return err
+	}
+	return writer.Close()
+}
+
+// pullSnapshot downloads the snapshot of a store as its replica, so the sync resumes from the continuation token
+// of the snapshot. An existing replica is backed up next to it first and its audit log carries on in the pulled
+// one. fgamanager must not have it open
+func pullSnapshot(ctx context.Context, config storeConfig, bucket *objectStore, out io.Writer) error {
+	path := replicaOf(config)
+	if db.IsShared(path) {
+		return fmt.Errorf("snapshots are pulled into SQLite replicas, %v is shared", db.RedactDataSource(path))
+	}
+	body, metadata, err := bucket.get(ctx, snapshotKey(config.StoreId))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = body.Close() }()
+	if metadata["store-id"] != config.StoreId {
+		return fmt.Errorf("the snapshot at %v%v is of store %q", bucket, snapshotKey(config.StoreId), metadata["store-id"])
+	}
+
+	pulled, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".pull-*")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(pulled.Name()) }()
+	err = decompress(body, pulled)
+	if closeErr := pulled.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("unable to download the snapshot: %w", err)
+	}
+	if owner, err := db.ReplicaStoreId(pulled.Name()); err != nil || owner != config.StoreId {
+		return fmt.Errorf("the snapshot is not a replica of %v: %v", config.StoreId, err)
+	}
+	pushedTokens, err := snapshotTokens(metadata)
+	if err != nil {
+		return err
+	}
+	tokens, err := adoptSnapshot(pulled.Name(), config.ApiUrl, config.StoreId)
+	if err != nil {
+		return err
+	}
+	if tokens.Encode() != pushedTokens.Encode() {
+		return fmt.Errorf("the snapshot holds %v but was pushed with %v", describeTokens(tokens), describeTokens(pushedTokens))
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		if err := keepAuditLog(pulled.Name(), path); err != nil {
+			return fmt.Errorf("unable to keep the audit log of %v: %w", path, err)
+		}
+		backupPath, err := backupReplica(path)
+		if err != nil {
+			return err
+		}
+		_, _ = fmt.Fprintf(out, "%v: previous replica saved as %v\n", config.Name, backupPath)
+	}
+	if err := os.Rename(pulled.Name(), path); err != nil {
+		return err
+	}
+	slog.Info("Snapshot pulled", "store", config.Name, "store_id", config.StoreId, "operation", "snapshot",
+		"replica", path, "tuples", metadata["tuple-count"], "created", metadata["created"])
+	_, _ = fmt.Fprintf(out, "%v: replica %v pulled with %v tuples from %v, the sync resumes from %v\n",
+		config.Name, path, metadata["tuple-count"], metadata["created"], describeTokens(tokens))
+	return nil
+}
+
+func decompress(in io.Reader, out io.Writer) error {
+	reader, err := gzip.NewReader(in)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, reader); err != nil {
+		return err
+	}
+	return reader.Close()
+}
+
+// adoptSnapshot brings a pulled replica to the current schema and points its sync to apiUrl, which may be
+// another url of the server it was pushed from. Snapshots pushed with pending actions or an audit log are
+// cleared of them. Returns the token the sync of every type resumes from
+func adoptSnapshot(path, apiUrl, storeId string) (url.Values, error) {
+	replica, err := db.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = replica.Close() }()
+	if err := replica.ClearLocalState(); err != nil {
+		return nil, err
+	}
+	if err := replica.MoveConnections(storeId, apiUrl); err != nil {
+		return nil, err
+	}
+	connections, err := replica.GetConnections(apiUrl, storeId)
+	if err != nil {
+		return nil, err
+	}
+	tokens := url.Values{}
+	for _, connection := range connections {
+		tokens.Set(connection.Type, connection.ContinuationToken)
+	}
+	return tokens, nil
+}
+
+// snapshotTokens are the tokens of every type a snapshot was pushed with, the type is empty when every type is
+// synced together
+func snapshotTokens(metadata map[string]string) (url.Values, error) {
+	if encoded, found := metadata["continuation-tokens"]; found {
+		tokens, err := url.ParseQuery(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("the snapshot has invalid continuation tokens %q: %w", encoded, err)
+		}
+		return tokens, nil
+	}
+	tokens := url.Values{}
+	if token, found := metadata["continuation-token"]; found {
+		tokens.Set("", token)
+	}
+	return tokens, nil
+}
+
+// describeTokens lists the tokens by type, as in the messages of the sync
+func describeTokens(tokens url.Values) string {
+	if len(tokens) == 0 {
+		return "the first change"
+	}
+	if token, found := tokens[""]; found && len(tokens) == 1 {
+		return fmt.Sprintf("token %q", token[0])
+	}
+	var described []string
+	for objectType, token := range tokens {
+		described = append(described, fmt.Sprintf("%v token %q", objectType, token[0]))
+	}
+	sort.Strings(described)
+	return strings.Join(described, ", ")
+}
+
+// keepAuditLog appends the audit log of the replica at previousPath to the pulled one
+func keepAuditLog(pulledPath, previousPath string) error {
+	// brings the previous replica to the schema of the pulled one
+	previous, err := db.Open(previousPath)
+	if err != nil {
+		return err
+	}
+	if err := previous.Close(); err != nil {
+		return err
+	}
+	pulled, err := db.Open(pulledPath)
+	if err != nil {
+		return err
+	}
+	err = pulled.KeepAuditLog(previousPath)
+	if closeErr := pulled.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// backupReplica saves a copy of a replica about to be replaced and removes it along its journal files
+func backupReplica(path string) (string, error) {
+	replica, err := db.Open(path)
+	if err != nil {
+		return "", err
+	}
+	backupPath := fmt.Sprintf("%v.%v.bak", path, time.Now().Format("20060102T150405"))
+	err = replica.Backup(backupPath)
+	if closeErr := replica.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+	for _, suffix := range []string{"", "-wal", "-shm", "-journal"} {
+		if err := os.Remove(path + suffix); err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+	return backupPath, nil
+}
+
+func runSnapshot(ctx context.Context, configs []storeConfig, location, endpoint string, pull bool) error {
+	if len(configs) == 0 {
+		return fmt.Errorf("give the stores with --storeId or --profile")
+	}
+	bucket, err := newObjectStore(location, endpoint, os.Getenv)
+	if err != nil {
+		return err
+	}
+	if pull {
+		for _, config := range configs {
+			if err := pullSnapshot(ctx, config, bucket, os.Stdout); err != nil {
+				return fmt.Errorf("pull of %v failed: %w", config.Name, err)
+			}
+		}
+		return nil
+	}
+	stores, err := openForRepair(configs)
+	for _, s := range stores {
+		defer s.close()
+	}
+	if err != nil {
+		return err
+	}
+	for _, s := range stores {
+		if err := pushSnapshot(ctx, s, bucket, os.Stdout); err != nil {
+			return fmt.Errorf("push of %v failed: %w", s.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	openfga "github.com/openfga/go-sdk"
+	"github.com/paulosuzart/fgamanager/db"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSnapshotPushPull(t *testing.T) {
+	fake := newFakeS3(t)
+	ctx := context.Background()
+	bucket, err := newObjectStore("s3://snapshots/team", "", fake.getenv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+
+	pushed, err := newStore(storeConfig{Name: "staging", ApiUrl: "http://staging:8080", StoreId: syncStoreId,
+		DbPath: filepath.Join(dir, "pushed.db")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pushed.close()
+	err = pushed.repo.ApplyChanges([]openfga.TupleChange{
+		{TupleKey: *openfga.NewTupleKey("user:jack", "viewer", "document:1"), Operation: openfga.WRITE, Timestamp: time.Now()},
+		{TupleKey: *openfga.NewTupleKey("user:jill", "viewer", "document:1"), Operation: openfga.WRITE, Timestamp: time.Now()},
+	}, db.Connection{ApiUrl: pushed.ApiUrl, StoreId: syncStoreId, ContinuationToken: "5", LastSync: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the mark and the audit log are of the instance pushing
+	jack := "user:jack viewer document:1"
+	if err := pushed.repo.MarkDeletion(jack, "jack@staging"); err != nil {
+		t.Fatal(err)
+	}
+	if err := pushed.repo.RecordAudit(db.AuditEntry{Timestamp: time.Now(), Operator: "jack", Profile: "staging",
+		ApiUrl: pushed.ApiUrl, StoreId: syncStoreId, Operation: "delete", TupleKeys: db.TupleKeys{jack},
+		StatusCode: 200, Response: "sent from the pushing instance"}); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := pushSnapshot(ctx, pushed, bucket, &out); err != nil {
+		t.Fatal(err)
+	}
+	object := fake.objects["/snapshots/team/"+syncStoreId+".db.gz"]
+	if object.header.Get("X-Amz-Meta-Tuple-Count") != "2" || object.header.Get("X-Amz-Meta-Continuation-Token") != "5" {
+		t.Errorf("Expected the tuple count and token as metadata, got %v", object.header)
+	}
+	var uploaded bytes.Buffer
+	if err := decompress(bytes.NewReader(object.body), &uploaded); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(uploaded.Bytes(), []byte("sent from the pushing instance")) {
+		t.Error("The audit log must not be uploaded")
+	}
+	if marked, _ := pushed.repo.GetMarkedForDeletion("jack@staging"); len(marked) != 1 {
+		t.Errorf("The replica pushed keeps its mark, got %v", marked)
+	}
+
+	// pulled through another url of the same server
+	config := storeConfig{Name: "staging", ApiUrl: "http://fga.internal:8080", StoreId: syncStoreId, DbPath: filepath.Join(dir, "pulled.db")}
+	for i := 0; i < 2; i++ {
+		out.Reset()
+		if err := pullSnapshot(ctx, config, bucket, &out); err != nil {
+			t.Fatal(err)
+		}
+		if i > 0 {
+			break
+		}
+		previous, err := db.Open(config.DbPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = previous.RecordAudit(db.AuditEntry{Timestamp: time.Now(), Operator: "jill", Profile: "staging",
+			ApiUrl: config.ApiUrl, StoreId: syncStoreId, Operation: "write", TupleKeys: db.TupleKeys{"user:jill#viewer@document:2"},
+			StatusCode: 200, Response: "sent from the pulling instance"})
+		if closeErr := previous.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !strings.Contains(out.String(), "previous replica saved as") {
+		t.Errorf("Expected the replica in place to be backed up, got %v", out.String())
+	}
+	if backups, _ := filepath.Glob(config.DbPath + ".*.bak"); len(backups) != 1 {
+		t.Errorf("Expected a backup, got %v", backups)
+	}
+	pulled := openReplica(t, config.DbPath)
+	if c, _ := pulled.CountTuples(nil); c != 2 {
+		t.Errorf("Expected the 2 tuples of the snapshot, got %v", c)
+	}
+	if token := pulled.GetContinuationToken(config.ApiUrl, syncStoreId, ""); token == nil || *token != "5" {
+		t.Errorf("The sync must resume from the token of the snapshot, got %v", token)
+	}
+	if pending, _ := pulled.CountPendingActions(); len(pending) != 0 {
+		t.Errorf("Nothing must be pending in the pulled replica, got %v", pending)
+	}
+	if entries, _ := pulled.GetAuditLog(); len(entries) != 1 || entries[0].Response != "sent from the pulling instance" {
+		t.Errorf("Expected the audit log of the replica replaced, got %v", entries)
+	}
+
+	t.Run("Another store", func(t *testing.T) {
+		fake.objects["/snapshots/team/01HQ3V9WJ3JYQ3Z6P8J1C4C0RD.db.gz"] = object
+		other := storeConfig{Name: "prod", StoreId: "01HQ3V9WJ3JYQ3Z6P8J1C4C0RD", DbPath: filepath.Join(dir, "prod.db")}
+		if err := pullSnapshot(ctx, other, bucket, &out); err == nil || !strings.Contains(err.Error(), syncStoreId) {
+			t.Errorf("Expected the snapshot of another store to be refused, got %v", err)
+		}
+		if _, err := os.Stat(other.DbPath); !os.IsNotExist(err) {
+			t.Errorf("Nothing must be pulled, got %v", err)
+		}
+	})
+}
+
+func TestSnapshotOfTypes(t *testing.T) {
+	fake := newFakeS3(t)
+	ctx := context.Background()
+	bucket, err := newObjectStore("s3://snapshots/team", "", fake.getenv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+
+	pushed, err := newStore(storeConfig{Name: "staging", ApiUrl: "http://staging:8080", StoreId: syncStoreId,
+		Types: []string{"document", "folder"}, DbPath: filepath.Join(dir, "pushed.db")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pushed.close()
+	err = pushed.repo.ApplyChanges([]openfga.TupleChange{
+		{TupleKey: *openfga.NewTupleKey("user:jack", "viewer", "document:1"), Operation: openfga.WRITE, Timestamp: time.Now()},
+	}, db.Connection{ApiUrl: pushed.ApiUrl, StoreId: syncStoreId, Type: "document", ContinuationToken: "7", LastSync: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// synced last, the token of folder alone would describe the snapshot
+	err = pushed.repo.ApplyChanges([]openfga.TupleChange{
+		{TupleKey: *openfga.NewTupleKey("user:jill", "viewer", "folder:1"), Operation: openfga.WRITE, Timestamp: time.Now()},
+	}, db.Connection{ApiUrl: pushed.ApiUrl, StoreId: syncStoreId, Type: "folder", ContinuationToken: "3", LastSync: time.Now().Add(time.Second)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := pushSnapshot(ctx, pushed, bucket, &out); err != nil {
+		t.Fatal(err)
+	}
+	key := "/snapshots/team/" + syncStoreId + ".db.gz"
+	if tokens := fake.objects[key].header.Get("X-Amz-Meta-Continuation-Tokens"); tokens != "document=7&folder=3" {
+		t.Errorf("Expected the token of every type as metadata, got %q", tokens)
+	}
+
+	config := storeConfig{Name: "staging", ApiUrl: "http://fga.internal:8080", StoreId: syncStoreId, DbPath: filepath.Join(dir, "pulled.db")}
+	if err := pullSnapshot(ctx, config, bucket, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), `document token "7", folder token "3"`) {
+		t.Errorf("Expected the token of every type, got %v", out.String())
+	}
+	pulled := openReplica(t, config.DbPath)
+	for objectType, expected := range map[string]string{"document": "7", "folder": "3"} {
+		if token := pulled.GetContinuationToken(config.ApiUrl, syncStoreId, objectType); token == nil || *token != expected {
+			t.Errorf("The sync of %v must resume from %v, got %v", objectType, expected, token)
+		}
+	}
+
+	t.Run("Pushed with the token of a type only", func(t *testing.T) {
+		object := fake.objects[key]
+		object.header = object.header.Clone()
+		object.header.Del("X-Amz-Meta-Continuation-Tokens")
+		object.header.Set("X-Amz-Meta-Continuation-Token", "3")
+		fake.objects[key] = object
+		other := config
+		other.DbPath = filepath.Join(dir, "other.db")
+		if err := pullSnapshot(ctx, other, bucket, &out); err == nil || !strings.Contains(err.Error(), `document token "7"`) {
+			t.Errorf("Expected the tokens of the other types to be checked, got %v", err)
+		}
+		if _, err := os.Stat(other.DbPath); !os.IsNotExist(err) {
+			t.Errorf("Nothing must be pulled, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gdamore/tcell/v2"
+	"github.com/paulosuzart/fgamanager/db"
+	"github.com/rivo/tview"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// statsTopLimit is how many objects and users the top lists have
+	statsTopLimit = 10
+	// statsWindow is how far back the write and delete rates go, a minute per bar
+	statsWindow = time.Hour
+	// statsRefreshInterval is how often the dashboard reads the replica again while shown. Finding the top objects
+	// counts every tuple, so it's not done on every change
+	statsRefreshInterval = 10 * time.Second
+	// lagTimeout caps how long the server is asked for the changes the replica doesn't have
+	lagTimeout = 10 * time.Second
+)
+
+// storeStats is the shape of the replica of a store and how its sync goes, shown by the dashboard and
+// printed by the stats command
+type storeStats struct {
+	Store       string          `json:"store"`
+	StoreId     string          `json:"storeId"`
+	Tuples      int             `json:"tuples"`
+	ObjectTypes []db.ValueCount `json:"objectTypes"`
+	Relations   []db.ValueCount `json:"relations"`
+	UserTypes   []db.ValueCount `json:"userTypes"`
+	TopObjects  []db.ValueCount `json:"topObjects"`
+	TopUsers    []db.ValueCount `json:"topUsers"`
+	// Activity has every minute of the window, the ones the sync applied nothing in too
+	Activity []db.SyncActivity `json:"activity"`
+	Lag      replicaLag        `json:"lag"`
+}
+
+// replicaLag is how far behind the server the replica is, stores synced by type count by the type furthest behind
+type replicaLag struct {
+	// LastSync is nil when the replica was never synced
+	LastSync             *time.Time `json:"lastSync"`
+	SecondsSinceLastSync float64    `json:"secondsSinceLastSync"`
+	// OldestUnapplied is when the oldest change the replica doesn't have was made, nil when it has every change
+	OldestUnapplied        *time.Time `json:"oldestUnapplied"`
+	SecondsOldestUnapplied float64    `json:"secondsOldestUnapplied"`
+	// Error tells why the server couldn't tell the changes the replica doesn't have
+	Error string `json:"error,omitempty"`
+}
+
+// collectStats reads the stats of the replica of s as of now, asking the server for the lag
+func collectStats(ctx context.Context, s *store, now time.Time) (*storeStats, error) {
+	stats := &storeStats{Store: s.Name, StoreId: s.StoreId}
+	counts, err := s.repo.GetTupleCounts()
+	if err != nil {
+		return nil, err
+	}
+	objectTypes, relations, userTypes := map[string]int{}, map[string]int{}, map[string]int{}
+	for _, count := range counts {
+		stats.Tuples += count.Count
+		objectTypes[count.ObjectType] += count.Count
+		relations[count.Relation] += count.Count
+		userTypes[count.UserType] += count.Count
+	}
+	stats.ObjectTypes, stats.Relations, stats.UserTypes = byCount(objectTypes), byCount(relations), byCount(userTypes)
+	if stats.TopObjects, err = s.repo.GetTopObjects(statsTopLimit); err != nil {
+		return nil, err
+	}
+	if stats.TopUsers, err = s.repo.GetTopUsers(statsTopLimit); err != nil {
+		return nil, err
+	}
+
+	first := now.UTC().Truncate(time.Minute).Add(time.Minute - statsWindow)
+	activity, err := s.repo.GetSyncActivity(first)
+	if err != nil {
+		return nil, err
+	}
+	applied := map[int64]db.SyncActivity{}
+	for _, minute := range activity {
+		applied[minute.Minute.Unix()] = minute
+	}
+	for minute := first; !minute.After(now); minute = minute.Add(time.Minute) {
+		stats.Activity = append(stats.Activity, db.SyncActivity{Minute: minute, Writes: applied[minute.Unix()].Writes,
+			Deletes: applied[minute.Unix()].Deletes})
+	}
+
+	stats.Lag = lagOf(ctx, s, now)
+	return stats, nil
+}
+
+// byCount lists the counts, most tuples first
+func byCount(counts map[string]int) []db.ValueCount {
+	result := []db.ValueCount{}
+	for value, count := range counts {
+		result = append(result, db.ValueCount{Value: value, Count: count})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Count != result[j].Count {
+			return result[i].Count > result[j].Count
+		}
+		return result[i].Value < result[j].Value
+	})
+	return result
+}
+
+// lagOf is how far behind the server the replica of s is, asking the server for the first change after the
+// position of every type synced
+func lagOf(ctx context.Context, s *store, now time.Time) replicaLag {
+	var lag replicaLag
+	connections, err := s.repo.GetConnections(s.ApiUrl, s.StoreId)
+	if err != nil {
+		lag.Error = err.Error()
+		return lag
+	}
+	positions := map[string]db.Connection{}
+	for _, connection := range connections {
+		positions[connection.Type] = connection
+	}
+	ctx, cancel := context.WithTimeout(ctx, lagTimeout)
+	defer cancel()
+	neverSynced := false
+	for _, objectType := range s.syncedTypes() {
+		connection, synced := positions[objectType]
+		neverSynced = neverSynced || !synced || connection.LastSync.IsZero()
+		if synced && (lag.LastSync == nil || connection.LastSync.Before(*lag.LastSync)) {
+			lastSync := connection.LastSync
+			lag.LastSync = &lastSync
+		}
+		request := s.client.OpenFgaApi.ReadChanges(ctx).PageSize(1)
+		if objectType != "" {
+			request = request.Type_(objectType)
+		}
+		if synced && connection.ContinuationToken != "" {
+			request = request.ContinuationToken(connection.ContinuationToken)
+		}
+		resp, _, err := request.Execute()
+		if err != nil {
+			lag.Error = err.Error()
+			continue
+		}
+		if changes := resp.GetChanges(); len(changes) > 0 {
+			if oldest := changes[0].GetTimestamp(); lag.OldestUnapplied == nil || oldest.Before(*lag.OldestUnapplied) {
+				lag.OldestUnapplied = &oldest
+			}
+		}
+	}
+	if neverSynced {
+		lag.LastSync = nil
+	}
+	if lag.LastSync != nil {
+		lag.SecondsSinceLastSync = now.Sub(*lag.LastSync).Seconds()
+	}
+	if lag.OldestUnapplied != nil {
+		lag.SecondsOldestUnapplied = now.Sub(*lag.OldestUnapplied).Seconds()
+	}
+	return lag
+}
+
+// ago is a time with how long ago it was, rounded to the second
+func ago(t *time.Time, seconds float64, never string) string {
+	if t == nil {
+		return never
+	}
+	return fmt.Sprintf("%v (%v ago)", t.Local().Format(time.DateTime), time.Duration(seconds*float64(time.Second)).Round(time.Second))
+}
+
+// totalActivity adds up the writes and deletes of every minute
+func totalActivity(activity []db.SyncActivity) (int, int) {
+	writes, deletes := 0, 0
+	for _, minute := range activity {
+		writes += minute.Writes
+		deletes += minute.Deletes
+	}
+	return writes, deletes
+}
+
+// sparkline draws a bar per value, the highest value as the full block
+func sparkline(values []int) string {
+	bars := []rune("▁▂▃▄▅▆▇█")
+	highest := 0
+	for _, value := range values {
+		highest = max(highest, value)
+	}
+	var line strings.Builder
+	for _, value := range values {
+		if value == 0 {
+			line.WriteRune(' ')
+		} else {
+			line.WriteRune(bars[(value*len(bars)-1)/highest])
+		}
+	}
+	return line.String()
+}
+
+// printStats writes the stats of a store as text, a line per part
+func printStats(stats *storeStats, out io.Writer) {
+	unapplied := "every change applied"
+	if stats.Lag.OldestUnapplied != nil {
+		unapplied = "oldest unapplied change " + ago(stats.Lag.OldestUnapplied, stats.Lag.SecondsOldestUnapplied, "")
+	} else if stats.Lag.Error != "" {
+		unapplied = "unapplied changes unknown"
+	}
+	_, _ = fmt.Fprintf(out, "%v: %v tuples, last sync %v, %v\n", stats.Store, stats.Tuples,
+		ago(stats.Lag.LastSync, stats.Lag.SecondsSinceLastSync, "never"), unapplied)
+	if stats.Lag.Error != "" {
+		_, _ = fmt.Fprintf(out, "  lag unknown   %v\n", stats.Lag.Error)
+	}
+	for _, part := range []struct {
+		name   string
+		counts []db.ValueCount
+	}{{"object types", stats.ObjectTypes}, {"relations", stats.Relations}, {"user types", stats.UserTypes},
+		{"top objects", stats.TopObjects}, {"top users", stats.TopUsers}} {
+		var values []string
+		for _, count := range part.counts {
+			values = append(values, fmt.Sprintf("%v %v", count.Value, count.Count))
+		}
+		_, _ = fmt.Fprintf(out, "  %-13v %v\n", part.name, strings.Join(values, ", "))
+	}
+	writes, deletes := totalActivity(stats.Activity)
+	_, _ = fmt.Fprintf(out, "  %-13v %v writes, %v deletes\n", "last hour", writes, deletes)
+}
+
+func runStats(ctx context.Context, configs []storeConfig, asJson bool, out io.Writer) error {
+	stores, err := openForRepair(configs)
+	for _, s := range stores {
+		defer s.close()
+	}
+	if err != nil {
+		return err
+	}
+	var all []*storeStats
+	for _, s := range stores {
+		stats, err := collectStats(ctx, s, time.Now())
+		if err != nil {
+			return fmt.Errorf("stats of %v failed: %w", s.Name, err)
+		}
+		if !asJson {
+			printStats(stats, out)
+		}
+		all = append(all, stats)
+	}
+	if asJson {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(all)
+	}
+	return nil
+}
+
+// statsView is a full screen page with the stats of a store
+type statsView struct {
+	*tview.Flex
+	summary  *tview.TextView
+	counts   []*tview.Table
+	activity *tview.TextView
+}
+
+func newStatsView(onDone func()) *statsView {
+	v := &statsView{
+		Flex:     tview.NewFlex().SetDirection(tview.FlexRow),
+		summary:  tview.NewTextView().SetDynamicColors(true),
+		activity: tview.NewTextView().SetDynamicColors(true),
+	}
+	v.summary.SetBorder(true)
+	v.summary.SetDoneFunc(func(key tcell.Key) {
+		if key == tcell.KeyEscape {
+			onDone()
+		}
+	})
+	v.activity.SetBorder(true).SetTitle(fmt.Sprintf(" Changes applied per minute, last %v ", statsWindow))
+	columns := tview.NewFlex()
+	for _, title := range []string{"Object types", "Relations", "User types", "Top objects", "Top users"} {
+		table := tview.NewTable().SetFixed(1, 0)
+		table.SetBorder(true).SetTitle(" " + title + " ")
+		v.counts = append(v.counts, table)
+		columns.AddItem(table, 0, 1, false)
+	}
+	v.AddItem(v.summary, 5, 0, true).AddItem(columns, 0, 1, false).AddItem(v.activity, 4, 0, false)
+	return v
+}
+
+// loading tells the stats of name are on their way
+func (v *statsView) loading(name string) {
+	v.summary.SetTitle(fmt.Sprintf(" Stats of %v - <esc> to return ", name))
+	v.summary.SetText("Reading the replica...")
+}
+
+func (v *statsView) fail(err error) {
+	v.summary.SetText("[red]" + err.Error())
+}
+
+func (v *statsView) show(stats *storeStats) {
+	v.summary.SetTitle(fmt.Sprintf(" Stats of %v - <esc> to return ", stats.Store))
+	unapplied := "[green]none"
+	if stats.Lag.OldestUnapplied != nil {
+		unapplied = "[orange]" + ago(stats.Lag.OldestUnapplied, stats.Lag.SecondsOldestUnapplied, "")
+	}
+	if stats.Lag.Error != "" {
+		unapplied = "[red]" + stats.Lag.Error
+	}
+	v.summary.SetText(fmt.Sprintf("[yellow]Tuples:[white] %v\n[yellow]Last sync:[white] %v\n[yellow]Oldest unapplied change:[white] %v",
+		stats.Tuples, ago(stats.Lag.LastSync, stats.Lag.SecondsSinceLastSync, "never"), unapplied))
+
+	for i, counts := range [][]db.ValueCount{stats.ObjectTypes, stats.Relations, stats.UserTypes, stats.TopObjects, stats.TopUsers} {
+		table := v.counts[i]
+		table.Clear()
+		table.SetCell(0, 0, tview.NewTableCell("VALUE").SetExpansion(1).SetSelectable(false))
+		table.SetCell(0, 1, tview.NewTableCell("TUPLES").SetAlign(tview.AlignRight).SetSelectable(false))
+		for row, count := range counts {
+			table.SetCell(row+1, 0, tview.NewTableCell(count.Value).SetTextColor(tcell.ColorLightCyan))
+			table.SetCell(row+1, 1, tview.NewTableCell(fmt.Sprint(count.Count)).SetAlign(tview.AlignRight).SetTextColor(tcell.ColorLightCyan))
+		}
+	}
+
+	writes, deletes := make([]int, len(stats.Activity)), make([]int, len(stats.Activity))
+	for i, minute := range stats.Activity {
+		writes[i], deletes[i] = minute.Writes, minute.Deletes
+	}
+	totalWrites, totalDeletes := totalActivity(stats.Activity)
+	v.activity.SetText(fmt.Sprintf("[lightgreen]Writes  %v[white] %v\n[lightcoral]Deletes %v[white] %v",
+		sparkline(writes), totalWrites, sparkline(deletes), totalDeletes))
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	openfga "github.com/openfga/go-sdk"
+	"github.com/paulosuzart/fgamanager/db"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCollectStats(t *testing.T) {
+	fake := newFakeFga(t)
+	fake.addChanges(syncStoreId, openfga.WRITE, "user:1 viewer document:1", "user:2 viewer document:1", "user:1 owner folder:1")
+	s := newSyncedStore(t, fake)
+
+	t.Run("Never synced", func(t *testing.T) {
+		stats, err := collectStats(context.Background(), s, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Tuples != 0 || stats.Lag.LastSync != nil || stats.Lag.OldestUnapplied == nil {
+			t.Errorf("Expected no tuples and every change unapplied, got %+v", stats)
+		}
+	})
+
+	syncUntil(t, s, func(u WatchUpdate) bool { return u.Status.State == caughtUp })
+	fake.addChanges(syncStoreId, openfga.DELETE, "user:2 viewer document:1")
+	stats, err := collectStats(context.Background(), s, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Tuples != 3 {
+		t.Errorf("Expected 3 tuples, got %v", stats.Tuples)
+	}
+	if expected := []db.ValueCount{{Value: "document", Count: 2}, {Value: "folder", Count: 1}}; !reflect.DeepEqual(stats.ObjectTypes, expected) {
+		t.Errorf("Expected %v, got %v", expected, stats.ObjectTypes)
+	}
+	if stats.TopObjects[0] != (db.ValueCount{Value: "document:1", Count: 2}) || stats.TopUsers[0] != (db.ValueCount{Value: "user:1", Count: 2}) {
+		t.Errorf("Expected document:1 and user:1 on top, got %v and %v", stats.TopObjects, stats.TopUsers)
+	}
+	if writes, deletes := totalActivity(stats.Activity); len(stats.Activity) != int(statsWindow/time.Minute) || writes != 3 || deletes != 0 {
+		t.Errorf("Expected 3 writes in the minutes of the window, got %v and %v in %v minutes", writes, deletes, len(stats.Activity))
+	}
+	if stats.Lag.LastSync == nil || stats.Lag.OldestUnapplied == nil || stats.Lag.Error != "" {
+		t.Errorf("Expected the last sync and the delete unapplied, got %+v", stats.Lag)
+	}
+
+	var out bytes.Buffer
+	printStats(stats, &out)
+	for _, expected := range []string{"test: 3 tuples, last sync", "oldest unapplied change", "  object types  document 2, folder 1", "  last hour     3 writes, 0 deletes"} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Expected %q in %v", expected, out.String())
+		}
+	}
+
+	t.Run("Server down", func(t *testing.T) {
+		fake.failWith(500, 500, 500, 500)
+		stats, err := collectStats(context.Background(), s, time.Now())
+		if err != nil || stats.Lag.Error == "" || stats.Tuples != 3 {
+			t.Errorf("Expected the stats of the replica with the lag unknown, got %+v (%v)", stats, err)
+		}
+	})
+}
+
+func TestSparkline(t *testing.T) {
+	if line := sparkline([]int{0, 1, 4, 8}); line != " ▁▄█" {
+		t.Errorf("Expected bars up to the highest value, got %q", line)
+	}
+	if line := sparkline([]int{0, 0}); line != "  " {
+		t.Errorf("Expected no bars without values, got %q", line)
+	}
+}
@@ -0,0 +1,586 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/gdamore/tcell/v2"
+	"github.com/ggwhite/go-masker"
+	openfga "github.com/openfga/go-sdk"
+	"github.com/openfga/go-sdk/credentials"
+	"github.com/paulosuzart/fgamanager/db"
+	"github.com/rivo/tview"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// storeConfig says where a store lives, how it's synced and where its replica is kept
+type storeConfig struct {
+	Name         string
+	ApiUrl       string
+	StoreId      string
+	DbPath       string
+	ApiToken     string
+	SyncInterval time.Duration
+	PageSize     int32
+	ReadOnly     bool
+	// Types are the object types replicated, every type when empty
+	Types []string
+}
+
+// parseStoreArg reads a --storeId value in the form [name=]storeId[@apiUrl], the rest of the settings come from base
+func parseStoreArg(arg string, base storeConfig) (storeConfig, error) {
+	config := base
+	if i := strings.Index(arg, "="); i >= 0 && (!strings.Contains(arg, "@") || i < strings.Index(arg, "@")) {
+		config.Name = arg[:i]
+		arg = arg[i+1:]
+	}
+	if id, server, found := strings.Cut(arg, "@"); found {
+		config.ApiUrl = server
+		arg = id
+	}
+	config.StoreId = arg
+	if config.StoreId == "" {
+		return config, fmt.Errorf("store id missing in %q", arg)
+	}
+	if _, err := url.ParseRequestURI(config.ApiUrl); err != nil {
+		return config, fmt.Errorf("api url of store %v is malformed: %w", config.StoreId, err)
+	}
+	if config.Name == "" {
+		config.Name = masker.ID(config.StoreId)
+	}
+	return config, nil
+}
+
+// storeConfigs turns every --storeId into a config
+func storeConfigs(args []string, base storeConfig) ([]storeConfig, error) {
+	var configs []storeConfig
+	seen := map[string]bool{}
+	for _, arg := range args {
+		config, err := parseStoreArg(arg, base)
+		if err != nil {
+			return nil, err
+		}
+		if seen[config.StoreId] {
+			return nil, fmt.Errorf("store %v given more than once", config.StoreId)
+		}
+		seen[config.StoreId] = true
+		configs = append(configs, config)
+	}
+	return configs, nil
+}
+
+func newClient(config storeConfig) (*openfga.APIClient, error) {
+	configuration := openfga.Configuration{
+		ApiUrl:  config.ApiUrl,
+		StoreId: config.StoreId,
+	}
+	if config.ApiToken != "" {
+		configuration.Credentials = &credentials.Credentials{
+			Method: credentials.CredentialsMethodApiToken,
+			Config: &credentials.Config{ApiToken: config.ApiToken},
+		}
+	}
+	clientConfiguration, err := openfga.NewConfiguration(configuration)
+	if err != nil {
+		return nil, err
+	}
+	return openfga.NewAPIClient(clientConfiguration), nil
+}
+
+// store is a connected store with its own client, replica and workers
+type store struct {
+	storeConfig
+	client *openfga.APIClient
+	fga    fgaService
+	repo   db.Repository
+	// log adds the store to every record
+	log     *slog.Logger
+	backoff backoff
+	// bus is told about every change to the replica, nil outside of a session
+	bus *changeBus
+	// followed is the last sync of another instance seen in a shared replica
+	followed time.Time
+	// metrics counts what the sync and the deletion worker did, nil outside of a session
+	metrics *storeMetrics
+
+	// election keeps the election of a shared replica and resetSync from starting and stopping the sync at once
+	election sync.Mutex
+	lock     sync.RWMutex
+	// updates is the last update of every type synced
+	updates map[string]WatchUpdate
+	// stopReads cancels the sync of every type and readers waits for them to return
+	stopReads context.CancelFunc
+	readers   sync.WaitGroup
+	// stopWorkers cancels the election and the deletion worker and workers waits for them to return
+	stopWorkers context.CancelFunc
+	workers     sync.WaitGroup
+	// stopped tells resetSync the store is being closed, kept under election
+	stopped bool
+}
+
+func newStore(config storeConfig, journal *auditJournal) (*store, error) {
+	client, err := newClient(config)
+	if err != nil {
+		return nil, err
+	}
+	repo, err := db.Open(config.DbPath)
+	if err == nil {
+		if err = repo.ClaimReplica(config.StoreId); err != nil {
+			_ = repo.Close()
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to open the replica %v: %w", db.RedactDataSource(config.DbPath), err)
+	}
+	repo.EnableHistory(*keepHistory)
+	return &store{
+		storeConfig: config,
+		client:      client,
+		fga:         newFgaService(config, client, repo, journal),
+		repo:        repo,
+		log:         slog.With("store", config.Name, "store_id", config.StoreId),
+		backoff:     defaultBackoff,
+	}, nil
+}
+
+// syncedTypes are the scopes the store is synced by, a single empty one when every type is
+func (s *store) syncedTypes() []string {
+	if len(s.Types) == 0 {
+		return []string{""}
+	}
+	return s.Types
+}
+
+// start runs the sync of every type and the deletion worker of the store, read only stores only sync.
+// A shared replica is synced by a single instance of the team, elected among the ones that have it open,
+// while every instance sends the deletions marked in it
+func (s *store) start(ctx context.Context, watchUpdatesChan chan WatchUpdate) {
+	ctx, s.stopWorkers = context.WithCancel(ctx)
+	if !s.ReadOnly {
+		s.workers.Add(1)
+		go func() {
+			defer s.workers.Done()
+			deleteMarked(ctx, s.repo, s.owner(), s.fga, s.log, s.metrics)
+		}()
+	}
+	if db.IsShared(s.DbPath) {
+		s.workers.Add(1)
+		go func() {
+			defer s.workers.Done()
+			s.elect(ctx, watchUpdatesChan)
+		}()
+		return
+	}
+	s.startSync(ctx, watchUpdatesChan)
+}
+
+// stop stops the sync, the election and the deletion worker of the store and waits for them, so the replica can
+// be closed
+func (s *store) stop() {
+	if s.stopWorkers != nil {
+		s.stopWorkers()
+	}
+	s.workers.Wait()
+	s.election.Lock()
+	defer s.election.Unlock()
+	s.stopped = true
+	s.stopSync()
+}
+
+// owner is who the deletions marked through the store are sent by, the operator with the profile it was opened with
+func (s *store) owner() string {
+	return operator() + "@" + s.Name
+}
+
+// elect checks every sync interval whether this instance is the syncer of the shared replica, syncing while it
+// is and following the sync of the elected one while it isn't
+func (s *store) elect(ctx context.Context, watchUpdatesChan chan WatchUpdate) {
+	for {
+		s.election.Lock()
+		elected, err := s.repo.ElectSyncer(ctx, s.ApiUrl, s.StoreId)
+		if elected && !s.syncing() {
+			s.log.Info("Elected to sync the shared replica", "operation", "sync")
+			if _, err := s.repo.ScopeTypes(s.StoreId, s.Types); err != nil {
+				s.log.Error("Failed to scope the shared replica", "operation", "scope", "err", err)
+			}
+			s.startSync(ctx, watchUpdatesChan)
+		} else if !elected && s.syncing() {
+			s.log.Warn("Lost the sync of the shared replica", "operation", "sync", "err", err)
+			s.stopSync()
+		}
+		s.election.Unlock()
+		if !elected {
+			s.follow(err, watchUpdatesChan)
+		}
+		if !wait(ctx, s.SyncInterval) {
+			return
+		}
+	}
+}
+
+// follow publishes the sync of the elected instance, as far as the shared replica tells
+func (s *store) follow(electionErr error, watchUpdatesChan chan WatchUpdate) {
+	lastSync := time.Time{}
+	if connection := s.repo.GetConnection(s.ApiUrl, s.StoreId); connection != nil {
+		lastSync = connection.LastSync
+	}
+	if !lastSync.Equal(s.followed) {
+		s.followed = lastSync
+		s.bus.publish(changeEvent{Store: s, Rebuilt: true})
+	}
+	for _, objectType := range s.syncedTypes() {
+		update := WatchUpdate{Store: s, Type: objectType, Status: syncStatus{State: following, LastSuccess: lastSync}}
+		update.Token = s.repo.GetContinuationToken(s.ApiUrl, s.StoreId, objectType)
+		if electionErr != nil {
+			update.Status.LastError = electionErr.Error()
+		}
+		s.publish(update, watchUpdatesChan)
+	}
+}
+
+// startSync runs the sync of every type until stopSync
+func (s *store) startSync(ctx context.Context, watchUpdatesChan chan WatchUpdate) {
+	readCtx, cancel := context.WithCancel(ctx)
+	s.lock.Lock()
+	s.stopReads = cancel
+	s.updates = nil
+	s.lock.Unlock()
+	for _, objectType := range s.syncedTypes() {
+		s.readers.Add(1)
+		go func(objectType string) {
+			defer s.readers.Done()
+			read(readCtx, s, objectType, watchUpdatesChan)
+		}(objectType)
+	}
+}
+
+// stopSync stops the sync of every type and waits for it
+func (s *store) stopSync() {
+	s.lock.RLock()
+	stop := s.stopReads
+	s.lock.RUnlock()
+	if stop != nil {
+		stop()
+	}
+	s.readers.Wait()
+	s.lock.Lock()
+	s.stopReads = nil
+	s.lock.Unlock()
+}
+
+// syncing tells whether the sync was started and not stopped since, it may have failed for good meanwhile
+func (s *store) syncing() bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.stopReads != nil
+}
+
+// rejectedTypes are the types whose continuation token the server refused
+func (s *store) rejectedTypes() []string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	var types []string
+	for _, objectType := range s.syncedTypes() {
+		if update, found := s.updates[objectType]; found && update.Status.State == rejected {
+			types = append(types, objectType)
+		}
+	}
+	return types
+}
+
+// publish keeps the update as the last state of its type and sends it to the UI
+func (s *store) publish(update WatchUpdate, watchUpdatesChan chan WatchUpdate) {
+	s.lock.Lock()
+	if s.updates == nil {
+		s.updates = map[string]WatchUpdate{}
+	}
+	s.updates[update.Type] = update
+	s.lock.Unlock()
+	watchUpdatesChan <- update
+}
+
+// syncSeverity orders the states from the one needing the user the most
+var syncSeverity = map[syncState]int{rejected: 5, failed: 4, backingOff: 3, catchingUp: 2, syncing: 1, following: 0, caughtUp: 0}
+
+// getLastUpdate is the last state of the sync, nil before the first one. When several types are synced
+// it's the last update of the type in the worst state
+func (s *store) getLastUpdate() *WatchUpdate {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	var worst *WatchUpdate
+	for _, objectType := range s.syncedTypes() {
+		update, found := s.updates[objectType]
+		if found && (worst == nil || syncSeverity[update.Status.State] > syncSeverity[worst.Status.State]) {
+			worst = &update
+		}
+	}
+	return worst
+}
+
+// typeStates describes the state of every type synced, "every type" when the store isn't type scoped
+func (s *store) typeStates() string {
+	if len(s.Types) == 0 {
+		return "every type"
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	var states []string
+	for _, objectType := range s.Types {
+		state := "??"
+		if update, found := s.updates[objectType]; found {
+			state = update.Status.State.String()
+		}
+		states = append(states, fmt.Sprintf("%v (%v)", objectType, state))
+	}
+	return strings.Join(states, ", ")
+}
+
+func (s *store) close() {
+	if err := s.repo.Close(); err != nil {
+		s.log.Error("Failed to close the replica", "replica", db.RedactDataSource(s.DbPath), "err", err)
+	}
+}
+
+// defaultReplica is the replica used by fgamanager before it could manage several stores
+const defaultReplica = "fga.db"
+
+// ownsReplica tells whether the replica at path is unused or already holds storeId
+func ownsReplica(path, storeId string) bool {
+	replica, err := db.IsReplica(path)
+	if os.IsNotExist(err) || (err == nil && !replica) {
+		return true
+	}
+	if err != nil {
+		return false
+	}
+	owner, err := db.ReplicaStoreId(path)
+	return err != nil || owner == storeId
+}
+
+// session is every store open in this run of fgamanager
+type session struct {
+	ctx              context.Context
+	watchUpdatesChan chan WatchUpdate
+	changes          *changeBus
+	journal          *auditJournal
+	lock             sync.RWMutex
+	stores           []*store
+}
+
+func newSession(ctx context.Context) *session {
+	return &session{
+		ctx:              ctx,
+		watchUpdatesChan: make(chan WatchUpdate, 10),
+		changes:          &changeBus{},
+	}
+}
+
+// replicaPath keeps fga.db for the store it holds, or for the first store if it's unused.
+// Any other store gets fga-<storeId>.db
+func (s *session) replicaPath(storeId string) string {
+	for _, open := range s.stores {
+		if open.DbPath == defaultReplica {
+			return fmt.Sprintf("fga-%v.db", storeId)
+		}
+	}
+	if ownsReplica(defaultReplica, storeId) {
+		return defaultReplica
+	}
+	return fmt.Sprintf("fga-%v.db", storeId)
+}
+
+// replicaOf is the replica of a store opened outside of a session
+func replicaOf(config storeConfig) string {
+	if config.DbPath != "" {
+		return config.DbPath
+	}
+	return (&session{}).replicaPath(config.StoreId)
+}
+
+// add opens the replica of a store and starts syncing it
+func (s *session) add(config storeConfig) (*store, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, open := range s.stores {
+		if open.StoreId == config.StoreId {
+			return nil, fmt.Errorf("store %v is already open", config.StoreId)
+		}
+	}
+	if config.DbPath == "" {
+		config.DbPath = s.replicaPath(config.StoreId)
+	}
+	opened, err := newStore(config, s.journal)
+	if err != nil {
+		return nil, err
+	}
+	opened.bus = s.changes
+	opened.metrics = newStoreMetrics()
+	if pruneStale != nil && *pruneStale {
+		opened.log.Info("Pruning stale entries", "operation", "prune")
+		rowsAffected, err := opened.repo.Prune()
+		if err != nil {
+			opened.close()
+			return nil, err
+		}
+		opened.log.Info("Pruned stale entries", "operation", "prune", "rows", rowsAffected)
+	}
+	// a shared replica is scoped by its syncer
+	if !db.IsShared(opened.DbPath) {
+		dropped, err := opened.repo.ScopeTypes(opened.StoreId, opened.Types)
+		if err != nil {
+			opened.close()
+			return nil, err
+		}
+		if dropped > 0 {
+			opened.log.Info("Dropped tuples of types not replicated", "operation", "scope", "types", opened.Types, "rows", dropped)
+		}
+	}
+	opened.start(s.ctx, s.watchUpdatesChan)
+	s.stores = append(s.stores, opened)
+	opened.log.Info("Opened store", "replica", db.RedactDataSource(opened.DbPath))
+	return opened, nil
+}
+
+// resetSync drops the continuation tokens the server rejected and rebuilds the replica of a store from the Read
+// endpoint. The types rejected catch up from the first change afterwards, the others go on from their tokens.
+// The sync is restarted even if the rebuild fails, unless another instance was elected to sync the shared replica
+func (s *session) resetSync(st *store) error {
+	st.election.Lock()
+	defer st.election.Unlock()
+	if st.stopped {
+		return fmt.Errorf("%v is being closed", st.Name)
+	}
+	types := st.rejectedTypes()
+	if len(types) == 0 {
+		types = st.syncedTypes()
+	}
+	st.stopSync()
+	elected, err := st.repo.ElectSyncer(s.ctx, st.ApiUrl, st.StoreId)
+	if err == nil && !elected {
+		err = fmt.Errorf("another instance syncs the shared replica of %v now, leaving the reset to it", st.Name)
+	}
+	if err != nil {
+		st.log.Error("Failed to reset the sync", "operation", "resync", "err", err)
+		return err
+	}
+	err = st.repo.RecordSyncEvent(db.SyncEvent{Timestamp: time.Now(), ApiUrl: st.ApiUrl, StoreId: st.StoreId,
+		Event: db.TokenReset, Reason: "reset by " + operator()})
+	if err == nil {
+		err = st.repo.ResetContinuationTokens(st.StoreId, types)
+	}
+	if err == nil {
+		st.log.Info("Continuation tokens reset, rebuilding the replica", "operation", "resync", "types", types)
+		err = resync(s.ctx, st, io.Discard)
+	}
+	if err != nil {
+		st.log.Error("Failed to reset the sync", "operation", "resync", "err", err)
+	}
+	st.bus.publish(changeEvent{Store: st, Rebuilt: true})
+	st.startSync(s.ctx, s.watchUpdatesChan)
+	return err
+}
+
+func (s *session) list() []*store {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return append([]*store(nil), s.stores...)
+}
+
+// find returns the open store with storeId, nil if it's not open
+func (s *session) find(storeId string) *store {
+	for _, open := range s.list() {
+		if open.StoreId == storeId {
+			return open
+		}
+	}
+	return nil
+}
+
+// close stops every store before closing its replica. The updates published meanwhile are drained, the UI may
+// not read them anymore and the readers would wait to publish otherwise
+func (s *session) close() {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-s.watchUpdatesChan:
+			case <-done:
+				return
+			}
+		}
+	}()
+	for _, open := range s.list() {
+		open.stop()
+		open.close()
+	}
+}
+
+// storeSwitcher is a full screen page listing the stores of the session
+type storeSwitcher struct {
+	*tview.Table
+	stores []*store
+}
+
+func newStoreSwitcher(onSelect func(*store), onDone func()) *storeSwitcher {
+	table := tview.NewTable().SetSelectable(true, false).SetFixed(1, 0)
+	table.SetBorder(true).SetTitle(" Stores - <enter> to switch, <esc> to return ")
+	w := &storeSwitcher{Table: table}
+	table.SetSelectedFunc(func(row, _ int) {
+		if row > 0 {
+			onSelect(w.stores[row-1])
+		}
+	})
+	table.SetDoneFunc(func(key tcell.Key) {
+		if key == tcell.KeyEscape {
+			onDone()
+		}
+	})
+	return w
+}
+
+// show refreshes the list, last sync and tuple count are read from each replica
+func (w *storeSwitcher) show(stores []*store, current *store) {
+	w.stores = stores
+	w.Clear()
+	for column, header := range []string{"  ", "NAME                ", "SERVER                        ", "STORE ID                    ", "LAST SYNC                ", "TUPLES      ", "SYNC        ", "TYPES       "} {
+		w.SetCell(0, column, tview.NewTableCell(header).SetSelectable(false))
+	}
+	for i, s := range w.stores {
+		row := i + 1
+		marker := ""
+		if s == current {
+			marker = "*"
+			w.Select(row, 0)
+		}
+		lastSync := "never"
+		if connection := s.repo.GetConnection(s.ApiUrl, s.StoreId); connection != nil {
+			lastSync = connection.LastSync.Format(time.DateTime)
+		}
+		types := "all"
+		if len(s.Types) > 0 {
+			types = strings.Join(s.Types, ", ")
+		}
+		watch := "??"
+		if update := s.getLastUpdate(); update != nil {
+			watch = update.Status.progress()
+		}
+		w.SetCell(row, 0, tview.NewTableCell(marker).SetTextColor(tcell.ColorDarkOrange))
+		w.SetCell(row, 1, tview.NewTableCell(s.Name).SetTextColor(tcell.ColorLightCyan))
+		w.SetCell(row, 2, tview.NewTableCell(s.ApiUrl).SetTextColor(tcell.ColorLightCyan))
+		w.SetCell(row, 3, tview.NewTableCell(masker.ID(s.StoreId)).SetTextColor(tcell.ColorLightCyan))
+		w.SetCell(row, 4, tview.NewTableCell(lastSync).SetTextColor(tcell.ColorLightCyan))
+		tuples := "??"
+		if count, err := s.repo.CountTuples(nil); err == nil {
+			tuples = fmt.Sprintf("%v", count)
+		}
+		w.SetCell(row, 5, tview.NewTableCell(tuples).SetTextColor(tcell.ColorLightCyan))
+		w.SetCell(row, 6, tview.NewTableCell(watch).SetTextColor(tcell.ColorLightBlue))
+		w.SetCell(row, 7, tview.NewTableCell(types).SetTextColor(tcell.ColorLightCyan))
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/paulosuzart/fgamanager/db"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestStoreConfigs(t *testing.T) {
+	base := storeConfig{ApiUrl: "http://localhost:8087", PageSize: defaultPageSize, SyncInterval: defaultSyncInterval}
+	t.Run("Store arg forms", func(t *testing.T) {
+		cases := map[string]storeConfig{
+			"01HME1":                       {Name: "01HME1****", ApiUrl: "http://localhost:8087", StoreId: "01HME1", PageSize: defaultPageSize, SyncInterval: defaultSyncInterval},
+			"prod=01HME1":                  {Name: "prod", ApiUrl: "http://localhost:8087", StoreId: "01HME1", PageSize: defaultPageSize, SyncInterval: defaultSyncInterval},
+			"01HME1@https://fga:8080":      {Name: "01HME1****", ApiUrl: "https://fga:8080", StoreId: "01HME1", PageSize: defaultPageSize, SyncInterval: defaultSyncInterval},
+			"prod=01HME1@https://fga:8080": {Name: "prod", ApiUrl: "https://fga:8080", StoreId: "01HME1", PageSize: defaultPageSize, SyncInterval: defaultSyncInterval},
+			"01HME1@https://fga:8080/?a=b": {Name: "01HME1****", ApiUrl: "https://fga:8080/?a=b", StoreId: "01HME1", PageSize: defaultPageSize, SyncInterval: defaultSyncInterval},
+		}
+		for arg, expected := range cases {
+			config, err := parseStoreArg(arg, base)
+			if err != nil {
+				t.Errorf("%v: unexpected error %v", arg, err)
+			}
+			if !reflect.DeepEqual(config, expected) {
+				t.Errorf("%v: expected %+v, got %+v", arg, expected, config)
+			}
+		}
+	})
+
+	t.Run("Invalid store args", func(t *testing.T) {
+		for _, arg := range []string{"", "prod=", "01HME1@not a url"} {
+			if _, err := parseStoreArg(arg, base); err == nil {
+				t.Errorf("%q: expected an error", arg)
+			}
+		}
+	})
+
+	t.Run("Repeated stores", func(t *testing.T) {
+		if _, err := storeConfigs([]string{"01HME1", "staging=01HME1"}, base); err == nil {
+			t.Error("Repeated stores must be refused")
+		}
+	})
+}
+
+func TestReplicaPath(t *testing.T) {
+	dir := t.TempDir()
+	wd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.Chdir(wd) }()
+
+	s := newSession(context.Background())
+	if path := s.replicaPath("01HME1"); path != defaultReplica {
+		t.Errorf("An unused fga.db goes to the first store, got %v", path)
+	}
+
+	repo, err := db.Open(defaultReplica)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.UpsertConnection(db.Connection{ApiUrl: "http://localhost:8087", StoreId: "01HME1"}); err != nil {
+		t.Fatal(err)
+	}
+	_ = repo.Close()
+
+	if path := s.replicaPath("01HME1"); path != defaultReplica {
+		t.Errorf("fga.db must be kept for its store, got %v", path)
+	}
+	if path := s.replicaPath("01HME2"); path != "fga-01HME2.db" {
+		t.Errorf("fga.db of another store must not be reused, got %v", path)
+	}
+
+	s.stores = append(s.stores, &store{storeConfig: storeConfig{StoreId: "01HME3", DbPath: defaultReplica}})
+	if path := s.replicaPath("01HME1"); path != "fga-01HME1.db" {
+		t.Errorf("fga.db is in use by another open store, got %v", path)
+	}
+}
+
+func TestReplicaOfAnotherStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fga.db")
+	first, err := newStore(storeConfig{Name: "first", ApiUrl: "http://localhost:8087", StoreId: "01HME1444HSEY9022AENH1YYKF", DbPath: path}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.close()
+	if owns := ownsReplica(path, "01HQ3V9WJ3JYQ3Z6P8J1C4C0RD"); owns {
+		t.Error("A replica opened for a store is taken before its first sync")
+	}
+	if _, err := newStore(storeConfig{Name: "second", ApiUrl: "http://localhost:8087", StoreId: "01HQ3V9WJ3JYQ3Z6P8J1C4C0RD", DbPath: path}, nil); err == nil {
+		t.Error("The replica of another store must be refused")
+	}
+}
+
+func TestStoreAdmin(t *testing.T) {
+	fake := newFakeFga(t)
+	for i := 0; i < 150; i++ {
+		fake.addStore(fmt.Sprintf("store-%v", i))
+	}
+	admin, err := newServerAdmin(storeConfig{ApiUrl: fake.server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	t.Run("List pages through every store", func(t *testing.T) {
+		stores, err := admin.listStores(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(stores) != 150 {
+			t.Errorf("Expected 150 stores, got %v", len(stores))
+		}
+	})
+
+	t.Run("Create and delete", func(t *testing.T) {
+		created, err := admin.createStore(ctx, "staging")
+		if err != nil {
+			t.Fatal(err)
+		}
+		found, err := findStore(ctx, admin, created.Id)
+		if err != nil || confirmationOf(found) != "staging" {
+			t.Fatalf("Created store not listed: %v %v", found, err)
+		}
+		if err := admin.deleteStore(ctx, created.Id); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := findStore(ctx, admin, created.Id); err == nil {
+			t.Error("Deleted store still listed")
+		}
+	})
+
+	t.Run("Delete unknown store", func(t *testing.T) {
+		if err := admin.deleteStore(ctx, "01HME1444HSEY9022AENH99999"); err == nil {
+			t.Error("Expected an error")
+		}
+	})
+}
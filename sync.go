@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	openfga "github.com/openfga/go-sdk"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// syncState is where the sync of a store stands
+type syncState int
+
+const (
+	// catchingUp while pages come full, fetching them back to back
+	catchingUp syncState = iota
+	// syncing while pages come with changes
+	syncing
+	// caughtUp once a page comes empty, the replica has every change
+	caughtUp
+	// backingOff after a failure that may go away, waiting to retry
+	backingOff
+	// failed after a failure retrying won't fix, the sync stops
+	failed
+	// rejected when the server refuses the continuation token, the sync stops until the token is reset
+	rejected
+	// following while another instance is elected to sync the shared replica
+	following
+)
+
+func (s syncState) String() string {
+	return [...]string{"Catching up", "Syncing", "Caught up", "Backing off", "Failed", "Token rejected", "Following the syncer"}[s]
+}
+
+// syncStatus is the state of the sync of a store with what the info bar shows about it
+type syncStatus struct {
+	State       syncState
+	LastError   string
+	LastSuccess time.Time
+	// Failures counts the failures since the last success
+	Failures int
+	RetryAt  time.Time
+	// Applied counts the changes applied since catch-up started, Rate is how many per second
+	Applied int
+	Rate    float64
+}
+
+// progress is the state with the catch-up progress while catching up
+func (s syncStatus) progress() string {
+	if s.State != catchingUp {
+		return s.State.String()
+	}
+	return fmt.Sprintf("%v, %v changes at %.0f/s", s.State, s.Applied, s.Rate)
+}
+
+// backoff doubles the wait after every failure up to max, with jitter so stores failing together
+// don't retry together
+type backoff struct {
+	base, max time.Duration
+	// jitter returns a number in [0, 1)
+	jitter func() float64
+}
+
+var defaultBackoff = backoff{base: time.Second, max: 2 * time.Minute, jitter: rand.Float64}
+
+// delay is the wait before the retry following the given number of failures, between half and all of
+// base * 2^(failures-1)
+func (b backoff) delay(failures int) time.Duration {
+	d := b.max
+	if failures < 32 {
+		d = min(b.base<<(failures-1), b.max)
+	}
+	return d/2 + time.Duration(b.jitter()*float64(d/2))
+}
+
+// retryable tells failures that may go away, network errors, rate limits and server errors, from
+// the ones that need the user, like a wrong store id or credentials
+func retryable(resp *http.Response, err error) bool {
+	if resp == nil {
+		return !errors.Is(err, context.Canceled)
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError
+}
+
+// tokenRejected tells the server refusing the continuation token, because it expired or comes from another
+// store or server. Retrying with it won't help
+func tokenRejected(err error) bool {
+	var validation openfga.FgaApiValidationError
+	return errors.As(err, &validation) && validation.ResponseCode() == openfga.INVALID_CONTINUATION_TOKEN
+}
+
+// wait sleeps for d, false if ctx is done before
+func wait(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// runSync keeps the replicas of the stores in sync without the TUI until interrupted, with the deletion worker
+// of the stores that aren't read only. The state changes of every type synced are logged, and the metrics are
+// served at /metrics when metricsAddress is given
+func runSync(configs []storeConfig, journal *auditJournal, metricsAddress string) error {
+	if len(configs) == 0 {
+		return fmt.Errorf("give the stores with --storeId or --profile")
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	stores := newSession(ctx)
+	stores.journal = journal
+	// stops the sync of every store before closing its replica
+	defer stores.close()
+	for _, config := range configs {
+		if _, err := stores.add(config); err != nil {
+			return fmt.Errorf("unable to open store %v: %w", config.StoreId, err)
+		}
+	}
+	if metricsAddress != "" {
+		address, err := serveMetrics(ctx, metricsAddress, stores)
+		if err != nil {
+			return fmt.Errorf("unable to serve the metrics: %w", err)
+		}
+		slog.Info("Serving metrics", "operation", "metrics", "address", address.String())
+		fmt.Printf("Metrics at http://%v/metrics\n", address)
+	}
+	fmt.Printf("Syncing %v stores, interrupt to stop\n", len(configs))
+
+	states := map[*store]map[string]syncState{}
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Info("Sync interrupted", "operation", "sync")
+			return nil
+		case update := <-stores.watchUpdatesChan:
+			s := update.Store
+			if states[s] == nil {
+				states[s] = map[string]syncState{}
+			}
+			if state, found := states[s][update.Type]; !found || state != update.Status.State {
+				states[s][update.Type] = update.Status.State
+				s.log.Info("Sync state changed", "operation", "sync", "type", update.Type, "state", update.Status.State.String())
+			}
+		}
+	}
+}
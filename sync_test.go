@@ -0,0 +1,565 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	openfga "github.com/openfga/go-sdk"
+	"github.com/paulosuzart/fgamanager/db"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	b := backoff{base: time.Second, max: time.Minute, jitter: func() float64 { return 0 }}
+	for failures, expected := range map[int]time.Duration{1: 500 * time.Millisecond, 2: time.Second, 4: 4 * time.Second, 7: 30 * time.Second, 100: 30 * time.Second} {
+		if d := b.delay(failures); d != expected {
+			t.Errorf("Expected %v after %v failures, got %v", expected, failures, d)
+		}
+	}
+	b.jitter = func() float64 { return 0.999 }
+	if d := b.delay(3); d < 3900*time.Millisecond || d > 4*time.Second {
+		t.Errorf("Jitter must stay below the full delay, got %v", d)
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	cases := []struct {
+		status    int
+		err       error
+		retryable bool
+	}{
+		{0, errors.New("connection refused"), true},
+		{0, context.Canceled, false},
+		{http.StatusTooManyRequests, errors.New("rate limited"), true},
+		{http.StatusServiceUnavailable, errors.New("unavailable"), true},
+		{http.StatusNotFound, errors.New("store not found"), false},
+		{http.StatusUnauthorized, errors.New("unauthorized"), false},
+	}
+	for _, c := range cases {
+		var resp *http.Response
+		if c.status != 0 {
+			resp = &http.Response{StatusCode: c.status}
+		}
+		if retryable(resp, c.err) != c.retryable {
+			t.Errorf("%v %v: expected retryable %v", c.status, c.err, c.retryable)
+		}
+	}
+}
+
+const syncStoreId = "01HME1444HSEY9022AENH1YYKF"
+
+func newSyncedStore(t *testing.T, fake *fakeFga) *store {
+	config := storeConfig{Name: "test", ApiUrl: fake.server.URL, StoreId: syncStoreId, PageSize: 2, SyncInterval: time.Millisecond}
+	client, err := newClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the sync runs on several connections, in memory they would be different databases
+	repo := openReplica(t, filepath.Join(t.TempDir(), "fga.db"))
+	return &store{
+		storeConfig: config,
+		client:      client,
+		repo:        repo,
+		log:         slog.Default(),
+		backoff:     backoff{base: time.Millisecond, max: 4 * time.Millisecond, jitter: func() float64 { return 0 }},
+	}
+}
+
+// syncUntil runs read until an update matches done and returns every update up to it
+func syncUntil(t *testing.T, s *store, done func(WatchUpdate) bool) []WatchUpdate {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates := make(chan WatchUpdate)
+	go read(ctx, s, "", updates)
+	var received []WatchUpdate
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case update := <-updates:
+			received = append(received, update)
+			if done(update) {
+				return received
+			}
+		case <-timeout:
+			t.Fatalf("Sync didn't reach the expected state, got %+v", received)
+		}
+	}
+}
+
+func states(updates []WatchUpdate) []syncState {
+	var result []syncState
+	for _, u := range updates {
+		result = append(result, u.Status.State)
+	}
+	return result
+}
+
+func TestRead(t *testing.T) {
+	caughtUpState := func(u WatchUpdate) bool { return u.Status.State == caughtUp }
+
+	t.Run("Catches up in batches", func(t *testing.T) {
+		fake := newFakeFga(t)
+		var tupleKeys []string
+		for i := 0; i < 2*catchUpBatch+maxPageSize; i++ {
+			tupleKeys = append(tupleKeys, fmt.Sprintf("user:%v member org:acme", i))
+		}
+		fake.addChanges(syncStoreId, openfga.WRITE, tupleKeys...)
+		s := newSyncedStore(t, fake)
+
+		updates := syncUntil(t, s, caughtUpState)
+		if got := states(updates); len(got) != 3 || got[0] != catchingUp || got[1] != catchingUp {
+			t.Fatalf("Expected catching up twice then caught up, got %v", got)
+		}
+		if updates[0].Status.Applied != catchUpBatch || updates[1].Status.Applied != 2*catchUpBatch || updates[1].Status.Rate <= 0 {
+			t.Errorf("Unexpected progress %+v, %+v", updates[0].Status, updates[1].Status)
+		}
+		if last := updates[2]; last.Writes != maxPageSize || *last.Token != fmt.Sprint(len(tupleKeys)) {
+			t.Errorf("Unexpected last update %+v", last)
+		}
+		if c, _ := s.repo.CountTuples(nil); c != len(tupleKeys) {
+			t.Errorf("Expected %v tuples in the replica, got %v", len(tupleKeys), c)
+		}
+		fake.lock.Lock()
+		defer fake.lock.Unlock()
+		for _, pageSize := range fake.pageSizes {
+			if pageSize != maxPageSize {
+				t.Errorf("Catch-up must ask for the largest pages, got %v", fake.pageSizes)
+				break
+			}
+		}
+	})
+
+	t.Run("Polls with the configured page size once caught up", func(t *testing.T) {
+		fake := newFakeFga(t)
+		fake.addChanges(syncStoreId, openfga.WRITE, "user:jack member org:acme")
+		s := newSyncedStore(t, fake)
+
+		added := false
+		updates := syncUntil(t, s, func(u WatchUpdate) bool {
+			if u.Status.State == caughtUp && !added {
+				fake.lock.Lock()
+				fake.pageSizes = nil
+				fake.lock.Unlock()
+				fake.addChanges(syncStoreId, openfga.WRITE, "user:jill member org:acme")
+				added = true
+			}
+			return added && u.Status.State == syncing
+		})
+		if last := updates[len(updates)-1]; last.Writes != 1 {
+			t.Errorf("Expected the new change to be synced, got %+v", last)
+		}
+		fake.lock.Lock()
+		defer fake.lock.Unlock()
+		for _, pageSize := range fake.pageSizes {
+			if pageSize != int(s.PageSize) {
+				t.Errorf("Expected page size %v, got %v", s.PageSize, fake.pageSizes)
+				break
+			}
+		}
+	})
+
+	t.Run("Backs off on server errors and recovers", func(t *testing.T) {
+		fake := newFakeFga(t)
+		fake.addChanges(syncStoreId, openfga.WRITE, "user:jack member org:acme")
+		fake.failWith(http.StatusInternalServerError, http.StatusServiceUnavailable)
+		s := newSyncedStore(t, fake)
+
+		updates := syncUntil(t, s, caughtUpState)
+		got := states(updates)
+		if len(got) != 4 || got[0] != backingOff || got[1] != backingOff || got[2] != syncing {
+			t.Fatalf("Expected backing off twice then syncing, got %v", got)
+		}
+		if updates[1].Status.Failures != 2 || updates[1].Status.RetryAt.IsZero() {
+			t.Errorf("Unexpected status %+v", updates[1].Status)
+		}
+		if recovered := updates[2].Status; recovered.Failures != 0 || recovered.LastError == "" || recovered.LastSuccess.IsZero() {
+			t.Errorf("Recovery must reset failures and keep the last error, got %+v", recovered)
+		}
+	})
+
+	t.Run("Syncs each type with its own token", func(t *testing.T) {
+		fake := newFakeFga(t)
+		fake.addChanges(syncStoreId, openfga.WRITE, "user:jack viewer document:1", "user:jack viewer team:1",
+			"user:jack viewer folder:1", "user:jill viewer document:2")
+		s := newSyncedStore(t, fake)
+		s.Types = []string{"document", "folder"}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		updates := make(chan WatchUpdate)
+		for _, objectType := range s.syncedTypes() {
+			go read(ctx, s, objectType, updates)
+		}
+		caughtUpTypes := map[string]bool{}
+		for len(caughtUpTypes) < 2 {
+			select {
+			case update := <-updates:
+				if update.Status.State == caughtUp {
+					caughtUpTypes[update.Type] = true
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Types didn't catch up, got %v", caughtUpTypes)
+			}
+		}
+
+		if c, _ := s.repo.CountTuples(nil); c != 3 {
+			t.Errorf("Expected the tuples of the synced types only, got %v", c)
+		}
+		for objectType, expected := range map[string]string{"document": "2", "folder": "1"} {
+			if token := s.repo.GetContinuationToken(s.ApiUrl, s.StoreId, objectType); token == nil || *token != expected {
+				t.Errorf("Expected token %v for %v, got %v", expected, objectType, token)
+			}
+		}
+		if states := s.typeStates(); states != "document (Caught up), folder (Caught up)" {
+			t.Errorf("Unexpected type states %v", states)
+		}
+	})
+
+	t.Run("Fails for good on client errors", func(t *testing.T) {
+		fake := newFakeFga(t)
+		s := newSyncedStore(t, fake)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		updates := make(chan WatchUpdate, 10)
+		finished := make(chan struct{})
+		go func() {
+			read(ctx, s, "", updates)
+			close(finished)
+		}()
+		select {
+		case <-finished:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Sync must stop after a client error")
+		}
+		if update := <-updates; update.Status.State != failed || update.Status.LastError == "" {
+			t.Errorf("Expected a failed update, got %+v", update.Status)
+		}
+	})
+
+	t.Run("Fetches the page again when the replica fails", func(t *testing.T) {
+		fake := newFakeFga(t)
+		fake.addChanges(syncStoreId, openfga.WRITE, "user:jack member org:acme", "user:jill member org:acme", "user:joe member org:acme")
+		s := newSyncedStore(t, fake)
+		repo := newFakeRepo()
+		repo.failApply = 1
+		s.repo = repo
+
+		updates := syncUntil(t, s, caughtUpState)
+		if got := states(updates); got[0] != backingOff || updates[0].Status.LastError != "disk I/O error" {
+			t.Fatalf("Expected backing off on the replica failure, got %v", got)
+		}
+		if c, _ := repo.CountTuples(nil); c != 3 {
+			t.Errorf("Expected 3 tuples, got %v", c)
+		}
+		if token := repo.GetContinuationToken(fake.server.URL, syncStoreId, ""); token == nil || *token != "3" {
+			t.Errorf("Expected token 3, got %v", token)
+		}
+	})
+	t.Run("Publishes the changes applied", func(t *testing.T) {
+		fake := newFakeFga(t)
+		fake.addChanges(syncStoreId, openfga.WRITE, "user:jack viewer document:1", "group:eng#member editor folder:1")
+		fake.addChanges(syncStoreId, openfga.DELETE, "user:jack viewer document:1")
+		s := newSyncedStore(t, fake)
+		s.bus = &changeBus{}
+		changes := s.bus.subscribe(0)
+
+		syncUntil(t, s, caughtUpState)
+		event := changes.wait()[s]
+		if event.Writes != 2 || event.Deletes != 1 || !reflect.DeepEqual(event.ObjectTypes, []string{"document", "folder"}) ||
+			!reflect.DeepEqual(event.UserTypes, []string{"group", "user"}) || !reflect.DeepEqual(event.Relations, []string{"editor", "viewer"}) {
+			t.Errorf("Unexpected change event %+v", event)
+		}
+	})
+}
+
+func TestRejectedToken(t *testing.T) {
+	fake := newFakeFga(t)
+	fake.addChanges(syncStoreId, openfga.WRITE, "user:jack member org:acme", "user:jill member org:acme")
+	s := newSyncedStore(t, fake)
+	s.repo.UpsertConnection(db.Connection{ApiUrl: s.ApiUrl, StoreId: s.StoreId, ContinuationToken: "expired"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stores := newSession(ctx)
+	s.startSync(ctx, stores.watchUpdatesChan)
+	next := func() WatchUpdate {
+		select {
+		case update := <-stores.watchUpdatesChan:
+			return update
+		case <-time.After(5 * time.Second):
+			t.Fatal("No update")
+		}
+		return WatchUpdate{}
+	}
+
+	if update := next(); update.Status.State != rejected || update.Status.LastError == "" {
+		t.Fatalf("Expected the token to be rejected, got %+v", update.Status)
+	}
+	if types := s.rejectedTypes(); len(types) != 1 {
+		t.Errorf("Expected every type to be rejected, got %v", types)
+	}
+
+	reset := make(chan error)
+	go func() { reset <- stores.resetSync(s) }()
+	for done := false; !done; {
+		select {
+		case err := <-reset:
+			if err != nil {
+				t.Fatal(err)
+			}
+			done = true
+		case <-stores.watchUpdatesChan:
+		}
+	}
+	for update := next(); update.Status.State != caughtUp; update = next() {
+		if update.Status.State == rejected {
+			t.Fatal("The reset token must be accepted")
+		}
+	}
+	if c, _ := s.repo.CountTuples(nil); c != 2 {
+		t.Errorf("Expected the replica to be rebuilt, got %v tuples", c)
+	}
+	events, _ := s.repo.GetSyncEvents(s.StoreId)
+	if len(events) != 2 || events[0].Event != db.TokenReset || events[1].Event != db.TokenRejected || events[1].ContinuationToken != "expired" {
+		t.Errorf("Unexpected events %+v", events)
+	}
+}
+
+// resetTypes is a replica recording the types whose tokens are reset
+type resetTypes struct {
+	db.Repository
+	types []string
+}
+
+func (r *resetTypes) ResetContinuationTokens(storeId string, types []string) error {
+	r.types = append(r.types, types...)
+	return r.Repository.ResetContinuationTokens(storeId, types)
+}
+
+func TestResetSync(t *testing.T) {
+	t.Run("Only the tokens rejected are reset", func(t *testing.T) {
+		fake := newFakeFga(t)
+		fake.addChanges(syncStoreId, openfga.WRITE, "user:jack member document:1", "user:jill member folder:1")
+		s := newSyncedStore(t, fake)
+		s.Types = []string{"document", "folder"}
+		repo := &resetTypes{Repository: s.repo}
+		s.repo = repo
+		_ = repo.UpsertConnection(db.Connection{ApiUrl: s.ApiUrl, StoreId: s.StoreId, Type: "document", ContinuationToken: "expired"})
+		_ = repo.UpsertConnection(db.Connection{ApiUrl: s.ApiUrl, StoreId: s.StoreId, Type: "folder", ContinuationToken: "0"})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		stores := newSession(ctx)
+		s.startSync(ctx, stores.watchUpdatesChan)
+		for len(s.rejectedTypes()) == 0 {
+			<-stores.watchUpdatesChan
+		}
+		reset := make(chan error)
+		go func() { reset <- stores.resetSync(s) }()
+		for done := false; !done; {
+			select {
+			case err := <-reset:
+				if err != nil {
+					t.Fatal(err)
+				}
+				done = true
+			case <-stores.watchUpdatesChan:
+			}
+		}
+		if !reflect.DeepEqual(repo.types, []string{"document"}) {
+			t.Errorf("Expected only the document token reset, got %v", repo.types)
+		}
+		s.stopSync()
+	})
+
+	t.Run("Left to the syncer of a shared replica", func(t *testing.T) {
+		s := newSyncedStore(t, newFakeFga(t))
+		s.DbPath = "postgres://team@localhost/fga"
+		repo := newFakeRepo()
+		repo.elect(false)
+		s.repo = repo
+		stores := newSession(context.Background())
+		if err := stores.resetSync(s); err == nil || !strings.Contains(err.Error(), "another instance syncs") {
+			t.Errorf("Expected the reset to be left to the syncer, got %v", err)
+		}
+		if s.syncing() {
+			t.Error("The sync must not restart once another instance is elected")
+		}
+		if events, _ := repo.GetSyncEvents(s.StoreId); len(events) != 0 {
+			t.Errorf("Nothing must be reset, got %+v", events)
+		}
+	})
+}
+
+func TestFollowersSendTheirDeletions(t *testing.T) {
+	s := newSyncedStore(t, newFakeFga(t))
+	s.DbPath = "postgres://team@localhost/fga"
+	repo := newFakeRepo()
+	repo.elect(false)
+	s.repo = repo
+	for _, user := range []string{"user:jane", "user:jack"} {
+		repo.applyChange(*openfga.NewTupleChange(*openfga.NewTupleKey(user, "member", "org:acme"), openfga.WRITE, time.Now()))
+	}
+	_ = repo.MarkDeletion("user:jane member org:acme", s.owner())
+	_ = repo.MarkDeletion("user:jack member org:acme", "jill@test")
+	deleted := make(chan string, 2)
+	s.fga = mockFga{deleteFunc: func(_ context.Context, deletes []openfga.TupleKeyWithoutCondition) (*http.Response, error) {
+		deleted <- deletes[0].User
+		return &http.Response{StatusCode: 200}, nil
+	}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates := make(chan WatchUpdate, 10)
+	go func() {
+		for range updates {
+		}
+	}()
+	s.start(ctx, updates)
+	select {
+	case user := <-deleted:
+		if user != "user:jane" {
+			t.Errorf("Only the deletions marked by the follower must be sent, got %v", user)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Followers must send the deletions they marked")
+	}
+	select {
+	case user := <-deleted:
+		t.Errorf("The deletions of others must be left to them, got %v", user)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestElection(t *testing.T) {
+	fake := newFakeFga(t)
+	fake.addChanges(syncStoreId, openfga.WRITE, "user:jane member org:acme", "user:jack member org:acme")
+	s := newSyncedStore(t, fake)
+	s.DbPath = "postgres://team@localhost/fga"
+	repo := newFakeRepo()
+	_ = repo.UpsertConnection(db.Connection{ApiUrl: s.ApiUrl, StoreId: syncStoreId, ContinuationToken: "1", LastSync: time.Now()})
+	repo.elect(false)
+	s.repo = repo
+	s.bus = &changeBus{}
+	changes := s.bus.subscribe(0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates := make(chan WatchUpdate)
+	s.start(ctx, updates)
+	waitFor := func(state syncState) WatchUpdate {
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case update := <-updates:
+				if update.Status.State == state {
+					return update
+				}
+			case <-timeout:
+				t.Fatalf("Sync didn't reach %v", state)
+			}
+		}
+	}
+
+	if update := waitFor(following); *update.Token != "1" || update.Status.LastSuccess.IsZero() {
+		t.Errorf("Followers must show the sync of the syncer, got %+v", update)
+	}
+	if c, _ := repo.CountTuples(nil); c != 0 {
+		t.Errorf("Followers must not sync, got %v tuples", c)
+	}
+	if event := changes.wait()[s]; !event.Rebuilt {
+		t.Errorf("Followers must tell the UI about the sync of the syncer, got %+v", event)
+	}
+
+	repo.elect(true)
+	waitFor(caughtUp)
+	if c, _ := repo.CountTuples(nil); c != 1 {
+		t.Errorf("Expected the syncer to sync, got %v tuples", c)
+	}
+
+	repo.elect(false)
+	waitFor(following)
+	fake.addChanges(syncStoreId, openfga.WRITE, "user:jill member org:acme")
+	waitFor(following)
+	waitFor(following)
+	if c, _ := repo.CountTuples(nil); c != 1 {
+		t.Errorf("Expected the sync to stop once another instance is elected, got %v tuples", c)
+	}
+}
+
+// closedRepo is a replica telling whether it was used once closed
+type closedRepo struct {
+	db.Repository
+	closed, usedClosed atomic.Bool
+}
+
+func (r *closedRepo) use() {
+	if r.closed.Load() {
+		r.usedClosed.Store(true)
+	}
+}
+
+func (r *closedRepo) ApplyChanges(changes []openfga.TupleChange, connection db.Connection) error {
+	r.use()
+	return r.Repository.ApplyChanges(changes, connection)
+}
+
+func (r *closedRepo) GetContinuationToken(apiUrl, storeId, objectType string) *string {
+	r.use()
+	return r.Repository.GetContinuationToken(apiUrl, storeId, objectType)
+}
+
+func (r *closedRepo) GetMarkedForDeletion(owner string) ([]db.Tuple, error) {
+	r.use()
+	return r.Repository.GetMarkedForDeletion(owner)
+}
+
+func (r *closedRepo) ElectSyncer(ctx context.Context, apiUrl, storeId string) (bool, error) {
+	r.use()
+	return r.Repository.ElectSyncer(ctx, apiUrl, storeId)
+}
+
+func (r *closedRepo) Close() error {
+	r.closed.Store(true)
+	return r.Repository.Close()
+}
+
+func TestSessionClose(t *testing.T) {
+	fake := newFakeFga(t)
+	fake.addChanges(syncStoreId, openfga.WRITE, "user:jane member org:acme", "user:jack member org:acme")
+	s := newSyncedStore(t, fake)
+	s.DbPath = "postgres://team@localhost/fga"
+	repo := &closedRepo{Repository: newFakeRepo()}
+	s.repo = repo
+	s.fga = mockFga{}
+
+	stores := newSession(context.Background())
+	s.start(stores.ctx, stores.watchUpdatesChan)
+	stores.stores = []*store{s}
+	// the sync and the election keep going, nothing reads their updates once the first one is in
+	for update := range stores.watchUpdatesChan {
+		if update.Status.State == caughtUp {
+			break
+		}
+	}
+
+	stores.close()
+	time.Sleep(20 * time.Millisecond)
+	if repo.usedClosed.Load() {
+		t.Fatal("The replica must not be used once closed")
+	}
+	if s.syncing() {
+		t.Error("The sync must be stopped before the replica is closed")
+	}
+	if err := stores.resetSync(s); err == nil {
+		t.Error("A closed store must not be reset")
+	}
+}
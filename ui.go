@@ -7,51 +7,97 @@ import (
 	"github.com/ggwhite/go-masker"
 	"github.com/paulosuzart/fgamanager/db"
 	"github.com/rivo/tview"
-	"log"
+	"log/slog"
+	"runtime/debug"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var helpBox *tview.TextView
 
-type count struct {
-	totalCount   int
-	lock         sync.RWMutex
-	newCountChan chan int
+// changeRefreshInterval is the least time between two refreshes of a view while the replica keeps changing
+const changeRefreshInterval = time.Second
+
+// failure is what stopped the app from a background goroutine, reported once the terminal is restored
+var failure atomic.Value
+
+// showError tells about a failure in the help box, it must run in the UI goroutine
+func showError(err error) {
+	slog.Error("UI failure", "err", err)
+	helpBox.SetText("[red]" + err.Error())
+}
+
+// guard is deferred by the background goroutines of the UI. A panic stops the app instead of leaving the
+// terminal as the UI set it up, and is reported after the stores are closed
+func guard(app *tview.Application) {
+	if p := recover(); p != nil {
+		slog.Error("Background failure", "panic", p, "stack", string(debug.Stack()))
+		failure.Store(fmt.Errorf("%v", p))
+		app.Stop()
+	}
 }
 
-func (c *count) setTotal(newTotal int) {
-	c.lock.Lock()
-	defer c.lock.Unlock()
-	c.totalCount = newTotal
-	log.Printf("New count is %v", newTotal)
+type count struct {
+	newCountChan chan int
+	onError      func(error)
 }
 
-func (c *count) refresh(d time.Duration) {
+// refresh counts the tuples of the current store, then again every time its replica changes
+func (c *count) refresh(changes *subscription, current func() *store) {
 	for {
-
-		dbCount := db.Repository.CountTuples(nil)
-		c.setTotal(dbCount)
-		c.newCountChan <- dbCount
-		time.Sleep(d)
+		dbCount, err := current().repo.CountTuples(nil)
+		if err != nil {
+			c.onError(err)
+		} else {
+			c.newCountChan <- dbCount
+		}
+		for {
+			if _, changed := changes.wait()[current()]; changed {
+				break
+			}
+		}
 	}
 }
 
 type TupleView struct {
 	tview.TableContentReadOnly
+	repo db.TupleRepository
 	// just to avoid going to the database again
 	page      *db.LoadResult
 	filter    db.Filter
 	filterSet bool
+	// onError is told when the replica fails, the view shows no tuples then
+	onError func(error)
 }
 
-func newTupleView() *TupleView {
-	firstPage := db.Load(0, nil)
-	return &TupleView{
+func newTupleView(repo db.TupleRepository, onError func(error)) *TupleView {
+	t := &TupleView{
 		TableContentReadOnly: tview.TableContentReadOnly{},
-		page:                 firstPage,
+		repo:                 repo,
 		filter:               db.Filter{},
+		onError:              onError,
+	}
+	t.page = t.loadPage(0, nil)
+	return t
+}
+
+// loadPage loads the page from offset on, nil when the replica fails
+func (t *TupleView) loadPage(offset int, filter *db.Filter) *db.LoadResult {
+	page, err := t.repo.Load(offset, filter)
+	if err != nil {
+		t.onError(err)
 	}
+	return page
+}
+
+// setRepository points the view to the replica of another store, dropping the filter
+func (t *TupleView) setRepository(repo db.TupleRepository) {
+	t.repo = repo
+	t.filter = db.Filter{}
+	t.filterSet = false
+	t.page = t.loadPage(0, nil)
 }
 
 type Action string
@@ -75,8 +121,9 @@ func (a Action) String() string {
 }
 
 func (t *TupleView) GetRowCount() int {
+	// a new filter is counted once, loading its first page
 	if t.filterSet {
-		return db.Repository.CountTuples(&t.filter) + 1
+		t.load(0)
 	}
 	if t.page == nil || t.page.GetTotal() == 0 {
 		return 1
@@ -91,8 +138,22 @@ func (t *TupleView) GetColumnCount() int {
 
 func (t *TupleView) load(row int) {
 	t.filterSet = false
-	t.page = db.Load(row, &t.filter)
-	log.Printf("Loaded value: %v", t.page)
+	t.page = t.loadPage(row, &t.filter)
+	if t.page != nil {
+		slog.Debug("Loaded page", "lower", t.page.GetLowerBound(), "upper", t.page.GetUpperBound(), "total", t.page.GetTotal())
+	}
+}
+
+// refresh loads the shown page again once the replica changed, a new filter is loaded when drawn anyway
+func (t *TupleView) refresh() {
+	if t.filterSet {
+		return
+	}
+	offset := 0
+	if t.page != nil {
+		offset = t.page.GetLowerBound()
+	}
+	t.load(offset)
 }
 
 func (t *TupleView) setFilter(filter db.Filter) {
@@ -128,7 +189,7 @@ func (t *TupleView) GetCell(row, column int) *tview.TableCell {
 		if t.page == nil || t.page.GetTotal() == 0 || len(t.page.Res) == 0 {
 			return nil
 		}
-		log.Printf("Count: %v. Current bounds: %v-%v. Requested row: %v", len(t.page.Res), t.page.GetLowerBound(), t.page.GetUpperBound(), row)
+		slog.Debug("Row out of the loaded page", "count", len(t.page.Res), "lower", t.page.GetLowerBound(), "upper", t.page.GetUpperBound(), "row", row)
 	}
 
 	index := row - t.page.GetLowerBound()
@@ -162,57 +223,140 @@ func (t *TupleView) GetCell(row, column int) *tview.TableCell {
 	}
 }
 
-func createDropdown(label, dropDownType string, getterFunc func() []string) *tview.DropDown {
-
-	dropdown := tview.NewDropDown().
-		SetLabel(label)
+// filterDropdown lists the values of a column of the replica of the current store, to filter the tuples by
+type filterDropdown struct {
+	*tview.DropDown
+	dropDownType string
+	get          func() ([]string, error)
+	// touched are the values of the tuples a change wrote
+	touched func(changeEvent) []string
+
+	lock sync.Mutex
+	// listed are the options shown, dirty tells they were left as they were while the user picked one
+	listed map[string]bool
+	dirty  bool
+}
 
-	dropdown.SetFocusFunc(func() {
+func newFilterDropdown(label, dropDownType string, get func() ([]string, error), touched func(changeEvent) []string) *filterDropdown {
+	d := &filterDropdown{DropDown: tview.NewDropDown().SetLabel(label), dropDownType: dropDownType, get: get, touched: touched}
+	d.SetFocusFunc(func() {
 		helpBox.SetText("[blue]ENTER:[white] Opens the [orange]" + dropDownType + "[white] dropdown")
 	})
+	return d
+}
 
-	go func() {
-		for {
-			// we update if nothing is selected and is not open
-			if i, _ := dropdown.GetCurrentOption(); i <= 0 && !dropdown.IsOpen() {
-				availableTypes := getterFunc()
-				options := []string{"Select a " + dropDownType}
-				options = append(options, availableTypes...)
-				dropdown.SetOptions(options, nil).
-					SetCurrentOption(0)
+// reset reloads the options, they are left as they were when the replica fails
+func (d *filterDropdown) reset() error {
+	values, err := d.get()
+	if err != nil {
+		return err
+	}
+	d.SetOptions(append([]string{"Select a " + d.dropDownType}, values...), nil).
+		SetCurrentOption(0)
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.listed = map[string]bool{}
+	for _, value := range values {
+		d.listed[value] = true
+	}
+	d.dirty = false
+	return nil
+}
 
-			}
-			time.Sleep(5 * time.Second)
+// stale tells whether a change may have added or removed options
+func (d *filterDropdown) stale(event changeEvent) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if event.Rebuilt || event.Deletes > 0 || d.dirty {
+		return true
+	}
+	for _, value := range d.touched(event) {
+		if !d.listed[value] {
+			return true
 		}
-	}()
+	}
+	return false
+}
 
-	return dropdown
+// follow reloads the options when the replica of the current store changes them, unless the user is picking
+// or picked one
+func (d *filterDropdown) follow(app *tview.Application, changes *subscription, current func() *store) {
+	for {
+		event, changed := changes.wait()[current()]
+		if !changed || !d.stale(event) {
+			continue
+		}
+		app.QueueUpdateDraw(func() {
+			if i, _ := d.GetCurrentOption(); i > 0 || d.IsOpen() {
+				d.lock.Lock()
+				d.dirty = true
+				d.lock.Unlock()
+				return
+			}
+			if err := d.reset(); err != nil {
+				showError(err)
+			}
+		})
+	}
 }
 
-func AddComponents(context context.Context, app *tview.Application) *tview.Grid {
+func AddComponents(context context.Context, app *tview.Application, stores *session, logs *logRing) *tview.Pages {
+	// the store the UI is showing, sync goroutines of every store keep running
+	var current atomic.Pointer[store]
+	current.Store(stores.list()[0])
+
 	helpBox = tview.NewTextView()
 	helpBox.SetText("Help will appear here").SetTextAlign(tview.AlignCenter).SetDynamicColors(true)
 
 	infoTable := tview.NewTable().SetBorders(false)
-	infoTable.SetCell(0, 0, tview.NewTableCell("Watch Active:").
+	infoTable.SetCell(0, 0, tview.NewTableCell("Sync:").
 		SetTextColor(tcell.ColorDarkOrange))
 
 	watchView := tview.NewTableCell("??").
 		SetTextColor(tcell.ColorLightBlue)
 
+	infoTable.SetCell(0, 2, tview.NewTableCell("Store:").
+		SetTextColor(tcell.ColorDarkOrange))
+	storeNameView := tview.NewTableCell(current.Load().Name)
+	infoTable.SetCell(0, 3, storeNameView)
+	storesCountView := tview.NewTableCell("")
+	infoTable.SetCell(0, 4, storesCountView)
+	showStoresCount := func() {
+		if open := len(stores.list()); open > 1 {
+			storesCountView.SetText(fmt.Sprintf("(%v stores, <ctrl-s> to switch)", open))
+		}
+	}
+	showStoresCount()
+	readOnlyView := tview.NewTableCell("").SetTextColor(tcell.ColorRed)
+	infoTable.SetCell(0, 5, readOnlyView)
+	showReadOnly := func(s *store) {
+		if s.ReadOnly {
+			readOnlyView.SetText("READ ONLY")
+		} else {
+			readOnlyView.SetText("")
+		}
+	}
+	showReadOnly(current.Load())
+
 	infoTable.SetCell(1, 0, tview.NewTableCell("Server:").
 		SetTextColor(tcell.ColorDarkOrange).SetMaxWidth(60))
-	infoTable.SetCell(1, 1, tview.NewTableCell(*apiUrl))
+	serverView := tview.NewTableCell(current.Load().ApiUrl)
+	infoTable.SetCell(1, 1, serverView)
 
 	infoTable.SetCell(1, 2, tview.NewTableCell("StoreId:").
 		SetTextColor(tcell.ColorDarkOrange))
 
-	infoTable.SetCell(1, 3, tview.NewTableCell(masker.ID(*storeId)))
+	storeIdView := tview.NewTableCell(masker.ID(current.Load().StoreId))
+	infoTable.SetCell(1, 3, storeIdView)
 
 	infoTable.SetCell(1, 4, tview.NewTableCell("Continuation Token:").
 		SetTextColor(tcell.ColorDarkOrange))
 	tokenView := tview.NewTableCell("??").SetMaxWidth(60)
 
+	infoTable.SetCell(1, 6, tview.NewTableCell("Types:").
+		SetTextColor(tcell.ColorDarkOrange))
+	typesView := tview.NewTableCell("??").SetMaxWidth(80)
+
 	infoTable.SetCell(2, 0, tview.NewTableCell("W:").
 		SetTextColor(tcell.ColorLightGreen))
 	writesView := tview.NewTableCell("??")
@@ -229,8 +373,18 @@ func AddComponents(context context.Context, app *tview.Application) *tview.Grid
 		SetTextColor(tcell.ColorDarkOrange))
 	selectedCountView := tview.NewTableCell("??")
 
+	infoTable.SetCell(3, 0, tview.NewTableCell("Last success:").
+		SetTextColor(tcell.ColorDarkOrange))
+	lastSuccessView := tview.NewTableCell("never")
+	infoTable.SetCell(3, 2, tview.NewTableCell("Last error:").
+		SetTextColor(tcell.ColorDarkOrange))
+	lastErrorView := tview.NewTableCell("").SetTextColor(tcell.ColorRed).SetMaxWidth(120)
+
 	infoTable.SetCell(0, 1, watchView)
+	infoTable.SetCell(3, 1, lastSuccessView)
+	infoTable.SetCell(3, 3, lastErrorView)
 	infoTable.SetCell(1, 5, tokenView)
+	infoTable.SetCell(1, 7, typesView)
 	infoTable.SetCell(2, 1, writesView)
 	infoTable.SetCell(2, 3, deletesView)
 	infoTable.SetCell(2, 5, totalCountView)
@@ -238,16 +392,25 @@ func AddComponents(context context.Context, app *tview.Application) *tview.Grid
 
 	newCount := count{
 		newCountChan: make(chan int, 10),
+		onError:      func(err error) { app.QueueUpdateDraw(func() { showError(err) }) },
 	}
-	go newCount.refresh(3 * time.Second)
-	tupleView := newTupleView()
-	log.Printf("Created table view")
+	countChanges := stores.changes.subscribe(changeRefreshInterval)
+	go func() {
+		defer guard(app)
+		newCount.refresh(countChanges, current.Load)
+	}()
+	tupleView := newTupleView(current.Load().repo, showError)
+	slog.Debug("Created table view")
 
 	tupleTable := tview.NewTable().SetContent(tupleView).SetSelectable(true, false).
 		SetBorders(false).SetFixed(1, 8)
 
 	tupleTable.SetFocusFunc(func() {
-		helpBox.SetText("[green]<ctrl-n>: [white]Submit new Tuple\n[red]<ctrl-d>:[white] Mark tuple for [red]deletion[white]\n[blue]<ctrl-tab>:[white] Return to the filter form")
+		if current.Load().ReadOnly {
+			helpBox.SetText("[red]Read only store[white], tuples can't be created or deleted\n[blue]<ctrl-t>/<ctrl-o>:[white] History of the tuple/object  [blue]<ctrl-s>/<ctrl-l>:[white] Switch/manage stores  [blue]<ctrl-p>/<ctrl-g>/<ctrl-k>:[white] Audit log/Log/Stats\n[blue]<ctrl-tab>:[white] Return to the filter form")
+			return
+		}
+		helpBox.SetText("[green]<ctrl-n>: [white]Submit new Tuple\n[red]<ctrl-d>:[white] Mark tuple for [red]deletion[white]\n[blue]<ctrl-t>/<ctrl-o>:[white] History of the tuple/object  [blue]<ctrl-s>/<ctrl-l>:[white] Switch/manage stores  [blue]<ctrl-p>/<ctrl-g>/<ctrl-k>:[white] Audit log/Log/Stats\n[blue]<ctrl-tab>:[white] Return to the filter form")
 	})
 	pages := tview.NewPages()
 	pages.SetBorder(true)
@@ -257,18 +420,48 @@ func AddComponents(context context.Context, app *tview.Application) *tview.Grid
 	createForm.AddInputField("Tuple", "tuple for creation", 120, nil, nil)
 	createForm.AddButton("Create", func() {
 		item := createForm.GetFormItem(0).(*tview.InputField)
-		log.Printf("Will crate tuple %v", item.GetText())
-		go create(context, item.GetText())
+		current.Load().log.Info("Creating tuple", "operation", "write", "tuple", item.GetText())
+		go create(context, current.Load().fga, item.GetText())
 		pages.SwitchToPage("help")
 		app.SetFocus(tupleTable)
 	})
 
+	root := tview.NewPages()
+	history := newHistoryView(func() {
+		root.SwitchToPage("main")
+		app.SetFocus(tupleTable)
+	})
+
 	tupleTable.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
 		row, _ := tupleTable.GetSelection()
-		if event.Key() == tcell.KeyCtrlD && row > 0 {
+		if (event.Key() == tcell.KeyCtrlT || event.Key() == tcell.KeyCtrlO) && row > 0 && tupleView.page != nil {
+			tuple := tupleView.page.Res[row-tupleView.page.GetLowerBound()].Tuple
+			subject := tuple.TupleKey
+			changes, err := current.Load().repo.GetTupleHistory(tuple.TupleKey)
+			if event.Key() == tcell.KeyCtrlO {
+				subject = tuple.ObjectType + ":" + tuple.ObjectId
+				changes, err = current.Load().repo.GetObjectHistory(tuple.ObjectType, tuple.ObjectId)
+			}
+			if err != nil {
+				showError(err)
+				return nil
+			}
+			history.show(subject, changes)
+			root.SwitchToPage("history")
+			app.SetFocus(history)
+			return nil
+		}
+		if (event.Key() == tcell.KeyCtrlD || event.Key() == tcell.KeyCtrlN) && current.Load().ReadOnly {
+			helpBox.SetText("[red]" + errReadOnly.Error())
+			return nil
+		}
+		if event.Key() == tcell.KeyCtrlD && row > 0 && tupleView.filter.AsOf == nil {
 			tuple := tupleView.page.Res[row-tupleView.page.GetLowerBound()].Tuple
-			log.Printf("Marking row as deleted %v", tuple.TupleKey)
-			db.MarkDeletion(tuple.TupleKey)
+			current.Load().log.Info("Marking tuple for deletion", "operation", "mark", "tuple", tuple.TupleKey)
+			if err := tupleView.repo.MarkDeletion(tuple.TupleKey, current.Load().owner()); err != nil {
+				showError(err)
+				return nil
+			}
 			tupleView.load(tupleView.page.GetLowerBound())
 		} else if event.Key() == tcell.KeyCtrlN {
 			pages.SwitchToPage("create")
@@ -286,45 +479,75 @@ func AddComponents(context context.Context, app *tview.Application) *tview.Grid
 		helpBox.SetText("[blue]<enter>:[white] triggers the filter with selected options")
 	})
 
-	userTypes := createDropdown("User Type", "userType", db.GetUserTypes)
-	relations := createDropdown("Relation", "relation", db.GetRelations)
-	objectTypes := createDropdown("Object Type", "objectType", db.GetObjectTypes)
+	asOf := tview.NewInputField().
+		SetLabel("As of").
+		SetPlaceholder("2024-02-10 11:00:00").
+		SetFieldWidth(20)
+
+	asOf.SetFocusFunc(func() {
+		helpBox.SetText("[blue]<enter>:[white] shows tuples as they were at this time, requires [orange]--history[white]")
+	})
+
+	userTypes := newFilterDropdown("User Type", "userType", func() ([]string, error) { return current.Load().repo.GetUserTypes() },
+		func(e changeEvent) []string { return e.UserTypes })
+	relations := newFilterDropdown("Relation", "relation", func() ([]string, error) { return current.Load().repo.GetRelations() },
+		func(e changeEvent) []string { return e.Relations })
+	objectTypes := newFilterDropdown("Object Type", "objectType", func() ([]string, error) { return current.Load().repo.GetObjectTypes() },
+		func(e changeEvent) []string { return e.ObjectTypes })
+	dropdowns := []*filterDropdown{userTypes, relations, objectTypes}
+	for _, dropdown := range dropdowns {
+		if err := dropdown.reset(); err != nil {
+			showError(err)
+		}
+		go func(dropdown *filterDropdown, changes *subscription) {
+			defer guard(app)
+			dropdown.follow(app, changes, current.Load)
+		}(dropdown, stores.changes.subscribe(changeRefreshInterval))
+	}
 
 	filterForm := tview.NewForm().
 		AddFormItem(userTypes).
 		AddFormItem(relations).
 		AddFormItem(objectTypes).
-		AddFormItem(search)
+		AddFormItem(search).
+		AddFormItem(asOf)
 	filterForm.SetBorder(false)
 	filterForm.SetHorizontal(true)
 
 	filterForm.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		i, _ := filterForm.GetFocusedItemIndex()
 		// if we hit tab at the last item of the form we go to the table
-		if i, _ := filterForm.GetFocusedItemIndex(); i == filterForm.GetFormItemCount()-1 {
-			if event.Key() == tcell.KeyTab {
-				app.SetFocus(tupleTable)
-				return event
-				// but if we hit enter we just prepare search
-			} else if event.Key() == tcell.KeyEnter {
-				filter := db.Filter{}
-				if searchText := search.GetText(); searchText != "" {
-					filter.Search = &searchText
-				}
-				if i, userType := userTypes.GetCurrentOption(); i > 0 {
-					filter.UserType = &userType
-				}
-				if i, relation := relations.GetCurrentOption(); i > 0 {
-					filter.Relation = &relation
-				}
-				if i, objectType := objectTypes.GetCurrentOption(); i > 0 {
-					filter.ObjectType = &objectType
+		if i == filterForm.GetFormItemCount()-1 && event.Key() == tcell.KeyTab {
+			app.SetFocus(tupleTable)
+			return event
+		}
+		// but if we hit enter on any of the text fields we just prepare search
+		if i >= filterForm.GetFormItemIndex("Filter") && event.Key() == tcell.KeyEnter {
+			filter := db.Filter{}
+			if searchText := search.GetText(); searchText != "" {
+				filter.Search = &searchText
+			}
+			if asOfText := asOf.GetText(); asOfText != "" {
+				at, err := parseAsOf(asOfText)
+				if err != nil {
+					helpBox.SetText("[red]" + err.Error())
+					return nil
 				}
-				tupleView.setFilter(filter)
-				tupleTable.Select(0, 0)
-				app.SetFocus(tupleTable)
-				return nil
+				filter.AsOf = at
 			}
-
+			if i, userType := userTypes.GetCurrentOption(); i > 0 {
+				filter.UserType = &userType
+			}
+			if i, relation := relations.GetCurrentOption(); i > 0 {
+				filter.Relation = &relation
+			}
+			if i, objectType := objectTypes.GetCurrentOption(); i > 0 {
+				filter.ObjectType = &objectType
+			}
+			tupleView.setFilter(filter)
+			tupleTable.Select(0, 0)
+			app.SetFocus(tupleTable)
+			return nil
 		}
 		return event
 	})
@@ -333,7 +556,7 @@ func AddComponents(context context.Context, app *tview.Application) *tview.Grid
 	tupleTable.SetDoneFunc(func(key tcell.Key) { app.SetFocus(filterForm) })
 
 	grid := tview.NewGrid().
-		SetRows(3, 3, -5, 5).
+		SetRows(4, 3, -5, 5).
 		SetMinSize(3, 20).
 		SetBorders(false).
 		AddItem(infoTable, 0, 0, 1, 1, 0, 0, false).
@@ -349,22 +572,285 @@ func AddComponents(context context.Context, app *tview.Application) *tview.Grid
 
 	grid.AddItem(pages, 3, 0, 1, 1, 3, 0, false)
 
-	watchUpdatesChan := make(chan WatchUpdate, 10)
+	showUpdate := func(t *WatchUpdate) {
+		typesView.SetText(current.Load().typeStates())
+		if t == nil {
+			for _, view := range []*tview.TableCell{tokenView, writesView, deletesView, watchView} {
+				view.SetText("??")
+			}
+			lastSuccessView.SetText("never")
+			lastErrorView.SetText("")
+			return
+		}
+		if t.Token != nil {
+			tokenView.SetText(*t.Token)
+		}
+		writesView.SetText(fmt.Sprintf("%v", t.Writes))
+		deletesView.SetText(fmt.Sprintf("%v", t.Deletes))
+		status := t.Status
+		// type scoped stores show the type in the worst state
+		prefix := ""
+		if t.Type != "" {
+			prefix = t.Type + ": "
+		}
+		switch status.State {
+		case backingOff:
+			watchView.SetText(fmt.Sprintf("%v%v, retry at %v", prefix, status.State, status.RetryAt.Format(time.TimeOnly))).SetTextColor(tcell.ColorOrange)
+		case failed:
+			watchView.SetText(prefix + status.State.String()).SetTextColor(tcell.ColorRed)
+		case rejected:
+			watchView.SetText(prefix + status.State.String() + ", <ctrl-r> to reset").SetTextColor(tcell.ColorRed)
+		default:
+			watchView.SetText(prefix + status.progress()).SetTextColor(tcell.ColorLightBlue)
+		}
+		lastSuccessView.SetText("never")
+		if !status.LastSuccess.IsZero() {
+			lastSuccessView.SetText(status.LastSuccess.Format(time.DateTime))
+		}
+		lastErrorView.SetText(status.LastError)
+	}
+
+	switchTo := func(s *store) {
+		s.log.Info("Switching to store")
+		current.Store(s)
+		storeNameView.SetText(s.Name)
+		serverView.SetText(s.ApiUrl)
+		storeIdView.SetText(masker.ID(s.StoreId))
+		showReadOnly(s)
+		showUpdate(s.getLastUpdate())
+		search.SetText("")
+		asOf.SetText("")
+		for _, dropdown := range dropdowns {
+			if err := dropdown.reset(); err != nil {
+				showError(err)
+			}
+		}
+		tupleView.setRepository(s.repo)
+		tupleTable.Select(0, 0)
+		go func() {
+			if count, err := s.repo.CountTuples(nil); err == nil {
+				newCount.newCountChan <- count
+			}
+		}()
+		root.SwitchToPage("main")
+		app.SetFocus(tupleTable)
+	}
+	backToMain := func() {
+		root.SwitchToPage("main")
+		app.SetFocus(tupleTable)
+	}
+	switcher := newStoreSwitcher(switchTo, backToMain)
+
+	var audit *auditView
+	audit = newAuditView(func() {
+		s := current.Load()
+		path := fmt.Sprintf("audit-%v-%v.jsonl", s.StoreId, time.Now().Format("20060102T150405"))
+		exported, err := exportAudit(s.repo, path)
+		if err != nil {
+			audit.details.SetText("[red]" + err.Error())
+			return
+		}
+		audit.details.SetText(fmt.Sprintf("[green]Exported %v entries to %v", exported, path))
+	}, backToMain)
+
+	stats := newStatsView(backToMain)
+	var loadingStats atomic.Bool
+	// loadStats reads the stats of the current store in the background, unless they are being read already
+	loadStats := func() {
+		if !loadingStats.CompareAndSwap(false, true) {
+			return
+		}
+		s := current.Load()
+		go func() {
+			defer guard(app)
+			defer loadingStats.Store(false)
+			collected, err := collectStats(context, s, time.Now())
+			app.QueueUpdateDraw(func() {
+				if name, _ := root.GetFrontPage(); name != "stats" || current.Load() != s {
+					return
+				}
+				if err != nil {
+					stats.fail(err)
+					return
+				}
+				stats.show(collected)
+			})
+		}()
+	}
+	go func() {
+		defer guard(app)
+		for range time.Tick(statsRefreshInterval) {
+			app.QueueUpdate(func() {
+				if name, _ := root.GetFrontPage(); name == "stats" {
+					loadStats()
+				}
+			})
+		}
+	}()
+
+	root.AddPage("main", grid, true, true).
+		AddPage("history", history, true, false).
+		AddPage("stores", switcher, true, false).
+		AddPage("audit", audit, true, false).
+		AddPage("stats", stats, true, false)
+
+	logPage := newLogView(logs, backToMain)
+	root.AddPage("logs", logPage, true, false)
 	go func() {
+		defer guard(app)
+		// tails the log while its page is shown
+		shown := 0
+		for range time.Tick(time.Second) {
+			if added := logs.count(); added == shown {
+				continue
+			} else {
+				shown = added
+			}
+			app.QueueUpdateDraw(func() {
+				if name, _ := root.GetFrontPage(); name == "logs" {
+					logPage.refresh(false)
+				}
+			})
+		}
+	}()
+
+	// openServer shows the stores of the server of the current store, picking one adds it to the session
+	openServer := func() {
+		s := current.Load()
+		admin, err := newServerAdmin(s.storeConfig)
+		if err != nil {
+			helpBox.SetText("[red]" + err.Error())
+			return
+		}
+		browser := newStoreBrowser(app, admin, func(config storeConfig) {
+			opened := stores.find(config.StoreId)
+			if opened == nil {
+				opened, err = stores.add(config)
+				if err != nil {
+					helpBox.SetText("[red]" + err.Error())
+					backToMain()
+					return
+				}
+				showStoresCount()
+			}
+			switchTo(opened)
+		}, backToMain)
+		browser.inSession = func(storeId string) bool { return stores.find(storeId) != nil }
+		browser.refresh()
+		root.AddAndSwitchToPage("server", browser, true)
+		app.SetFocus(browser.table)
+	}
+
+	// confirmReset offers to reset the sync of a store once the server rejected one of its continuation tokens
+	confirmReset := func(s *store) {
+		types := s.rejectedTypes()
+		if len(types) == 0 {
+			helpBox.SetText("[blue]<ctrl-r>:[white] resets the sync once the server rejects a continuation token, nothing to reset for " + s.Name)
+			return
+		}
+		scope := "every type"
+		if types[0] != "" {
+			scope = "type " + strings.Join(types, ", ")
+		}
+		reason := ""
+		if update := s.getLastUpdate(); update != nil {
+			reason = update.Status.LastError
+		}
+		modal := tview.NewModal().
+			SetText(fmt.Sprintf("The server rejected the continuation token of %v in store %v:\n%v\n\nReset the tokens and rebuild the replica from the Read endpoint?", scope, s.Name, reason)).
+			AddButtons([]string{"Cancel", "Reset"}).
+			SetDoneFunc(func(_ int, label string) {
+				root.RemovePage("reset")
+				app.SetFocus(tupleTable)
+				if label != "Reset" {
+					return
+				}
+				watchView.SetText("Rebuilding the replica...").SetTextColor(tcell.ColorOrange)
+				go func() {
+					defer guard(app)
+					err := stores.resetSync(s)
+					app.QueueUpdateDraw(func() {
+						if err != nil {
+							helpBox.SetText("[red]" + err.Error())
+							return
+						}
+						helpBox.SetText(fmt.Sprintf("[green]Replica of %v rebuilt[white], the sync catches up from the first change", s.Name))
+						if current.Load() == s {
+							switchTo(s)
+						}
+					})
+				}()
+			})
+		root.AddPage("reset", modal, false, true)
+	}
+
+	root.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		if name, _ := root.GetFrontPage(); name == "main" {
+			switch event.Key() {
+			case tcell.KeyCtrlS:
+				switcher.show(stores.list(), current.Load())
+				root.SwitchToPage("stores")
+				app.SetFocus(switcher)
+				return nil
+			case tcell.KeyCtrlL:
+				openServer()
+				return nil
+			case tcell.KeyCtrlG:
+				logPage.refresh(true)
+				root.SwitchToPage("logs")
+				app.SetFocus(logPage)
+				return nil
+			case tcell.KeyCtrlP:
+				s := current.Load()
+				entries, err := s.repo.GetAuditLog()
+				if err != nil {
+					showError(err)
+					return nil
+				}
+				audit.show(s.Name, entries)
+				root.SwitchToPage("audit")
+				app.SetFocus(audit.table)
+				return nil
+			case tcell.KeyCtrlR:
+				confirmReset(current.Load())
+				return nil
+			case tcell.KeyCtrlK:
+				stats.loading(current.Load().Name)
+				root.SwitchToPage("stats")
+				app.SetFocus(stats.summary)
+				loadStats()
+				return nil
+			}
+		}
+		return event
+	})
+
+	tableChanges := stores.changes.subscribe(changeRefreshInterval)
+	go func() {
+		defer guard(app)
+		for {
+			if _, changed := tableChanges.wait()[current.Load()]; changed {
+				app.QueueUpdateDraw(func() {
+					tupleView.refresh()
+					selectedCountView.SetText(fmt.Sprintf("%v", tupleTable.GetRowCount()-1))
+				})
+			}
+		}
+	}()
+
+	go func() {
+		defer guard(app)
 		for {
 			select {
-			case t := <-watchUpdatesChan:
-				app.QueueUpdate(func() {
-					if t.Token != nil {
-						tokenView.SetText(*t.Token)
-					}
-					writesView.SetText(fmt.Sprintf("%v", t.Writes))
-					deletesView.SetText(fmt.Sprintf("%v", t.Deletes))
-					watchView.SetText(fmt.Sprintf("%v", t.WatchEnabled))
-					// we decrease one because first line is actually header
+			case t := <-stores.watchUpdatesChan:
+				if t.Store != current.Load() {
+					continue
+				}
+				app.QueueUpdateDraw(func() {
+					showUpdate(t.Store.getLastUpdate())
 				})
 			case i := <-newCount.newCountChan:
-				log.Printf("New count detected %v", i)
+				slog.Debug("New count detected", "total", i)
 				app.QueueUpdateDraw(func() {
 					totalCountView.SetText(fmt.Sprintf("%v", i))
 					selectedCountView.SetText(fmt.Sprintf("%v", tupleTable.GetRowCount()-1))
@@ -374,9 +860,6 @@ func AddComponents(context context.Context, app *tview.Application) *tview.Grid
 		}
 	}()
 
-	go read(context, watchUpdatesChan)
-	go deleteMarked(context)
-
-	return grid
+	return root
 
 }
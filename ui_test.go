@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gdamore/tcell/v2"
+	openfga "github.com/openfga/go-sdk"
+	"github.com/paulosuzart/fgamanager/db"
+	"github.com/rivo/tview"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTupleView(t *testing.T) {
+	repo := newFakeRepo()
+	start := time.Now()
+	for i := 0; i < 12; i++ {
+		object := "doc:" + fmt.Sprint(i)
+		if i%3 == 0 {
+			object = "folder:" + fmt.Sprint(i)
+		}
+		_ = repo.ApplyChange(openfga.TupleChange{
+			TupleKey:  openfga.TupleKey{User: fmt.Sprintf("user:%v", i), Relation: "viewer", Object: object},
+			Operation: openfga.WRITE,
+			Timestamp: start.Add(time.Duration(i) * time.Second)})
+	}
+	var failures []error
+	view := newTupleView(repo, func(err error) { failures = append(failures, err) })
+
+	if c := view.GetRowCount(); c != 13 {
+		t.Fatalf("Expected a header and 12 rows, got %v", c)
+	}
+	// newest first, paging through the replica as rows are drawn
+	for row, userId := range map[int]string{1: "11", 5: "7", 6: "6", 12: "0"} {
+		if cell := view.GetCell(row, 1); cell == nil || cell.Text != userId {
+			t.Errorf("Expected user %v at row %v, got %+v", userId, row, cell)
+		}
+	}
+
+	if err := repo.MarkDeletion("user:11 viewer doc:11", "jack@test"); err != nil {
+		t.Fatal(err)
+	}
+	view.load(0)
+	if cell := view.GetCell(1, 6); cell.Text != Delete.String() {
+		t.Errorf("Expected the tuple marked for deletion, got %v", cell.Text)
+	}
+
+	// the sync applies a change while the page is shown
+	_ = repo.ApplyChange(openfga.TupleChange{TupleKey: openfga.TupleKey{User: "user:12", Relation: "viewer", Object: "doc:12"},
+		Operation: openfga.WRITE, Timestamp: start.Add(time.Minute)})
+	view.refresh()
+	if cell := view.GetCell(1, 1); view.GetRowCount() != 14 || cell.Text != "12" {
+		t.Errorf("Expected the new tuple on top, got %v with %v rows", cell.Text, view.GetRowCount())
+	}
+
+	folder := "folder"
+	view.setFilter(db.Filter{ObjectType: &folder})
+	if c := view.GetRowCount(); c != 5 {
+		t.Errorf("Expected a header and 4 folders, got %v", c)
+	}
+	if cell := view.GetCell(1, 4); cell == nil || cell.Text != "9" {
+		t.Errorf("Expected folder 9 first, got %+v", cell)
+	}
+
+	t.Run("Failures are reported", func(t *testing.T) {
+		failure := errors.New("database is locked")
+		repo.fail(failure)
+		view.setRepository(repo)
+		if c := view.GetRowCount(); c != 1 {
+			t.Errorf("Expected only the header, got %v", c)
+		}
+		view.setFilter(db.Filter{ObjectType: &folder})
+		if c := view.GetRowCount(); c != 1 {
+			t.Errorf("Expected only the header, got %v", c)
+		}
+		if len(failures) != 2 || failures[0] != failure {
+			t.Errorf("Expected the failures to be reported, got %v", failures)
+		}
+	})
+}
+
+func TestFilterDropdown(t *testing.T) {
+	loads := 0
+	dropdown := newFilterDropdown("Object Type", "objectType", func() ([]string, error) {
+		loads++
+		return []string{"document", "folder"}, nil
+	}, func(e changeEvent) []string { return e.ObjectTypes })
+	if err := dropdown.reset(); err != nil || dropdown.GetOptionCount() != 3 {
+		t.Fatalf("Expected the placeholder and 2 types, got %v (%v)", dropdown.GetOptionCount(), err)
+	}
+
+	for event, stale := range map[*changeEvent]bool{
+		{Writes: 3, ObjectTypes: []string{"folder"}}:            false,
+		{Writes: 1, ObjectTypes: []string{"document", "group"}}: true,
+		{Deletes: 1, ObjectTypes: []string{"folder"}}:           true,
+		{Rebuilt: true}: true,
+	} {
+		if dropdown.stale(*event) != stale {
+			t.Errorf("Expected %+v stale %v", *event, stale)
+		}
+	}
+	if loads != 1 {
+		t.Errorf("Deciding must not query the replica, got %v loads", loads)
+	}
+}
+
+// screenText is what the screen shows, row after row
+func screenText(screen tcell.SimulationScreen) string {
+	cells, width, _ := screen.GetContents()
+	var text strings.Builder
+	for i, cell := range cells {
+		text.WriteString(string(cell.Runes))
+		if (i+1)%width == 0 {
+			text.WriteString("\n")
+		}
+	}
+	return text.String()
+}
+
+func TestSyncUpdatesAreDrawn(t *testing.T) {
+	s := newSyncedStore(t, newFakeFga(t))
+	s.bus = &changeBus{}
+	stores := newSession(context.Background())
+	stores.stores = []*store{s}
+	screen := tcell.NewSimulationScreen("")
+	app := tview.NewApplication().SetScreen(screen)
+	root := AddComponents(context.Background(), app, stores, newLogRing(10))
+	go func() { _ = app.SetRoot(root, true).Run() }()
+	defer app.Stop()
+	// the screen is read between draws
+	shown := func() string {
+		text := make(chan string, 1)
+		app.QueueUpdate(func() { text <- screenText(screen) })
+		return <-text
+	}
+	waitFor := func(text string) {
+		t.Helper()
+		for timeout := time.After(5 * time.Second); !strings.Contains(shown(), text); {
+			select {
+			case <-timeout:
+				t.Fatalf("Expected %q on the screen, got\n%v", text, shown())
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}
+	waitFor("Sync:")
+
+	// nothing else redraws an idle store
+	s.publish(WatchUpdate{Store: s, Writes: 4217, Status: syncStatus{State: rejected}}, stores.watchUpdatesChan)
+	waitFor("4217")
+	waitFor("<ctrl-r> to reset")
+}